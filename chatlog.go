@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/jnwhiteh/wallops/chatlog"
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/sorcix/irc"
+)
+
+// logChat writes a message to the chat log of each channel or query it
+// belongs to. It is called before the message is processed, so that we
+// still know which channels someone was in when they quit or change nick.
+func (p *Proxy) logChat(msg *ircx.Message) {
+	if p.chatlog == nil {
+		return
+	}
+	line, ok := chatlog.Format(msg)
+	if !ok {
+		return
+	}
+
+	var targets []string
+	switch msg.Command {
+	case irc.PRIVMSG, irc.NOTICE:
+		// Notices from the server itself are diagnostics, not conversation
+		if !isText(msg) || !msg.Prefix.IsHostmask() {
+			return
+		}
+		targets = []string{p.conversation(msg)}
+	case irc.QUIT, irc.NICK:
+		targets = p.state.CommonChannels(msg.Prefix.Name)
+	case irc.MODE:
+		if !p.isupport.IsChannel(msg.Param(0)) {
+			return
+		}
+		targets = []string{msg.Param(0)}
+	default:
+		targets = []string{msg.Param(0)}
+	}
+	p.writeChatLog(targets, sentAt(msg), line)
+}
+
+func (p *Proxy) writeChatLog(targets []string, when time.Time, line string) {
+	for _, target := range targets {
+		if err := p.chatlog.Log(target, when, line); err != nil {
+			log.Printf("%sFailed to write the chat log for %s: %s%s", colorWarning, target, err, colorReset)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Package chatlog writes conversations to disk, one file per network,
+// channel (or query) and day, in the layout and line format used by ZNC's
+// log module:
+//
+//	network/#channel/2006-01-02.log
+//	[15:04:05] <alice> hello
+//	[15:04:05] *** Joins: bob (~b@example.net)
+//
+// Once a day is over its file can be compressed with gzip.
+package chatlog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/sorcix/irc"
+)
+
+var LoggerClosedError = fmt.Errorf("Chat log has been closed")
+
+// The layout of the date in file names
+const dayLayout = "2006-01-02"
+
+// Options controls where and how logs are written
+type Options struct {
+	Dir       string         // logs are written to Dir/network/target/
+	Timestamp string         // the time layout that starts each line, or empty for none
+	Location  *time.Location // the time zone for timestamps and the start of each day
+	Compress  bool           // gzip each file once its day is over
+}
+
+// Logger writes the logs for one network. It is safe for concurrent use.
+type Logger struct {
+	network string
+	options Options
+	files   map[string]*logFile // keyed by directory name
+	closed  bool
+
+	compressing sync.WaitGroup
+	pending     map[string]bool // files being compressed
+	sync.Mutex
+}
+
+// logFile is the open log of a target for a day
+type logFile struct {
+	day  string
+	file *os.File
+}
+
+func New(network string, options Options) *Logger {
+	if options.Location == nil {
+		options.Location = time.Local
+	}
+	return &Logger{
+		network: network,
+		options: options,
+		files:   make(map[string]*logFile),
+		pending: make(map[string]bool),
+	}
+}
+
+// Log appends a line to target's log for the day of when. If the target's
+// file is for an earlier day, it is closed (and compressed) first. Lines
+// that arrive late, stamped with an earlier day than the file's, are written
+// to the current file rather than reopening an old one.
+func (l *Logger) Log(target string, when time.Time, line string) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return LoggerClosedError
+	}
+
+	when = when.In(l.options.Location)
+	name := fileName(target)
+	day := when.Format(dayLayout)
+	current := l.files[name]
+	if current != nil && day > current.day {
+		// The file is compressed by open, with any others left behind
+		current.file.Close()
+		current = nil
+	}
+	if current == nil {
+		var err error
+		current, err = l.open(name, day)
+		if err != nil {
+			return err
+		}
+		l.files[name] = current
+	}
+
+	if l.options.Timestamp != "" {
+		line = when.Format(l.options.Timestamp) + " " + line
+	}
+	_, err := io.WriteString(current.file, line+"\n")
+	return err
+}
+
+// Close closes every open file and waits for any compression to finish.
+// Today's files are left uncompressed, to be picked up after a restart.
+func (l *Logger) Close() error {
+	l.Lock()
+	var err error
+	for name, current := range l.files {
+		if closeErr := current.file.Close(); closeErr != nil {
+			err = closeErr
+		}
+		delete(l.files, name)
+	}
+	l.closed = true
+	l.Unlock()
+
+	l.compressing.Wait()
+	return err
+}
+
+// open opens the log for a target and day, compressing any files left over
+// from earlier days (by a previous run, say) along the way. If there is a
+// file for a later day, that is opened instead.
+func (l *Logger) open(name, day string) (*logFile, error) {
+	dir := filepath.Join(l.options.Dir, fileName(l.network), name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	logs, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	for _, path := range logs {
+		if other, ok := logDay(path); ok && other > day {
+			day = other
+		}
+	}
+	file, err := os.OpenFile(filepath.Join(dir, day+".log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.options.Compress {
+		for _, path := range logs {
+			if other, ok := logDay(path); ok && other < day {
+				l.compressLater(path)
+			}
+		}
+	}
+	return &logFile{day: day, file: file}, nil
+}
+
+// logDay returns the day a log file is for, from its name
+func logDay(path string) (string, bool) {
+	day := strings.TrimSuffix(filepath.Base(path), ".log")
+	_, err := time.Parse(dayLayout, day)
+	return day, err == nil
+}
+
+// compressLater compresses a file in the background, unless it is already
+// being compressed. If that fails, the file is left as it is and tried
+// again the next time the target's log is opened.
+func (l *Logger) compressLater(path string) {
+	if l.pending[path] {
+		return
+	}
+	l.pending[path] = true
+	l.compressing.Add(1)
+	go func() {
+		defer l.compressing.Done()
+		compress(path)
+		l.Lock()
+		delete(l.pending, path)
+		l.Unlock()
+	}()
+}
+
+// compress replaces a file with a gzipped copy. If the day's file was
+// compressed before (when a log is reopened after midnight, say), the copy
+// is appended to it; gzip readers treat the result as one stream.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(out)
+	_, err = io.Copy(writer, in)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// fileName turns a network or target into a directory name. Names are
+// lower cased, like ZNC does, and path separators are replaced.
+func fileName(name string) string {
+	name = strings.ToLower(name)
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// Format returns the log line for a message, without a timestamp, and false
+// if the message isn't one that is logged. CTCPs other than ACTION aren't.
+func Format(msg *ircx.Message) (string, bool) {
+	if msg.Prefix == nil {
+		return "", false
+	}
+	nick := msg.Prefix.Name
+	mask := msg.Prefix.User + "@" + msg.Prefix.Host
+
+	switch msg.Command {
+	case irc.PRIVMSG:
+		text := msg.Param(1)
+		if action := strings.TrimPrefix(text, "\x01ACTION "); action != text {
+			return fmt.Sprintf("* %s %s", nick, strings.TrimSuffix(action, "\x01")), true
+		}
+		if strings.HasPrefix(text, "\x01") {
+			return "", false
+		}
+		return fmt.Sprintf("<%s> %s", nick, text), true
+	case irc.NOTICE:
+		if strings.HasPrefix(msg.Param(1), "\x01") {
+			return "", false
+		}
+		return fmt.Sprintf("-%s- %s", nick, msg.Param(1)), true
+	case irc.JOIN:
+		return fmt.Sprintf("*** Joins: %s (%s)", nick, mask), true
+	case irc.PART:
+		return fmt.Sprintf("*** Parts: %s (%s) (%s)", nick, mask, msg.Param(1)), true
+	case irc.QUIT:
+		return fmt.Sprintf("*** Quits: %s (%s) (%s)", nick, mask, msg.Param(0)), true
+	case irc.KICK:
+		return fmt.Sprintf("*** %s was kicked by %s (%s)", msg.Param(1), nick, msg.Param(2)), true
+	case irc.NICK:
+		return fmt.Sprintf("*** %s is now known as %s", nick, msg.Param(0)), true
+	case irc.TOPIC:
+		return fmt.Sprintf("*** %s changes topic to '%s'", nick, msg.Param(1)), true
+	case irc.MODE:
+		if len(msg.AllParams()) < 2 {
+			return "", false
+		}
+		return fmt.Sprintf("*** %s sets mode: %s", nick, strings.Join(msg.AllParams()[1:], " ")), true
+	}
+	return "", false
+}
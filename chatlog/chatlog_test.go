@@ -0,0 +1,141 @@
+package chatlog
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jnwhiteh/wallops/ircx"
+)
+
+func TestFormat(t *testing.T) {
+	for line, expected := range map[string]string{
+		":alice!~a@example.net PRIVMSG #wallops :hello":                   "<alice> hello",
+		":alice!~a@example.net PRIVMSG #wallops :\x01ACTION waves\x01":    "* alice waves",
+		":alice!~a@example.net NOTICE #wallops :heads up":                 "-alice- heads up",
+		":alice!~a@example.net JOIN #wallops":                             "*** Joins: alice (~a@example.net)",
+		":alice!~a@example.net PART #wallops :bye":                        "*** Parts: alice (~a@example.net) (bye)",
+		":alice!~a@example.net QUIT :Ping timeout":                        "*** Quits: alice (~a@example.net) (Ping timeout)",
+		":alice!~a@example.net KICK #wallops bob :behave":                 "*** bob was kicked by alice (behave)",
+		":alice!~a@example.net NICK :alicia":                              "*** alice is now known as alicia",
+		":alice!~a@example.net TOPIC #wallops :New topic":                 "*** alice changes topic to 'New topic'",
+		":alice!~a@example.net MODE #wallops +ov bob :carol":              "*** alice sets mode: +ov bob carol",
+		":alice!~a@example.net PRIVMSG bot :\x01VERSION\x01":              "",
+		":irc.example.net 001 bot :Welcome to the Internet Relay Network": "",
+	} {
+		got, ok := Format(ircx.ParseMessage(line))
+		if got != expected || ok != (expected != "") {
+			t.Errorf("Format(%q) = %q, %v, expected %q", line, got, ok, expected)
+		}
+	}
+}
+
+func readGzip(t *testing.T, path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %s", path, err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %s", path, err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %s", path, err)
+	}
+	return string(data)
+}
+
+func TestLoggerRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := Options{Dir: dir, Timestamp: "[15:04:05]", Location: time.UTC, Compress: true}
+	first := time.Date(2020, 1, 1, 23, 59, 0, 0, time.UTC)
+	second := first.Add(2 * time.Minute)
+
+	logger := New("Example", options)
+	logger.Log("#Wallops", first, "<alice> before midnight")
+	logger.Log("#Wallops", second, "<alice> after midnight")
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+
+	channel := filepath.Join(dir, "example", "#wallops")
+	if got := readGzip(t, filepath.Join(channel, "2020-01-01.log.gz")); got != "[23:59:00] <alice> before midnight\n" {
+		t.Errorf("Unexpected rotated log %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(channel, "2020-01-01.log")); !os.IsNotExist(err) {
+		t.Errorf("Expected the rotated log to be removed, got %v", err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(channel, "2020-01-02.log"))
+	if string(data) != "[00:01:00] <alice> after midnight\n" {
+		t.Errorf("Unexpected current log %q", data)
+	}
+	// Logs are private to the user running the proxy
+	for path, mode := range map[string]os.FileMode{
+		channel: os.ModeDir | 0700,
+		filepath.Join(channel, "2020-01-01.log.gz"): 0600,
+		filepath.Join(channel, "2020-01-02.log"):    0600,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Errorf("Failed to stat %s: %s", path, err)
+		} else if info.Mode() != mode {
+			t.Errorf("Expected %s to have mode %s, got %s", path, mode, info.Mode())
+		}
+	}
+
+	// After a restart, the previous day is compressed when the target's log
+	// is next opened
+	logger = New("Example", options)
+	logger.Log("#wallops", second.Add(24*time.Hour), "<alice> the next day")
+	logger.Close()
+	if got := readGzip(t, filepath.Join(channel, "2020-01-02.log.gz")); got != "[00:01:00] <alice> after midnight\n" {
+		t.Errorf("Unexpected log after restarting %q", got)
+	}
+
+	// Lines that arrive late go in the current file, which is never
+	// compressed, even across a restart
+	logger = New("Example", options)
+	logger.Log("#wallops", second.Add(24*time.Hour), "<alice> on time")
+	logger.Log("#wallops", second, "<alice> late")
+	logger.Close()
+	logger = New("Example", options)
+	logger.Log("#wallops", second, "<alice> later still")
+	logger.Close()
+	data, _ = ioutil.ReadFile(filepath.Join(channel, "2020-01-03.log"))
+	if string(data) != "[00:01:00] <alice> the next day\n[00:01:00] <alice> on time\n[00:01:00] <alice> late\n[00:01:00] <alice> later still\n" {
+		t.Errorf("Unexpected log after late lines %q", data)
+	}
+	if got := readGzip(t, filepath.Join(channel, "2020-01-02.log.gz")); got != "[00:01:00] <alice> after midnight\n" {
+		t.Errorf("Late lines changed an old log %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(channel, "2020-01-02.log")); !os.IsNotExist(err) {
+		t.Errorf("Expected no log to be reopened for a late line, got %v", err)
+	}
+
+	if err := logger.Log("#wallops", second, "closed"); err != LoggerClosedError {
+		t.Errorf("Expected %s, got %v", LoggerClosedError, err)
+	}
+}
+
+func TestFileName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"#Wallops": "#wallops",
+		"#a/../b":  "#a_.._b",
+		"..":       "_",
+		"":         "_",
+	} {
+		if got := fileName(name); got != expected {
+			t.Errorf("fileName(%q) = %q, expected %q", name, got, expected)
+		}
+	}
+}
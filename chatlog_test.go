@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jnwhiteh/wallops/chatlog"
+	"github.com/jnwhiteh/wallops/ircx"
+)
+
+func TestLogChat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chatlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	proxy := newBouncedProxy()
+	proxy.chatlog = chatlog.New("Example", chatlog.Options{Dir: dir, Location: time.UTC})
+	for _, line := range []string{
+		"@time=2020-01-01T12:00:00.000Z :alice!a@example.net PRIVMSG #wallops :hi",
+		"@time=2020-01-01T12:00:01.000Z :Alice!a@example.net PRIVMSG bot :psst",
+		"@time=2020-01-01T12:00:02.000Z :irc.example.net NOTICE bot :from the server",
+		"@time=2020-01-01T12:00:03.000Z :alice!a@example.net QUIT :bye",
+	} {
+		proxy.logChat(ircx.ParseMessage(line))
+	}
+	proxy.chatlog.Close()
+
+	for target, expected := range map[string]string{
+		"#wallops": "<alice> hi\n*** Quits: alice (a@example.net) (bye)\n",
+		"alice":    "<Alice> psst\n",
+	} {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "example", target, "2020-01-01.log"))
+		if string(data) != expected {
+			t.Errorf("%s was logged as %q", target, data)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example", "bot")); !os.IsNotExist(err) {
+		t.Errorf("Server notices shouldn't be logged")
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/jnwhiteh/wallops/chatlog"
+	"github.com/jnwhiteh/wallops/config"
+	"github.com/jnwhiteh/wallops/ircx"
+)
+
+// FileConfig is the configuration file for the proxy. Every setting can also
+// be given as a flag, which takes precedence over the file.
+type FileConfig struct {
+	Server struct {
+		Host         string `yaml:"host"`
+		Port         int    `yaml:"port"`
+		Password     string `yaml:"password"`
+		Nick         string `yaml:"nick"`
+		RealName     string `yaml:"realname"`
+		Capabilities string `yaml:"capabilities"` // comma-separated, or empty for the defaults
+		Channels     string `yaml:"channels"`     // as for -join
+
+		TLS struct {
+			Enabled            bool   `yaml:"enabled"`
+			ServerName         string `yaml:"server_name"`
+			CAFile             string `yaml:"ca_file"`
+			InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+			CertFile           string `yaml:"cert_file"`
+			KeyFile            string `yaml:"key_file"`
+		} `yaml:"tls"`
+
+		SASL struct {
+			Mechanism string `yaml:"mechanism"`
+			Username  string `yaml:"username"`
+			Password  string `yaml:"password"`
+		} `yaml:"sasl"`
+	} `yaml:"server"`
+
+	Flood struct {
+		Burst int     `yaml:"burst"`
+		Rate  float64 `yaml:"rate"`
+		Size  int     `yaml:"size"`
+	} `yaml:"flood"`
+
+	Reconnect struct {
+		MaxAttempts int           `yaml:"max_attempts"`
+		MaxDelay    time.Duration `yaml:"max_delay"`
+	} `yaml:"reconnect"`
+
+	Timeouts config.Timeouts `yaml:"timeouts"`
+
+	Clients struct {
+		Listen   string              `yaml:"listen"`   // where to accept IRC clients, or empty
+		Password string              `yaml:"password"` // sent by clients with PASS
+		Buffer   int                 `yaml:"buffer"`   // messages buffered for each client
+		Overflow ircx.OverflowPolicy `yaml:"overflow"` // what to do when a client falls behind
+	} `yaml:"clients"`
+
+	Backlog struct {
+		Size   int           `yaml:"size"`    // messages kept for each channel and query
+		MaxAge time.Duration `yaml:"max_age"` // how long they are kept, or 0 for no limit
+	} `yaml:"backlog"`
+
+	ChatLog struct {
+		Dir       string `yaml:"dir"`       // where to write chat logs, or empty to not write them
+		Timestamp string `yaml:"timestamp"` // the time layout that starts each line
+		Timezone  string `yaml:"timezone"`  // Local, UTC or a zone such as Europe/London
+		Compress  bool   `yaml:"compress"`  // gzip each day's logs once it is over
+	} `yaml:"chatlog"`
+
+	History struct {
+		Dir string `yaml:"dir"` // where to keep searchable history, or empty to not keep it
+	} `yaml:"history"`
+
+	Console struct {
+		Buffer   int                 `yaml:"buffer"`   // messages buffered for the console
+		Overflow ircx.OverflowPolicy `yaml:"overflow"` // what to do when the console falls behind
+	} `yaml:"console"`
+
+	Metrics struct {
+		Listen string `yaml:"listen"` // where to serve /metrics, or empty
+	} `yaml:"metrics"`
+
+	Log struct {
+		Level config.LogLevel `yaml:"level"`
+	} `yaml:"log"`
+}
+
+func DefaultFileConfig() FileConfig {
+	var c FileConfig
+	c.Server.Host = "localhost"
+	c.Server.Port = 6667
+	c.Server.Nick = "bjornbot"
+	c.Server.RealName = "Bjornbot"
+	c.Flood.Burst = ircx.DefaultFloodConfig.Burst
+	c.Flood.Rate = ircx.DefaultFloodConfig.Rate
+	c.Flood.Size = ircx.DefaultFloodConfig.Size
+	c.Reconnect.MaxAttempts = ircx.DefaultReconnectPolicy.MaxAttempts
+	c.Reconnect.MaxDelay = ircx.DefaultReconnectPolicy.MaxDelay
+	c.Clients.Buffer = 256
+	c.Clients.Overflow = ircx.Disconnect
+	c.Backlog.Size = 500
+	c.Backlog.MaxAge = 24 * time.Hour
+	c.ChatLog.Timestamp = "[15:04:05]"
+	c.ChatLog.Timezone = "Local"
+	c.ChatLog.Compress = true
+	c.Console.Buffer = 1024
+	c.Console.Overflow = ircx.DropOldest
+	c.Timeouts = config.Timeouts{
+		Proxy:           time.Second * 30,
+		Pong:            time.Second * 15,
+		MissedDeadlines: 5,
+	}
+	c.Log.Level = config.Debug
+	return c
+}
+
+func (c *FileConfig) Validate() error {
+	if c.Server.Host == "" {
+		return config.Invalid("server.host", "must be set")
+	}
+	if err := config.ValidatePort("server.port", c.Server.Port); err != nil {
+		return err
+	}
+	if !ircx.ValidNickname(c.Server.Nick) {
+		return config.Invalid("server.nick", "%q is not a valid nickname", c.Server.Nick)
+	}
+	if c.Server.RealName == "" {
+		return config.Invalid("server.realname", "must be set")
+	}
+	if (c.Server.TLS.CertFile == "") != (c.Server.TLS.KeyFile == "") {
+		return config.Invalid("server.tls", "cert_file and key_file must be set together")
+	}
+	if !c.SASL().Valid() {
+		return config.Invalid("server.sasl", "mechanism %q is unknown or is missing a username or password", c.Server.SASL.Mechanism)
+	}
+	if c.Flood.Burst < 1 {
+		return config.Invalid("flood.burst", "must be at least 1, got %d", c.Flood.Burst)
+	}
+	if c.Flood.Rate <= 0 {
+		return config.Invalid("flood.rate", "must be positive, got %v", c.Flood.Rate)
+	}
+	if c.Flood.Size < 1 {
+		return config.Invalid("flood.size", "must be at least 1, got %d", c.Flood.Size)
+	}
+	if c.Reconnect.MaxAttempts < 0 {
+		return config.Invalid("reconnect.max_attempts", "must not be negative, got %d", c.Reconnect.MaxAttempts)
+	}
+	if c.Reconnect.MaxDelay <= 0 {
+		return config.Invalid("reconnect.max_delay", "must be positive, got %v", c.Reconnect.MaxDelay)
+	}
+	if c.Clients.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Clients.Listen); err != nil {
+			return config.Invalid("clients.listen", "%q is not a host:port address", c.Clients.Listen)
+		}
+		if c.Clients.Password == "" {
+			return config.Invalid("clients.password", "must be set to accept IRC clients")
+		}
+	}
+	if c.Clients.Buffer < 1 {
+		return config.Invalid("clients.buffer", "must be at least 1, got %d", c.Clients.Buffer)
+	}
+	if c.Backlog.Size < 0 {
+		return config.Invalid("backlog.size", "must not be negative, got %d", c.Backlog.Size)
+	}
+	if c.Backlog.MaxAge < 0 {
+		return config.Invalid("backlog.max_age", "must not be negative, got %s", c.Backlog.MaxAge)
+	}
+	if _, err := time.LoadLocation(c.ChatLog.Timezone); err != nil {
+		return config.Invalid("chatlog.timezone", "%s", err)
+	}
+	if c.Console.Buffer < 1 {
+		return config.Invalid("console.buffer", "must be at least 1, got %d", c.Console.Buffer)
+	}
+	if c.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			return config.Invalid("metrics.listen", "%q is not a host:port address", c.Metrics.Listen)
+		}
+	}
+	return c.Timeouts.Validate()
+}
+
+func (c *FileConfig) SASL() ircx.SASLConfig {
+	return ircx.SASLConfig{
+		Mechanism: c.Server.SASL.Mechanism,
+		Username:  c.Server.SASL.Username,
+		Password:  c.Server.SASL.Password,
+	}
+}
+
+// ProxyConfig returns the settings used to connect to the server
+func (c *FileConfig) ProxyConfig() ProxyConfig {
+	reconnect := ircx.DefaultReconnectPolicy
+	reconnect.MaxAttempts = c.Reconnect.MaxAttempts
+	reconnect.MaxDelay = c.Reconnect.MaxDelay
+	// Validate has already checked the timezone
+	location, _ := time.LoadLocation(c.ChatLog.Timezone)
+
+	return ProxyConfig{
+		host:     c.Server.Host,
+		port:     c.Server.Port,
+		password: c.Server.Password,
+		nick:     c.Server.Nick,
+		realName: c.Server.RealName,
+		tls: ircx.TLSConfig{
+			Enabled:            c.Server.TLS.Enabled,
+			ServerName:         c.Server.TLS.ServerName,
+			CAFile:             c.Server.TLS.CAFile,
+			InsecureSkipVerify: c.Server.TLS.InsecureSkipVerify,
+			CertFile:           c.Server.TLS.CertFile,
+			KeyFile:            c.Server.TLS.KeyFile,
+		},
+		sasl: c.SASL(),
+		caps: ircx.ParseCapabilities(c.Server.Capabilities),
+		flood: ircx.FloodConfig{
+			Burst: c.Flood.Burst,
+			Rate:  c.Flood.Rate,
+			Size:  c.Flood.Size,
+		},
+		channels:  ircx.ParseChannels(c.Server.Channels),
+		reconnect: reconnect,
+		console:   bufferConfig{size: c.Console.Buffer, overflow: c.Console.Overflow},
+		clients:   bufferConfig{size: c.Clients.Buffer, overflow: c.Clients.Overflow},
+		backlog:   ircx.BacklogLimits{Size: c.Backlog.Size, MaxAge: c.Backlog.MaxAge},
+		chatlog: chatlog.Options{
+			Dir:       c.ChatLog.Dir,
+			Timestamp: c.ChatLog.Timestamp,
+			Location:  location,
+			Compress:  c.ChatLog.Compress,
+		},
+	}
+}
+
+// applyFlags overrides the file with any flags given on the command line
+func (c *FileConfig) applyFlags() {
+	overrides := map[string]func(){
+		"host":                func() { c.Server.Host = *host },
+		"port":                func() { c.Server.Port = *port },
+		"password":            func() { c.Server.Password = *password },
+		"nick":                func() { c.Server.Nick = *nick },
+		"realname":            func() { c.Server.RealName = *realName },
+		"tls":                 func() { c.Server.TLS.Enabled = *useTLS },
+		"tls-servername":      func() { c.Server.TLS.ServerName = *tlsServerName },
+		"tls-ca":              func() { c.Server.TLS.CAFile = *tlsCAFile },
+		"tls-insecure":        func() { c.Server.TLS.InsecureSkipVerify = *tlsInsecure },
+		"tls-cert":            func() { c.Server.TLS.CertFile = *tlsCertFile },
+		"tls-key":             func() { c.Server.TLS.KeyFile = *tlsKeyFile },
+		"sasl":                func() { c.Server.SASL.Mechanism = *saslMechanism },
+		"sasl-user":           func() { c.Server.SASL.Username = *saslUsername },
+		"sasl-password":       func() { c.Server.SASL.Password = *saslPassword },
+		"caps":                func() { c.Server.Capabilities = *capabilities },
+		"flood-burst":         func() { c.Flood.Burst = *floodBurst },
+		"flood-rate":          func() { c.Flood.Rate = *floodRate },
+		"sendq":               func() { c.Flood.Size = *sendQueue },
+		"join":                func() { c.Server.Channels = *join },
+		"reconnect-attempts":  func() { c.Reconnect.MaxAttempts = *reconnectAttempts },
+		"reconnect-max-delay": func() { c.Reconnect.MaxDelay = *reconnectMaxDelay },
+		"proxy-timeout":       func() { c.Timeouts.Proxy = *deadlineTimeout },
+		"pong-timeout":        func() { c.Timeouts.Pong = *pongWait },
+		"missed-deadlines":    func() { c.Timeouts.MissedDeadlines = *missedDeadlines },
+		"log-level":           func() { c.Log.Level, _ = config.ParseLogLevel(*logLevel) },
+		"listen":              func() { c.Clients.Listen = *clientsAddr },
+		"listen-password":     func() { c.Clients.Password = *clientsPassword },
+		"client-buffer":       func() { c.Clients.Buffer = *clientBuffer },
+		"client-overflow":     func() { c.Clients.Overflow, _ = ircx.ParseOverflowPolicy(*clientOverflow) },
+		"backlog-size":        func() { c.Backlog.Size = *backlogSize },
+		"backlog-age":         func() { c.Backlog.MaxAge = *backlogAge },
+		"chatlog":             func() { c.ChatLog.Dir = *chatlogDir },
+		"chatlog-timestamp":   func() { c.ChatLog.Timestamp = *chatlogTimestamp },
+		"chatlog-timezone":    func() { c.ChatLog.Timezone = *chatlogTimezone },
+		"chatlog-compress":    func() { c.ChatLog.Compress = *chatlogCompress },
+		"history":             func() { c.History.Dir = *historyDir },
+		"console-buffer":      func() { c.Console.Buffer = *consoleBuffer },
+		"console-overflow":    func() { c.Console.Overflow, _ = ircx.ParseOverflowPolicy(*consoleOverflow) },
+		"metrics":             func() { c.Metrics.Listen = *metricsAddr },
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if override, ok := overrides[f.Name]; ok {
+			override()
+		}
+	})
+}
+
+// loadConfig builds the configuration from the defaults, the file given
+// with -config (if any) and the flags, in that order.
+func loadConfig() (FileConfig, error) {
+	c := DefaultFileConfig()
+	if *configPath != "" {
+		err := config.Load(*configPath, &c)
+		if err != nil {
+			return c, err
+		}
+	}
+	if _, err := config.ParseLogLevel(*logLevel); err != nil {
+		return c, config.Invalid("-log-level", "%s", err)
+	}
+	if _, err := ircx.ParseOverflowPolicy(*clientOverflow); err != nil {
+		return c, config.Invalid("-client-overflow", "%s", err)
+	}
+	if _, err := ircx.ParseOverflowPolicy(*consoleOverflow); err != nil {
+		return c, config.Invalid("-console-overflow", "%s", err)
+	}
+	c.applyFlags()
+	return c, c.Validate()
+}
+
+// reloadOnHangup reloads the configuration whenever we receive SIGHUP. The
+// timeouts and log level apply to the running connection straight away, but
+// changes to anything else need a restart.
+func reloadOnHangup(current FileConfig) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		next, err := loadConfig()
+		if err != nil {
+			log.Printf("%sNot reloading configuration: %s%s", colorWarning, err, colorReset)
+			continue
+		}
+		live.Update(next.Timeouts, next.Log.Level)
+		log.Printf("Reloaded configuration (log level %s, timeouts %+v)", next.Log.Level, next.Timeouts)
+
+		if !reflect.DeepEqual(next.ProxyConfig(), current.ProxyConfig()) || next.Clients != current.Clients || next.History != current.History || next.Console != current.Console || next.Metrics != current.Metrics {
+			log.Printf("%sChanges to the server, flood, reconnect, clients, backlog, chat log, history, console and metrics settings need a restart%s", colorWarning, colorReset)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Package config loads the YAML configuration files used by the wallops
+// binaries, and holds the settings that can be changed while they run.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Validator is implemented by configuration that can check itself once it
+// has been loaded.
+type Validator interface {
+	Validate() error
+}
+
+// Load reads a YAML file into config, which should already hold the
+// defaults for anything the file leaves out. Unknown keys are an error, so
+// that typos don't silently fall back to the defaults.
+func Load(path string, config Validator) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	err = config.Validate()
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// FieldError reports an invalid setting, naming it as it appears in the
+// file, e.g. "server.port".
+type FieldError struct {
+	Field  string
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+// Invalid returns a FieldError for field
+func Invalid(field, format string, args ...interface{}) error {
+	return &FieldError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// ValidatePort checks that port is a usable TCP port
+func ValidatePort(field string, port int) error {
+	if port < 1 || port > 65535 {
+		return Invalid(field, "must be between 1 and 65535, got %d", port)
+	}
+	return nil
+}
+
+// Timeouts control how long we wait on the network before deciding a
+// connection is dead.
+type Timeouts struct {
+	Proxy           time.Duration `yaml:"proxy"`            // read and write deadlines
+	Pong            time.Duration `yaml:"pong"`             // how long to wait for an answer to our PING
+	MissedDeadlines int           `yaml:"missed_deadlines"` // quiet read deadlines before we PING
+}
+
+func (t Timeouts) Validate() error {
+	if t.Proxy <= 0 {
+		return Invalid("timeouts.proxy", "must be positive, got %v", t.Proxy)
+	}
+	if t.Pong <= 0 {
+		return Invalid("timeouts.pong", "must be positive, got %v", t.Pong)
+	}
+	if t.MissedDeadlines < 1 {
+		return Invalid("timeouts.missed_deadlines", "must be at least 1, got %d", t.MissedDeadlines)
+	}
+	return nil
+}
+
+// LogLevel controls how much is logged
+type LogLevel int
+
+const (
+	Debug LogLevel = iota // everything, including each message sent and received
+	Info                  // connections, errors and other events
+)
+
+func ParseLogLevel(level string) (LogLevel, error) {
+	switch level {
+	case "debug":
+		return Debug, nil
+	case "info":
+		return Info, nil
+	}
+	return Info, fmt.Errorf("unknown log level %q, expected debug or info", level)
+}
+
+func (l LogLevel) String() string {
+	if l == Debug {
+		return "debug"
+	}
+	return "info"
+}
+
+func (l *LogLevel) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	err := unmarshal(&name)
+	if err != nil {
+		return err
+	}
+	*l, err = ParseLogLevel(name)
+	return err
+}
+
+func (l LogLevel) MarshalYAML() (interface{}, error) {
+	return l.String(), nil
+}
+
+// Live holds the settings that are safe to change while connections are
+// running. Connections read them each time they need them, so an update
+// applies straight away.
+type Live struct {
+	timeouts Timeouts
+	level    LogLevel
+	sync.RWMutex
+}
+
+func NewLive(timeouts Timeouts, level LogLevel) *Live {
+	return &Live{timeouts: timeouts, level: level}
+}
+
+func (l *Live) Timeouts() Timeouts {
+	l.RLock()
+	defer l.RUnlock()
+	return l.timeouts
+}
+
+func (l *Live) LogLevel() LogLevel {
+	l.RLock()
+	defer l.RUnlock()
+	return l.level
+}
+
+// Debug reports whether debug logging is enabled
+func (l *Live) Debug() bool {
+	return l.LogLevel() == Debug
+}
+
+func (l *Live) Update(timeouts Timeouts, level LogLevel) {
+	l.Lock()
+	l.timeouts = timeouts
+	l.level = level
+	l.Unlock()
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Port     int      `yaml:"port"`
+	Timeouts Timeouts `yaml:"timeouts"`
+	Log      struct {
+		Level LogLevel `yaml:"level"`
+	} `yaml:"log"`
+}
+
+func (c *testConfig) Validate() error {
+	if err := ValidatePort("port", c.Port); err != nil {
+		return err
+	}
+	return c.Timeouts.Validate()
+}
+
+func defaultTestConfig() *testConfig {
+	c := &testConfig{Port: 6667, Timeouts: Timeouts{time.Second, time.Second, 1}}
+	c.Log.Level = Debug
+	return c
+}
+
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, "port: 6697\ntimeouts:\n  pong: 30s\nlog:\n  level: info\n")
+	c := defaultTestConfig()
+	if err := Load(path, c); err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	if c.Port != 6697 || c.Timeouts.Pong != 30*time.Second || c.Log.Level != Info {
+		t.Errorf("Load read %+v", c)
+	}
+	// Settings the file leaves out keep their defaults
+	if c.Timeouts.Proxy != time.Second || c.Timeouts.MissedDeadlines != 1 {
+		t.Errorf("Defaults were not kept: %+v", c.Timeouts)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		contents string
+		expected string
+	}{
+		{"prot: 6697\n", "field prot not found"},
+		{"port: 70000\n", "port: must be between 1 and 65535, got 70000"},
+		{"timeouts:\n  proxy: 0s\n", "timeouts.proxy: must be positive, got 0s"},
+		{"timeouts:\n  missed_deadlines: 0\n", "timeouts.missed_deadlines: must be at least 1, got 0"},
+		{"timeouts:\n  pong: soon\n", "soon"},
+		{"log:\n  level: loud\n", `unknown log level "loud"`},
+	}
+
+	for _, test := range tests {
+		path := writeConfig(t, test.contents)
+		err := Load(path, defaultTestConfig())
+		if err == nil {
+			t.Errorf("Load(%q) succeeded", test.contents)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), path+": ") || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Load(%q) = %q, expected it to name the file and contain %q", test.contents, err, test.expected)
+		}
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	err := Load(filepath.Join(t.TempDir(), "missing.yaml"), defaultTestConfig())
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected a missing file error, got %v", err)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, level := range []LogLevel{Debug, Info} {
+		parsed, err := ParseLogLevel(level.String())
+		if err != nil || parsed != level {
+			t.Errorf("ParseLogLevel(%q) = %v, %v", level, parsed, err)
+		}
+	}
+	if _, err := ParseLogLevel("DEBUG"); err == nil {
+		t.Errorf("ParseLogLevel accepted DEBUG")
+	}
+}
+
+func TestLiveUpdate(t *testing.T) {
+	live := NewLive(Timeouts{time.Second, time.Second, 1}, Debug)
+	if !live.Debug() {
+		t.Errorf("Expected debug logging")
+	}
+
+	timeouts := Timeouts{time.Minute, 2 * time.Minute, 3}
+	live.Update(timeouts, Info)
+	if live.Timeouts() != timeouts {
+		t.Errorf("Timeouts() = %+v, expected %+v", live.Timeouts(), timeouts)
+	}
+	if live.Debug() || live.LogLevel() != Info {
+		t.Errorf("Expected info logging, got %s", live.LogLevel())
+	}
+}
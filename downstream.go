@@ -0,0 +1,549 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/sorcix/irc"
+)
+
+// The name we use as the prefix of messages that come from the proxy itself
+// rather than the upstream server
+const serverName = "wallops"
+
+var (
+	// startedAt is when the proxy started, for RPL_CREATED
+	startedAt = time.Now()
+
+	clientQueueSize     = 256              // messages waiting to be written to a client
+	registrationTimeout = 30 * time.Second // how long a client has to register
+
+	// clientCaps are the capabilities we offer to clients
+	clientCaps = []string{"server-time"}
+
+	badPasswordError  = fmt.Errorf("Bad password")
+	slowClientError   = fmt.Errorf("Client is not reading fast enough")
+	clientClosedError = fmt.Errorf("Client connection closed")
+)
+
+// client is an IRC client attached to the proxy. Once it has registered, it
+// subscribes to everything the upstream server sends us, and everything it
+// sends is relayed upstream.
+type client struct {
+	conn    net.Conn
+	reader  messageReader
+	encoder *ircx.Encoder
+
+	nick string // the nick the client registered with
+	user string // the username, which tells apart clients catching up on the backlog
+
+	serverTime bool // the client negotiated server-time
+
+	outgoing  chan *ircx.Message // replies from the proxy itself, waiting to be written
+	done      chan struct{}      // closed once the client is closed
+	closeOnce sync.Once
+}
+
+// clientMessage is a message sent by a client, to be relayed upstream
+type clientMessage struct {
+	client *client
+	msg    *ircx.Message
+}
+
+func newClient(conn net.Conn) *client {
+	return &client{
+		conn:     conn,
+		reader:   &safeReader{ircx.NewLimitedDecoder(conn, ircx.MaxLineLength)},
+		encoder:  ircx.NewEncoder(conn),
+		outgoing: make(chan *ircx.Message, clientQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// ListenForClients accepts IRC client connections on addr. Clients must
+// send password with PASS before they are let in.
+func (p *Proxy) ListenForClients(addr, password string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Accepting IRC clients on %s", listener.Addr())
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("%sStopped accepting IRC clients: %s%s", colorWarning, err, colorReset)
+				return
+			}
+			go p.serveClient(newClient(conn), password)
+		}
+	}()
+	return nil
+}
+
+// serveClient registers a client, hands it to the run loop and then reads
+// its messages until it goes away.
+func (p *Proxy) serveClient(c *client, password string) {
+	defer c.Close()
+
+	c.conn.SetReadDeadline(time.Now().Add(registrationTimeout))
+	err := c.register(password)
+	if err != nil {
+		log.Printf("%sClient %s failed to register: %s%s", colorWarning, c.conn.RemoteAddr(), err, colorReset)
+		return
+	}
+	c.conn.SetReadDeadline(time.Time{})
+
+	log.Printf("Client %s registered as %s", c.conn.RemoteAddr(), c.nick)
+	p.attach <- c
+	defer func() { p.detach <- c }()
+
+	for {
+		msg, err := c.reader.ReadMessage()
+		if err == parseError {
+			continue
+		} else if err != nil {
+			return
+		}
+
+		switch msg.Command {
+		case irc.PING:
+			c.Send(&irc.Message{
+				Prefix:   &irc.Prefix{Name: serverName},
+				Command:  irc.PONG,
+				Params:   []string{serverName},
+				Trailing: msg.Trailing,
+			})
+		case irc.QUIT:
+			return
+		case ircx.CAP:
+			if reply := c.negotiate(msg, true); reply != nil {
+				c.Send(reply)
+			}
+		case irc.PASS, irc.USER:
+			// Registration is over
+		default:
+			select {
+			case p.fromClients <- clientMessage{c, msg}:
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+// register reads PASS, NICK and USER from the client, negotiating
+// capabilities along the way. The password is checked once both NICK and
+// USER have arrived, and capability negotiation (if started) has ended.
+func (c *client) register(password string) error {
+	var pass string
+	negotiating := false
+	for c.nick == "" || c.user == "" || negotiating {
+		msg, err := c.reader.ReadMessage()
+		if err == parseError {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		switch msg.Command {
+		case irc.PASS:
+			pass = msg.Param(0)
+		case irc.NICK:
+			c.nick = msg.Param(0)
+		case irc.USER:
+			c.user = msg.Param(0)
+		case ircx.CAP:
+			switch msg.Param(0) {
+			case "LS", "REQ":
+				negotiating = true
+			case "END":
+				negotiating = false
+			}
+			if reply := c.negotiate(msg, false); reply != nil {
+				c.write(reply)
+			}
+		case irc.PING:
+			c.write(&irc.Message{Prefix: &irc.Prefix{Name: serverName}, Command: irc.PONG, Params: []string{serverName}, Trailing: msg.Trailing})
+		case irc.QUIT:
+			return clientClosedError
+		}
+	}
+
+	if subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+		c.write(&irc.Message{
+			Prefix:   &irc.Prefix{Name: serverName},
+			Command:  irc.ERR_PASSWDMISMATCH,
+			Params:   []string{c.nick},
+			Trailing: "Password incorrect",
+		})
+		c.write(&irc.Message{Command: irc.ERROR, Trailing: "Closing link: password incorrect"})
+		return badPasswordError
+	}
+	return nil
+}
+
+// negotiate answers a CAP command from the client, returning nil if there
+// is nothing to say. Capabilities can only be requested during registration,
+// as the writer relies on them not changing once it has started.
+func (c *client) negotiate(msg *ircx.Message, registered bool) *irc.Message {
+	target := c.nick
+	if target == "" {
+		target = "*"
+	}
+	reply := &irc.Message{
+		Prefix:        &irc.Prefix{Name: serverName},
+		Command:       ircx.CAP,
+		Params:        []string{target, msg.Param(0)},
+		EmptyTrailing: true,
+	}
+
+	switch msg.Param(0) {
+	case "LS":
+		reply.Trailing = strings.Join(clientCaps, " ")
+	case "LIST":
+		if c.serverTime {
+			reply.Trailing = "server-time"
+		}
+	case "REQ":
+		requested := strings.Fields(msg.Param(1))
+		reply.Trailing = strings.Join(requested, " ")
+		reply.Params[1] = "NAK"
+		if registered || len(requested) == 0 {
+			return reply
+		}
+		for _, name := range requested {
+			if name != "server-time" {
+				return reply
+			}
+		}
+		reply.Params[1] = "ACK"
+		c.serverTime = true
+	default:
+		return nil
+	}
+	return reply
+}
+
+// write writes a message straight to the client, for use before the writer
+// has started
+func (c *client) write(msg *irc.Message) error {
+	c.conn.SetWriteDeadline(time.Now().Add(live.Timeouts().Proxy))
+	return c.encoder.Encode(ircx.Wrap(msg))
+}
+
+// Send queues a message for the client without blocking. A client that
+// falls too far behind is disconnected, so that it can't hold up the proxy.
+func (c *client) Send(msg *irc.Message) {
+	select {
+	case c.outgoing <- ircx.Wrap(msg):
+	case <-c.done:
+	default:
+		log.Printf("%sDisconnecting %s: %s%s", colorWarning, c.conn.RemoteAddr(), slowClientError, colorReset)
+		c.Close()
+	}
+}
+
+// writeMessages writes the proxy's replies and the messages from the
+// subscription to the client, until either the client or the subscription
+// goes away. The initial messages, the registration burst and the backlog,
+// are written first. They are written directly rather than queued, as a
+// burst for many channels can be larger than the queue.
+func (c *client) writeMessages(sub *ircx.Subscription, initial []*ircx.Message) {
+	defer c.Close()
+	for _, msg := range initial {
+		if c.encode(msg) != nil {
+			return
+		}
+	}
+
+	for {
+		var msg *ircx.Message
+
+		// Replies from the proxy, such as the registration burst, go first
+		select {
+		case msg = <-c.outgoing:
+		default:
+			select {
+			case msg = <-c.outgoing:
+			case relayed, ok := <-sub.Messages():
+				if !ok {
+					if err := sub.Err(); err != nil {
+						log.Printf("%sDisconnecting %s: %s%s", colorWarning, c.conn.RemoteAddr(), err, colorReset)
+					}
+					return
+				}
+				msg = c.tagged(relayed)
+			case <-c.done:
+				return
+			}
+		}
+
+		if c.encode(msg) != nil {
+			return
+		}
+	}
+}
+
+func (c *client) encode(msg *ircx.Message) error {
+	c.conn.SetWriteDeadline(time.Now().Add(live.Timeouts().Proxy))
+	return c.encoder.Encode(msg)
+}
+
+// replay prepares the messages a client missed. Clients that negotiated
+// server-time get the original times in tags; for the others, the time is
+// added to the text.
+func (c *client) replay(entries []ircx.BacklogEntry) []*ircx.Message {
+	var msgs []*ircx.Message
+	for _, entry := range entries {
+		msg := *entry.Message.Message
+		if c.serverTime {
+			msgs = append(msgs, &ircx.Message{Message: &msg, Tags: ircx.Tags{"time": ircx.ServerTime(entry.Time)}})
+			continue
+		}
+
+		stamp := entry.Time.Local().Format("[2006-01-02 15:04:05] ")
+		if strings.HasPrefix(msg.Trailing, "\x01ACTION ") {
+			msg.Trailing = "\x01ACTION " + stamp + strings.TrimPrefix(msg.Trailing, "\x01ACTION ")
+		} else {
+			msg.Trailing = stamp + msg.Trailing
+		}
+		msgs = append(msgs, ircx.Wrap(&msg))
+	}
+	return msgs
+}
+
+// tagged prepares a relayed message for the client, which only gets the
+// server-time tag and only if it asked for it. The message itself is shared
+// with other subscribers, so it isn't modified.
+func (c *client) tagged(msg *ircx.Message) *ircx.Message {
+	if !c.serverTime {
+		return untagged(msg)
+	}
+	when, ok := msg.Time()
+	if !ok {
+		when = time.Now()
+	}
+	return &ircx.Message{Message: msg.Message, Tags: ircx.Tags{"time": ircx.ServerTime(when)}}
+}
+
+func (c *client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// welcome builds the registration burst for a newly registered client,
+// describing the upstream connection: the welcome numerics, RPL_ISUPPORT, a
+// MOTD, and a JOIN, topic and NAMES for each channel we are in.
+func (p *Proxy) welcome(c *client) []*ircx.Message {
+	var burst []*ircx.Message
+	send := func(msg *irc.Message) {
+		burst = append(burst, ircx.Wrap(msg))
+	}
+	numeric := func(command string, params []string, trailing string) {
+		send(&irc.Message{
+			Prefix:   &irc.Prefix{Name: serverName},
+			Command:  command,
+			Params:   append([]string{p.currentNick}, params...),
+			Trailing: trailing,
+		})
+	}
+
+	numeric(irc.RPL_WELCOME, nil, "Welcome to the Internet Relay Network "+p.selfMask())
+	numeric(irc.RPL_YOURHOST, nil, fmt.Sprintf("Your host is %s, relaying %s", serverName, p.addr))
+	numeric(irc.RPL_CREATED, nil, "This server was created "+startedAt.Format(time.RFC1123))
+	chanModes := p.isupport.ChanModes()
+	prefixModes, _ := p.isupport.Prefix()
+	numeric(irc.RPL_MYINFO, []string{serverName, serverName, "iow", strings.Join(chanModes[:], "") + prefixModes}, "")
+
+	tokens := isupportTokens(p.isupport)
+	for len(tokens) > 0 {
+		n := len(tokens)
+		if n > 12 {
+			n = 12
+		}
+		numeric(ircx.RPL_ISUPPORT, tokens[:n], "are supported by this server")
+		tokens = tokens[n:]
+	}
+
+	// The client may have asked for a different nick to the one we have
+	if c.nick != p.currentNick {
+		send(&irc.Message{
+			Prefix:   &irc.Prefix{Name: c.nick, User: c.user, Host: serverName},
+			Command:  irc.NICK,
+			Trailing: p.currentNick,
+		})
+	}
+
+	numeric(irc.RPL_MOTDSTART, nil, fmt.Sprintf("- %s Message of the day -", serverName))
+	numeric(irc.RPL_MOTD, nil, fmt.Sprintf("- Connected to %s as %s", p.addr, p.currentNick))
+	numeric(irc.RPL_ENDOFMOTD, nil, "End of /MOTD command.")
+
+	for _, name := range p.state.Channels() {
+		info, ok := p.state.Channel(name)
+		if !ok {
+			continue
+		}
+		send(&irc.Message{
+			Prefix:  irc.ParsePrefix(p.selfMask()),
+			Command: irc.JOIN,
+			Params:  []string{info.Name},
+		})
+		if info.Topic != "" {
+			numeric(irc.RPL_TOPIC, []string{info.Name}, info.Topic)
+		}
+		for _, names := range namesLines(info.Members) {
+			numeric(irc.RPL_NAMREPLY, []string{"=", info.Name}, names)
+		}
+		numeric(irc.RPL_ENDOFNAMES, []string{info.Name}, "End of /NAMES list.")
+	}
+	return burst
+}
+
+// selfMask returns our nick!user@host, or just our nick if the server hasn't
+// told us the rest
+func (p *Proxy) selfMask() string {
+	if p.hostmask != "" {
+		return p.hostmask
+	}
+	return p.currentNick
+}
+
+// isupportTokens returns the server's RPL_ISUPPORT tokens, sorted, as they
+// would appear in the numeric
+func isupportTokens(isupport *ircx.ISupport) []string {
+	escaper := strings.NewReplacer(`\`, `\x5C`, " ", `\x20`, "=", `\x3D`)
+	var tokens []string
+	for name, value := range isupport.Tokens() {
+		if value == "" {
+			tokens = append(tokens, name)
+		} else {
+			tokens = append(tokens, name+"="+escaper.Replace(value))
+		}
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// namesLines splits a channel's members into RPL_NAMREPLY lines. Clients
+// haven't negotiated multi-prefix, so each member has only their highest
+// prefix.
+func namesLines(members []ircx.Member) []string {
+	const maxLine = 400
+
+	var lines []string
+	var line []string
+	length := 0
+	for _, member := range members {
+		name := member.Nick
+		if member.Prefixes != "" {
+			name = member.Prefixes[:1] + name
+		}
+		if length+len(name)+1 > maxLine && len(line) > 0 {
+			lines = append(lines, strings.Join(line, " "))
+			line, length = nil, 0
+		}
+		line = append(line, name)
+		length += len(name) + 1
+	}
+	if len(line) > 0 {
+		lines = append(lines, strings.Join(line, " "))
+	}
+	return lines
+}
+
+// forClients reports whether a message from the upstream server should be
+// passed on to clients. Keepalives and capability negotiation are handled
+// by the proxy. It is the clients' hub filter, so it runs in the run loop.
+func (p *Proxy) forClients(msg *ircx.Message) bool {
+	if msg.Command == irc.PING || msg.Command == irc.PONG || msg.Command == ircx.CAP {
+		return false
+	}
+	// Echoes of our own messages have already been shown to the other
+	// clients by fromClient
+	if isText(msg) && msg.Prefix != nil && p.isupport.Fold(msg.Prefix.Name) == p.isupport.Fold(p.currentNick) {
+		return false
+	}
+	return true
+}
+
+// untagged removes a message's tags, for clients that haven't negotiated
+// server-time. The message itself is shared with other subscribers, so it
+// isn't modified.
+func untagged(msg *ircx.Message) *ircx.Message {
+	if len(msg.Tags) == 0 {
+		return msg
+	}
+	return ircx.Wrap(msg.Message)
+}
+
+// fromClient relays a message from a client to the upstream server. Text is
+// also shown to the other clients, as the upstream server won't send it back
+// to us.
+func (p *Proxy) fromClient(c *client, msg *ircx.Message) {
+	if isText(msg) {
+		if len(msg.Params[0]) > ircx.MaxTargetLength {
+			c.Send(&irc.Message{
+				Prefix:   &irc.Prefix{Name: serverName},
+				Command:  irc.ERR_NOSUCHNICK,
+				Params:   []string{c.nick, msg.Params[0]},
+				Trailing: "No such nick/channel",
+			})
+			return
+		}
+		err := p.SendText(msg.Command, msg.Params[0], msg.Trailing)
+		if err != nil {
+			log.Printf("%sFailed to send: %s%s", colorWarning, err, colorReset)
+			return
+		}
+		sent := &irc.Message{
+			Prefix:   irc.ParsePrefix(p.selfMask()),
+			Command:  msg.Command,
+			Params:   msg.Params,
+			Trailing: msg.Trailing,
+		}
+		p.backlog.Add(p.isupport.Fold(msg.Params[0]), ircx.Wrap(sent))
+		for other := range p.clients {
+			if other != c {
+				other.Send(sent)
+			}
+		}
+		return
+	}
+	p.Send(ircx.Wrap(msg.Message))
+}
+
+// record keeps text sent to us or our channels in the backlog, under the
+// channel or, for private messages, the sender. Notices from the server and
+// echoes of our own messages (which fromClient has already kept) are left
+// out.
+func (p *Proxy) record(msg *ircx.Message) {
+	if !isText(msg) || msg.Prefix == nil || msg.Prefix.User == "" {
+		return
+	}
+	if p.isupport.Fold(msg.Prefix.Name) == p.isupport.Fold(p.currentNick) {
+		return
+	}
+	p.backlog.Add(p.isupport.Fold(p.conversation(msg)), msg)
+}
+
+// nickChanged tells the clients that our nick changed while we were
+// reconnecting
+func (p *Proxy) nickChanged(from string) {
+	for c := range p.clients {
+		c.Send(&irc.Message{
+			Prefix:   &irc.Prefix{Name: from},
+			Command:  irc.NICK,
+			Trailing: p.currentNick,
+		})
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/sorcix/irc"
+)
+
+// registerClient sends lines from the client end of a pipe and returns the
+// result of registering with password, along with what the proxy wrote back.
+func registerClient(t *testing.T, password string, lines ...string) (*client, error, []*ircx.Message) {
+	log.SetOutput(ioutil.Discard)
+	proxyEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+
+	c := newClient(proxyEnd)
+	result := make(chan error, 1)
+	go func() {
+		result <- c.register(password)
+		proxyEnd.Close()
+	}()
+
+	go func() {
+		for _, line := range lines {
+			clientEnd.Write([]byte(line + "\r\n"))
+		}
+	}()
+
+	var replies []*ircx.Message
+	decoder := ircx.NewDecoder(clientEnd)
+	for {
+		msg, err := decoder.Decode()
+		if err != nil {
+			break
+		}
+		replies = append(replies, msg)
+	}
+	return c, <-result, replies
+}
+
+func TestClientRegister(t *testing.T) {
+	c, err, replies := registerClient(t, "hunter2",
+		"CAP LS 302", "PASS hunter2", "NICK alice", "USER alice 0 * :Alice", "CAP END")
+	if err != nil {
+		t.Fatalf("register failed: %s", err)
+	}
+	if c.nick != "alice" || c.user != "alice" {
+		t.Errorf("Registered as %s/%s", c.nick, c.user)
+	}
+	if len(replies) != 1 || replies[0].Command != ircx.CAP || replies[0].Param(1) != "LS" || replies[0].Param(2) != "server-time" {
+		t.Errorf("Expected CAP LS offering server-time, got %v", replies)
+	}
+	if c.serverTime {
+		t.Errorf("Client didn't ask for server-time")
+	}
+}
+
+func TestClientRegisterServerTime(t *testing.T) {
+	c, err, replies := registerClient(t, "hunter2",
+		"CAP LS 302", "NICK alice", "CAP REQ :server-time away-notify", "CAP REQ :server-time",
+		"USER alice 0 * :Alice", "PASS hunter2", "CAP END")
+	if err != nil {
+		t.Fatalf("register failed: %s", err)
+	}
+	if !c.serverTime {
+		t.Errorf("Expected server-time to be enabled")
+	}
+	if len(replies) != 3 || replies[1].Param(1) != "NAK" || replies[2].Param(1) != "ACK" || replies[2].Param(2) != "server-time" {
+		t.Errorf("Expected a NAK and then an ACK, got %v", replies)
+	}
+}
+
+func TestClientRegisterBadPassword(t *testing.T) {
+	for _, pass := range []string{"PASS wrong", ""} {
+		_, err, replies := registerClient(t, "hunter2", pass, "NICK alice", "USER alice 0 * :Alice")
+		if err != badPasswordError {
+			t.Errorf("%q: expected %s, got %v", pass, badPasswordError, err)
+		}
+		if len(replies) != 2 || replies[0].Command != irc.ERR_PASSWDMISMATCH || replies[1].Command != irc.ERROR {
+			t.Errorf("%q: expected 464 and ERROR, got %v", pass, replies)
+		}
+	}
+}
+
+func TestClientRegisterLineTooLong(t *testing.T) {
+	_, err, _ := registerClient(t, "hunter2", "PASS "+strings.Repeat("a", ircx.MaxLineLength))
+	if err != ircx.LineTooLongError {
+		t.Errorf("Expected %s, got %v", ircx.LineTooLongError, err)
+	}
+}
+
+func TestClientRegistrationTimeout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer func(timeout time.Duration) { registrationTimeout = timeout }(registrationTimeout)
+	registrationTimeout = 50 * time.Millisecond
+	proxyEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+
+	done := make(chan struct{})
+	go func() {
+		(&Proxy{}).serveClient(newClient(proxyEnd), "hunter2")
+		close(done)
+	}()
+	clientEnd.Write([]byte("NICK alice\r\n"))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Client that didn't finish registering was not disconnected")
+	}
+}
+
+// drain returns the messages queued for a client
+func newBouncedProxy() *Proxy {
+	isupport := ircx.NewISupport()
+	isupport.Handle(ircx.ParseMessage(":irc.example.net 005 bot NETWORK=Example CHANTYPES=# PREFIX=(ov)@+ :are supported by this server"))
+	state := ircx.NewState("bot", isupport)
+	for _, line := range []string{
+		":bot!bot@example.net JOIN #wallops",
+		":irc.example.net 332 bot #wallops :Welcome to wallops",
+		":irc.example.net 353 bot = #wallops :@alice +bob bot",
+		":irc.example.net 366 bot #wallops :End of /NAMES list.",
+	} {
+		state.Handle(ircx.ParseMessage(line))
+	}
+
+	return &Proxy{
+		addr:        "irc.example.net:6667",
+		currentNick: "bot",
+		hostmask:    "bot!bot@example.net",
+		isupport:    isupport,
+		state:       state,
+		backlog:     ircx.NewBacklog(ircx.BacklogLimits{Size: 10}),
+		clients:     make(map[*client]*ircx.Subscription),
+	}
+}
+
+func TestWelcome(t *testing.T) {
+	proxy := newBouncedProxy()
+	c := newClient(nil)
+	c.nick, c.user = "alice", "alice"
+	var commands []string
+	for _, msg := range proxy.welcome(c) {
+		commands = append(commands, msg.Command)
+		switch msg.Command {
+		case irc.RPL_WELCOME:
+			if msg.Param(0) != "bot" {
+				t.Errorf("001 was addressed to %s", msg.Param(0))
+			}
+		case ircx.RPL_ISUPPORT:
+			if !strings.Contains(msg.String(), "NETWORK=Example") {
+				t.Errorf("005 is missing the network: %s", msg)
+			}
+		case irc.NICK:
+			if msg.Prefix.Name != "alice" || msg.Trailing != "bot" {
+				t.Errorf("Unexpected nick change %s", msg)
+			}
+		case irc.JOIN:
+			if msg.Prefix.String() != "bot!bot@example.net" || msg.Param(0) != "#wallops" {
+				t.Errorf("Unexpected join %s", msg)
+			}
+		case irc.RPL_TOPIC:
+			if msg.Trailing != "Welcome to wallops" {
+				t.Errorf("Unexpected topic %s", msg)
+			}
+		case irc.RPL_NAMREPLY:
+			if msg.Trailing != "@alice +bob bot" {
+				t.Errorf("Unexpected names %q", msg.Trailing)
+			}
+		}
+	}
+
+	expected := "001 002 003 004 005 NICK 375 372 376 JOIN 332 353 366"
+	if got := strings.Join(commands, " "); got != expected {
+		t.Errorf("Burst was %s, expected %s", got, expected)
+	}
+}
+
+func TestWelcomeManyChannels(t *testing.T) {
+	proxy := newBouncedProxy()
+	for i := 0; i < 100; i++ {
+		channel := fmt.Sprintf("#channel%d", i)
+		proxy.state.Handle(ircx.ParseMessage(":bot!bot@example.net JOIN " + channel))
+		proxy.state.Handle(ircx.ParseMessage(":irc.example.net 332 bot " + channel + " :topic"))
+	}
+
+	proxyEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+	c := newClient(proxyEnd)
+	burst := proxy.welcome(c)
+	if len(burst) <= clientQueueSize {
+		t.Fatalf("Expected a burst larger than the queue, got %d messages", len(burst))
+	}
+	go c.writeMessages(ircx.NewHub().Subscribe(10, ircx.Disconnect, nil), burst)
+
+	decoder := ircx.NewDecoder(clientEnd)
+	for i := range burst {
+		if _, err := decoder.Decode(); err != nil {
+			t.Fatalf("Client was disconnected after %d messages: %s", i, err)
+		}
+	}
+	c.Close()
+}
+
+func TestForClients(t *testing.T) {
+	proxy := newBouncedProxy()
+	hub := ircx.NewHub()
+	alice := hub.Subscribe(10, ircx.Disconnect, proxy.forClients)
+	bob := hub.Subscribe(10, ircx.Disconnect, proxy.forClients)
+
+	hub.Publish(ircx.ParseMessage("@time=2020-01-01T00:00:00.000Z :carol!c@example.net PRIVMSG #wallops :hi"))
+	hub.Publish(ircx.ParseMessage("PING :irc.example.net"))
+	hub.Publish(ircx.ParseMessage(":bot!bot@example.net PRIVMSG #wallops :echoed"))
+	hub.Close()
+
+	for _, sub := range []*ircx.Subscription{alice, bob} {
+		var msgs []*ircx.Message
+		for msg := range sub.Messages() {
+			msgs = append(msgs, untagged(msg))
+		}
+		if len(msgs) != 1 {
+			t.Fatalf("Expected one message, got %v", msgs)
+		}
+		if len(msgs[0].Tags) != 0 || msgs[0].Trailing != "hi" {
+			t.Errorf("Unexpected message %s", msgs[0])
+		}
+	}
+}
+
+func TestClientSlowSubscriberDisconnected(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	proxyEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+
+	// Nobody reads from the client end, so its buffer fills
+	hub := ircx.NewHub()
+	sub := hub.Subscribe(2, ircx.Disconnect, nil)
+	c := newClient(proxyEnd)
+	done := make(chan struct{})
+	go func() {
+		c.writeMessages(sub, nil)
+		close(done)
+	}()
+	for i := 0; i < 4; i++ {
+		hub.Publish(ircx.ParseMessage("PRIVMSG #wallops :hi"))
+	}
+
+	if sub.Err() != ircx.SubscriberOverflowError {
+		t.Errorf("Expected the subscription to overflow, got %v", sub.Err())
+	}
+	clientEnd.Close()
+	<-done
+	if hub.Len() != 0 {
+		t.Errorf("Expected no subscribers, got %d", hub.Len())
+	}
+}
+
+func TestNamesLines(t *testing.T) {
+	var members []ircx.Member
+	for i := 0; i < 100; i++ {
+		members = append(members, ircx.Member{Nick: strings.Repeat("n", 9), Prefixes: "@+"})
+	}
+	lines := namesLines(members)
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %d", len(lines))
+	}
+	for _, line := range lines {
+		if len(line) > 400 || !strings.HasPrefix(line, "@nnnnnnnnn ") {
+			t.Errorf("Unexpected line %q", line)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	proxy := newBouncedProxy()
+	for _, line := range []string{
+		":carol!c@example.net PRIVMSG #Wallops :in the channel",
+		":Carol!c@example.net PRIVMSG bot :in a query",
+		":irc.example.net NOTICE bot :from the server",
+		":bot!bot@example.net PRIVMSG #wallops :echoed",
+		":carol!c@example.net JOIN #wallops",
+	} {
+		proxy.record(ircx.ParseMessage(line))
+	}
+
+	entries := proxy.backlog.Since(0)
+	if len(entries) != 2 {
+		t.Fatalf("Expected two messages to be kept, got %v", entries)
+	}
+	if entries[0].Target != "#wallops" || entries[1].Target != "carol" {
+		t.Errorf("Kept under %s and %s", entries[0].Target, entries[1].Target)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	backlog := ircx.NewBacklog(ircx.BacklogLimits{Size: 10})
+	backlog.Add("#wallops", ircx.ParseMessage("@time=2020-01-01T12:00:00.000Z;msgid=abc :carol!c@example.net PRIVMSG #wallops :hi"))
+	backlog.Add("#wallops", ircx.ParseMessage("@time=2020-01-01T12:00:01.000Z :carol!c@example.net PRIVMSG #wallops :\x01ACTION waves\x01"))
+	entries := backlog.Since(0)
+
+	c := newClient(nil)
+	c.serverTime = true
+	msgs := c.replay(entries)
+	if len(msgs) != 2 || msgs[0].String() != "@time=2020-01-01T12:00:00.000Z :carol!c@example.net PRIVMSG #wallops :hi" {
+		t.Errorf("Unexpected replay with server-time %v", msgs)
+	}
+
+	c.serverTime = false
+	msgs = c.replay(entries)
+	stamp := time.Date(2020, 1, 1, 12, 0, 1, 0, time.UTC).Local().Format("[2006-01-02 15:04:05] ")
+	if len(msgs[1].Tags) != 0 || msgs[1].Trailing != "\x01ACTION "+stamp+"waves\x01" {
+		t.Errorf("Unexpected replay without server-time %q", msgs[1])
+	}
+	if entries[0].Message.Trailing != "hi" {
+		t.Errorf("Replay modified the backlog")
+	}
+}
+
+func TestWriteMessagesOrder(t *testing.T) {
+	proxyEnd, clientEnd := net.Pipe()
+	defer clientEnd.Close()
+
+	hub := ircx.NewHub()
+	sub := hub.Subscribe(10, ircx.Disconnect, nil)
+	hub.Publish(ircx.ParseMessage("PRIVMSG #wallops :live"))
+	c := newClient(proxyEnd)
+	c.Send(&irc.Message{Command: irc.PONG, Params: []string{serverName}, Trailing: "reply"})
+	go c.writeMessages(sub, []*ircx.Message{
+		ircx.ParseMessage(":wallops 001 bot :burst"),
+		ircx.ParseMessage("PRIVMSG #wallops :backlog"),
+	})
+
+	decoder := ircx.NewDecoder(clientEnd)
+	for _, expected := range []string{"burst", "backlog", "reply", "live"} {
+		msg, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("Failed to read %s: %s", expected, err)
+		}
+		if msg.Trailing != expected {
+			t.Errorf("Got %q, expected %q", msg.Trailing, expected)
+		}
+	}
+	c.Close()
+}
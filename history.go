@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/jnwhiteh/wallops/chatlog"
+	"github.com/jnwhiteh/wallops/history"
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/sorcix/irc"
+)
+
+// archive adds text we receive from other users (or the server's echoes of
+// our own) to the history, if it is enabled
+func (p *Proxy) archive(msg *ircx.Message) {
+	if p.history == nil || !isText(msg) || msg.Prefix == nil || !msg.Prefix.IsHostmask() {
+		return
+	}
+	p.addHistory(msg.Prefix.Name, msg, sentAt(msg))
+}
+
+// recordSent writes text that we send to the chat log and the history,
+// unless the server will echo it back to us. It runs in the run loop, which
+// owns our nick and capabilities.
+func (p *Proxy) recordSent(msg *ircx.Message) {
+	if !isText(msg) || (p.caps != nil && p.caps.Enabled("echo-message")) {
+		return
+	}
+	now := time.Now()
+	if p.chatlog != nil {
+		sent := *msg.Message
+		sent.Prefix = irc.ParsePrefix(p.selfMask())
+		if line, ok := chatlog.Format(ircx.Wrap(&sent)); ok {
+			p.writeChatLog([]string{msg.Params[0]}, now, line)
+		}
+	}
+	p.addHistory(p.currentNick, msg, now)
+}
+
+func (p *Proxy) addHistory(nick string, msg *ircx.Message, when time.Time) {
+	if p.history == nil {
+		return
+	}
+	_, err := p.history.Add(history.Record{
+		Time:    when,
+		Network: p.network(),
+		Channel: p.conversation(msg),
+		Nick:    nick,
+		Command: msg.Command,
+		Text:    msg.Trailing,
+	})
+	if err != nil {
+		log.Printf("%sFailed to add to the history: %s%s", colorWarning, err, colorReset)
+	}
+}
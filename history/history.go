@@ -0,0 +1,381 @@
+// Package history keeps an archive of messages on local disk that can be
+// searched by network, channel, nick, time and the words in the text.
+//
+// Records are appended to a file of JSON lines. Opening an archive reads
+// the file back to build the index in memory, which holds just enough of
+// each record to filter on; the records that match a search are read from
+// disk.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var IndexClosedError = fmt.Errorf("History has been closed")
+
+const (
+	DefaultLimit = 50  // results per page if a query doesn't say
+	MaxLimit     = 500 // the most results a page may have
+
+	// The name of the archive within its directory
+	archiveName = "history.jsonl"
+)
+
+// Record is an archived message
+type Record struct {
+	Id      uint64 // increases with every record, starting at 1
+	Time    time.Time
+	Network string
+	Channel string // the channel, or the other party of a private conversation
+	Nick    string // who sent the message
+	Command string // PRIVMSG or NOTICE
+	Text    string
+
+	// Who the record belongs to, when an archive is shared by several
+	// connections that mustn't see each other's records
+	Owner string `json:",omitempty"`
+}
+
+// Query selects records. Owner, network, channel and nick are matched
+// ignoring case, and empty fields match anything.
+type Query struct {
+	Owner   string
+	Network string
+	Channel string
+	Nick    string
+	Since   time.Time // only records at or after this time, unless zero
+	Until   time.Time // only records before this time, unless zero
+	Text    string    // every word must appear in the record's text
+	Limit   int       // results per page, DefaultLimit if zero
+	Before  uint64    // the Next of the previous page, or 0 for the first
+}
+
+// Page is one page of search results
+type Page struct {
+	Records []Record // newest first
+	Next    uint64   // for Query.Before to fetch the next page, or 0 if there isn't one
+}
+
+// Index is an archive along with its index. It is safe for concurrent use.
+type Index struct {
+	file    *os.File
+	size    int64 // where the next record will be written
+	partial bool  // the file ends in an incomplete line
+	closed  bool
+
+	entries []entry             // in the order they were added
+	words   map[string][]uint32 // positions in entries, ascending
+	names   map[string]string   // interned networks, channels and nicks
+
+	sync.RWMutex
+}
+
+// entry is what the index keeps in memory for each record
+type entry struct {
+	id      uint64
+	time    int64 // in Unix nanoseconds
+	owner   string
+	network string
+	channel string
+	nick    string
+	offset  int64 // where the record is in the file
+	length  int
+}
+
+// Open opens the archive in dir, creating it if necessary, and indexes the
+// records already in it. A line left incomplete by a crash is ignored.
+func Open(dir string) (*Index, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, archiveName), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	x := &Index{
+		file:  file,
+		words: make(map[string][]uint32),
+		names: make(map[string]string),
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			x.partial = len(line) > 0
+			x.size += int64(len(line))
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		var record Record
+		if json.Unmarshal(line, &record) == nil {
+			x.index(record, x.size, len(line))
+		}
+		x.size += int64(len(line))
+	}
+	return x, nil
+}
+
+// Add archives a record, assigning its Id, and returns it
+func (x *Index) Add(record Record) (Record, error) {
+	x.Lock()
+	defer x.Unlock()
+	if x.closed {
+		return record, IndexClosedError
+	}
+
+	record.Id = 1
+	if len(x.entries) > 0 {
+		record.Id = x.entries[len(x.entries)-1].id + 1
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return record, err
+	}
+	data = append(data, '\n')
+
+	// Finish off an incomplete line so that it doesn't swallow this one
+	if x.partial {
+		data = append([]byte{'\n'}, data...)
+	}
+	written, err := x.file.Write(data)
+	x.size += int64(written)
+	if err != nil {
+		x.partial = written > 0
+		return record, err
+	}
+	if x.partial {
+		x.partial = false
+		data = data[1:]
+	}
+	x.index(record, x.size-int64(len(data)), len(data))
+	return record, nil
+}
+
+// Search returns a page of the records matching a query, newest first
+func (x *Index) Search(query Query) (Page, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	} else if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	owner, network, channel, nick := fold(query.Owner), fold(query.Network), fold(query.Channel), fold(query.Nick)
+
+	x.RLock()
+	defer x.RUnlock()
+	if x.closed {
+		return Page{}, IndexClosedError
+	}
+
+	// Without any words, every record is a candidate
+	var candidates []uint32
+	words := Words(query.Text)
+	if len(words) > 0 {
+		candidates = x.withWords(words)
+	}
+	count := len(x.entries)
+	if len(words) > 0 {
+		count = len(candidates)
+	}
+
+	var page Page
+	var matched []entry
+	for i := count - 1; i >= 0; i-- {
+		position := i
+		if len(words) > 0 {
+			position = int(candidates[i])
+		}
+		e := x.entries[position]
+		if query.Before != 0 && e.id >= query.Before {
+			continue
+		}
+		if (owner != "" && e.owner != owner) ||
+			(network != "" && e.network != network) ||
+			(channel != "" && e.channel != channel) ||
+			(nick != "" && e.nick != nick) ||
+			(!query.Since.IsZero() && e.time < query.Since.UnixNano()) ||
+			(!query.Until.IsZero() && e.time >= query.Until.UnixNano()) {
+			continue
+		}
+		if len(matched) == limit {
+			page.Next = matched[limit-1].id
+			break
+		}
+		matched = append(matched, e)
+	}
+
+	for _, e := range matched {
+		record, err := x.read(e)
+		if err != nil {
+			return Page{}, err
+		}
+		page.Records = append(page.Records, record)
+	}
+	return page, nil
+}
+
+// Len returns the number of records archived
+func (x *Index) Len() int {
+	x.RLock()
+	defer x.RUnlock()
+	return len(x.entries)
+}
+
+func (x *Index) Close() error {
+	x.Lock()
+	defer x.Unlock()
+	x.closed = true
+	return x.file.Close()
+}
+
+// index adds a record that has been written at offset to the index
+func (x *Index) index(record Record, offset int64, length int) {
+	position := uint32(len(x.entries))
+	x.entries = append(x.entries, entry{
+		id:      record.Id,
+		time:    record.Time.UnixNano(),
+		owner:   x.intern(record.Owner),
+		network: x.intern(record.Network),
+		channel: x.intern(record.Channel),
+		nick:    x.intern(record.Nick),
+		offset:  offset,
+		length:  length,
+	})
+	for _, word := range Words(record.Text) {
+		x.words[word] = append(x.words[word], position)
+	}
+}
+
+// intern folds a name and returns a shared copy, so that each record
+// doesn't hold its own
+func (x *Index) intern(name string) string {
+	name = fold(name)
+	if shared, ok := x.names[name]; ok {
+		return shared
+	}
+	x.names[name] = name
+	return name
+}
+
+// withWords returns the positions of the records that contain every word
+func (x *Index) withWords(words []string) []uint32 {
+	lists := make([][]uint32, len(words))
+	for i, word := range words {
+		lists[i] = x.words[word]
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+
+	var positions []uint32
+	for _, position := range lists[0] {
+		found := true
+		for _, list := range lists[1:] {
+			i := sort.Search(len(list), func(i int) bool { return list[i] >= position })
+			if i == len(list) || list[i] != position {
+				found = false
+				break
+			}
+		}
+		if found {
+			positions = append(positions, position)
+		}
+	}
+	return positions
+}
+
+func (x *Index) read(e entry) (Record, error) {
+	data := make([]byte, e.length)
+	if _, err := x.file.ReadAt(data, e.offset); err != nil {
+		return Record{}, err
+	}
+	var record Record
+	err := json.Unmarshal(data, &record)
+	return record, err
+}
+
+func fold(name string) string {
+	return strings.ToLower(name)
+}
+
+// Words splits text into the lower case words that are indexed, ignoring
+// punctuation and IRC formatting codes. Each word appears once.
+func Words(text string) []string {
+	seen := make(map[string]bool)
+	var words []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(stripFormatting(text)), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// stripFormatting removes bold, colour and other formatting codes, so that
+// the digits of a colour don't end up in the word that follows it
+func stripFormatting(text string) string {
+	var builder strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; c {
+		case 0x02, 0x0f, 0x11, 0x16, 0x1d, 0x1e, 0x1f:
+		case 0x03:
+			// Up to two digits of foreground, and optionally a comma and
+			// up to two digits of background
+			i += digits(text[i+1:])
+			if i+2 < len(text) && text[i+1] == ',' && digits(text[i+2:]) > 0 {
+				i += 1 + digits(text[i+2:])
+			}
+		default:
+			builder.WriteByte(c)
+		}
+	}
+	return builder.String()
+}
+
+// digits counts the digits (at most two) that text starts with
+func digits(text string) int {
+	count := 0
+	for count < 2 && count < len(text) && text[count] >= '0' && text[count] <= '9' {
+		count++
+	}
+	return count
+}
+
+// ParseTime parses the bounds of a time range: an RFC 3339 time, a date and
+// optional time (2006-01-02 or 2006-01-02T15:04) in the local time zone, or
+// how long ago, as a duration such as 90m or a number of days such as 7d.
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if ago, err := time.ParseDuration(value); err == nil && ago >= 0 {
+		return now.Add(-ago), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time, date, duration or number of days", value)
+}
@@ -0,0 +1,168 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func openTemp(t *testing.T) (*Index, string) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open: %s", err)
+	}
+	return index, dir
+}
+
+func addAll(t *testing.T, index *Index, records ...Record) {
+	for i, record := range records {
+		record.Time = start.Add(time.Duration(i) * time.Minute)
+		record.Command = "PRIVMSG"
+		if _, err := index.Add(record); err != nil {
+			t.Fatalf("Failed to add: %s", err)
+		}
+	}
+}
+
+func texts(page Page) []string {
+	var texts []string
+	for _, record := range page.Records {
+		texts = append(texts, record.Text)
+	}
+	return texts
+}
+
+func TestSearch(t *testing.T) {
+	index, dir := openTemp(t)
+	defer os.RemoveAll(dir)
+	addAll(t, index,
+		Record{Network: "Example", Channel: "#wallops", Nick: "alice", Text: "The deploy is broken"},
+		Record{Network: "Example", Channel: "#wallops", Nick: "bob", Text: "which deploy?"},
+		Record{Network: "Example", Channel: "#go", Nick: "alice", Text: "\x0304Deploy\x03 finished, nothing broken"},
+		Record{Network: "Other", Channel: "#wallops", Nick: "alice", Text: "deploy broken elsewhere"},
+		Record{Owner: "conn", Network: "Other", Channel: "#private", Nick: "carol", Text: "owned by a connection"},
+	)
+
+	for _, test := range []struct {
+		query    Query
+		expected []string
+	}{
+		{Query{Text: "deploy broken"}, []string{"deploy broken elsewhere", "\x0304Deploy\x03 finished, nothing broken", "The deploy is broken"}},
+		{Query{Text: "DEPLOY", Nick: "Bob"}, []string{"which deploy?"}},
+		{Query{Network: "example", Channel: "#WALLOPS"}, []string{"which deploy?", "The deploy is broken"}},
+		{Query{Nick: "alice", Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, []string{"\x0304Deploy\x03 finished, nothing broken"}},
+		{Query{Owner: "CONN"}, []string{"owned by a connection"}},
+		{Query{Owner: "other", Network: "Other"}, nil},
+		{Query{Text: "missing"}, nil},
+	} {
+		page, err := index.Search(test.query)
+		if err != nil {
+			t.Fatalf("Search failed: %s", err)
+		}
+		if got := texts(page); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%+v found %q, expected %q", test.query, got, test.expected)
+		}
+	}
+}
+
+func TestSearchPages(t *testing.T) {
+	index, dir := openTemp(t)
+	defer os.RemoveAll(dir)
+	for i := 0; i < 5; i++ {
+		addAll(t, index, Record{Channel: "#wallops", Text: "hello"})
+	}
+
+	var ids []uint64
+	query := Query{Text: "hello", Limit: 2}
+	for pages := 0; pages < 5; pages++ {
+		page, err := index.Search(query)
+		if err != nil {
+			t.Fatalf("Search failed: %s", err)
+		}
+		for _, record := range page.Records {
+			ids = append(ids, record.Id)
+		}
+		if page.Next == 0 {
+			break
+		}
+		query.Before = page.Next
+	}
+	if !reflect.DeepEqual(ids, []uint64{5, 4, 3, 2, 1}) {
+		t.Errorf("Paged through %v", ids)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	index, dir := openTemp(t)
+	defer os.RemoveAll(dir)
+	addAll(t, index, Record{Channel: "#wallops", Nick: "alice", Text: "first"})
+	index.Close()
+	if info, err := os.Stat(filepath.Join(dir, archiveName)); err != nil {
+		t.Errorf("Failed to stat the archive: %s", err)
+	} else if info.Mode() != 0600 {
+		t.Errorf("Expected the archive to be private, got mode %s", info.Mode())
+	}
+
+	// Simulate a crash part way through writing a record
+	file, _ := os.OpenFile(filepath.Join(dir, archiveName), os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"Id":2,"Text":"trunc`)
+	file.Close()
+
+	index, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	if index.Len() != 1 {
+		t.Fatalf("Expected one record, got %d", index.Len())
+	}
+	record, err := index.Add(Record{Channel: "#wallops", Nick: "alice", Text: "second"})
+	if err != nil || record.Id != 2 {
+		t.Fatalf("Add returned %+v, %v", record, err)
+	}
+	page, _ := index.Search(Query{Nick: "alice"})
+	if got := texts(page); !reflect.DeepEqual(got, []string{"second", "first"}) {
+		t.Errorf("Found %q", got)
+	}
+	index.Close()
+
+	index, _ = Open(dir)
+	defer index.Close()
+	if index.Len() != 2 {
+		t.Errorf("Expected the truncated line to be skipped, got %d records", index.Len())
+	}
+}
+
+func TestWords(t *testing.T) {
+	got := Words("\x02Hello\x02, \x0312,04world\x03! hello wörld 42")
+	if !reflect.DeepEqual(got, []string{"hello", "world", "wörld", "42"}) {
+		t.Errorf("Words returned %q", got)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2020, 1, 8, 12, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Time{
+		"2020-01-01T10:00:00Z": time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC),
+		"2020-01-01":           time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local),
+		"2020-01-01T10:30":     time.Date(2020, 1, 1, 10, 30, 0, 0, time.Local),
+		"7d":                   time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+		"90m":                  time.Date(2020, 1, 8, 10, 30, 0, 0, time.UTC),
+	} {
+		got, err := ParseTime(value, now)
+		if err != nil || !got.Equal(expected) {
+			t.Errorf("ParseTime(%q) = %s, %v, expected %s", value, got, err, expected)
+		}
+	}
+	if _, err := ParseTime("last week", now); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
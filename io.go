@@ -1,18 +1,18 @@
 package main
 
-import "github.com/sorcix/irc"
+import "github.com/jnwhiteh/wallops/ircx"
 
 // messageReader provides an interface that makes it easy to mock connections
 // for testing purposes
 type messageReader interface {
-	ReadMessage() (*irc.Message, error)
+	ReadMessage() (*ircx.Message, error)
 }
 
 type messageWriter interface {
-	WriteMessage(*irc.Message) error
+	WriteMessage(*ircx.Message) error
 }
 
-// safeReader fixes the semantics of the irc package to ensure we can properly
+// safeReader fixes the semantics of the ircx decoder to ensure we can properly
 // handle error and invalid messages.
 //
 // The decoder will ONLY return an error if the underlying bufio.Reader
@@ -20,10 +20,10 @@ type messageWriter interface {
 // message, which obviously cannot be used. These cases are converted into a
 // parseError return.
 type safeReader struct {
-	decoder *irc.Decoder
+	decoder *ircx.Decoder
 }
 
-func (r *safeReader) ReadMessage() (*irc.Message, error) {
+func (r *safeReader) ReadMessage() (*ircx.Message, error) {
 	msg, err := r.decoder.Decode()
 	if err != nil {
 		return nil, err
@@ -31,15 +31,18 @@ func (r *safeReader) ReadMessage() (*irc.Message, error) {
 	if msg == nil {
 		return nil, parseError
 	}
-	logRecv(msg)
 	return msg, err
 }
 
 type writer struct {
-	encoder *irc.Encoder
+	encoder *ircx.Encoder
 }
 
-func (w *writer) WriteMessage(msg *irc.Message) error {
+func (w *writer) WriteMessage(msg *ircx.Message) error {
 	logSend(msg)
-	return w.encoder.Encode(msg)
+	err := w.encoder.Encode(msg)
+	if err == nil {
+		messagesSent.Inc()
+	}
+	return err
 }
@@ -0,0 +1,135 @@
+package ircx
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// BacklogLimits bounds how much a Backlog keeps for each target
+type BacklogLimits struct {
+	Size   int           // messages kept per target, or 0 to keep nothing
+	MaxAge time.Duration // how long messages are kept, or 0 for no limit
+}
+
+// BacklogEntry is a message kept by a Backlog
+type BacklogEntry struct {
+	Seq     uint64    // increases with every message added, starting at 1
+	Target  string    // the channel or query the message belongs to
+	Time    time.Time // when the message was sent
+	Message *Message
+}
+
+// Backlog keeps recent messages for each target (a channel or query), so
+// that they can be replayed to clients that weren't around to see them. It
+// also remembers how far each client has read.
+type Backlog struct {
+	limits    BacklogLimits
+	targets   map[string][]BacklogEntry
+	seq       uint64
+	positions map[string]uint64
+	now       func() time.Time
+	sync.Mutex
+}
+
+func NewBacklog(limits BacklogLimits) *Backlog {
+	return &Backlog{
+		limits:    limits,
+		targets:   make(map[string][]BacklogEntry),
+		positions: make(map[string]uint64),
+		now:       time.Now,
+	}
+}
+
+// Add keeps a message for target, which should already be folded. It is
+// timestamped with its server-time tag if it has one, or the current time.
+func (b *Backlog) Add(target string, msg *Message) {
+	b.Lock()
+	defer b.Unlock()
+	if b.limits.Size < 1 {
+		return
+	}
+
+	when, ok := msg.Time()
+	if !ok {
+		when = b.now()
+	}
+	b.seq++
+	entries := append(b.targets[target], BacklogEntry{
+		Seq:     b.seq,
+		Target:  target,
+		Time:    when,
+		Message: msg,
+	})
+	if len(entries) > b.limits.Size {
+		entries = append([]BacklogEntry(nil), entries[len(entries)-b.limits.Size:]...)
+	}
+	b.targets[target] = entries
+}
+
+// Since returns the messages added after seq, across every target, in the
+// order they were added
+func (b *Backlog) Since(seq uint64) []BacklogEntry {
+	b.Lock()
+	defer b.Unlock()
+	b.expire()
+
+	var entries []BacklogEntry
+	for _, kept := range b.targets {
+		idx := sort.Search(len(kept), func(i int) bool { return kept[i].Seq > seq })
+		entries = append(entries, kept[idx:]...)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries
+}
+
+// Latest returns the sequence number of the last message added
+func (b *Backlog) Latest() uint64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.seq
+}
+
+// Unread returns the messages a client hasn't seen. A client we haven't
+// heard of before gets everything.
+func (b *Backlog) Unread(client string) []BacklogEntry {
+	b.Lock()
+	position := b.positions[client]
+	b.Unlock()
+	return b.Since(position)
+}
+
+// MarkRead records that a client has seen everything up to seq
+func (b *Backlog) MarkRead(client string, seq uint64) {
+	b.Lock()
+	defer b.Unlock()
+	b.positions[client] = seq
+}
+
+// Len returns the number of messages kept
+func (b *Backlog) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	b.expire()
+	count := 0
+	for _, entries := range b.targets {
+		count += len(entries)
+	}
+	return count
+}
+
+// expire discards the messages that are older than the age limit
+func (b *Backlog) expire() {
+	if b.limits.MaxAge <= 0 {
+		return
+	}
+	cutoff := b.now().Add(-b.limits.MaxAge)
+	for target, entries := range b.targets {
+		idx := sort.Search(len(entries), func(i int) bool { return entries[i].Time.After(cutoff) })
+		if idx == len(entries) {
+			delete(b.targets, target)
+		} else if idx > 0 {
+			b.targets[target] = append([]BacklogEntry(nil), entries[idx:]...)
+		}
+	}
+}
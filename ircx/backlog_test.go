@@ -0,0 +1,78 @@
+package ircx
+
+import (
+	"testing"
+	"time"
+)
+
+func texts(entries []BacklogEntry) []string {
+	var texts []string
+	for _, entry := range entries {
+		texts = append(texts, entry.Message.Trailing)
+	}
+	return texts
+}
+
+func TestBacklogSizeLimit(t *testing.T) {
+	backlog := NewBacklog(BacklogLimits{Size: 2})
+	for i := 1; i <= 3; i++ {
+		backlog.Add("#wallops", numbered(i))
+	}
+	backlog.Add("alice", numbered(4))
+
+	got := texts(backlog.Since(0))
+	if len(got) != 3 || got[0] != "2" || got[1] != "3" || got[2] != "4" {
+		t.Errorf("Expected the newest two messages for each target, got %v", got)
+	}
+	if got := texts(backlog.Since(3)); len(got) != 1 || got[0] != "4" {
+		t.Errorf("Expected only the message after 3, got %v", got)
+	}
+	if backlog.Latest() != 4 {
+		t.Errorf("Latest is %d, expected 4", backlog.Latest())
+	}
+}
+
+func TestBacklogAgeLimit(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	backlog := NewBacklog(BacklogLimits{Size: 10, MaxAge: time.Hour})
+	backlog.now = func() time.Time { return now }
+
+	backlog.Add("#wallops", ParseMessage("@time=2020-01-01T10:00:00.000Z PRIVMSG #wallops :old"))
+	backlog.Add("#wallops", ParseMessage("@time=2020-01-01T11:30:00.000Z PRIVMSG #wallops :recent"))
+	backlog.Add("#wallops", ParseMessage("PRIVMSG #wallops :now"))
+
+	entries := backlog.Since(0)
+	if got := texts(entries); len(got) != 2 || got[0] != "recent" || got[1] != "now" {
+		t.Fatalf("Expected the old message to expire, got %v", got)
+	}
+	if !entries[1].Time.Equal(now) {
+		t.Errorf("Untagged message was kept with time %s", entries[1].Time)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if backlog.Len() != 0 {
+		t.Errorf("Expected everything to expire, %d left", backlog.Len())
+	}
+}
+
+func TestBacklogReadPositions(t *testing.T) {
+	backlog := NewBacklog(BacklogLimits{Size: 10})
+	backlog.Add("#wallops", numbered(1))
+	backlog.MarkRead("laptop", backlog.Latest())
+	backlog.Add("#wallops", numbered(2))
+
+	if got := texts(backlog.Unread("laptop")); len(got) != 1 || got[0] != "2" {
+		t.Errorf("Expected the laptop to have missed one message, got %v", got)
+	}
+	if got := texts(backlog.Unread("phone")); len(got) != 2 {
+		t.Errorf("Expected a new client to get everything, got %v", got)
+	}
+}
+
+func TestBacklogDisabled(t *testing.T) {
+	backlog := NewBacklog(BacklogLimits{})
+	backlog.Add("#wallops", numbered(1))
+	if backlog.Len() != 0 || backlog.Latest() != 0 {
+		t.Errorf("Expected nothing to be kept")
+	}
+}
@@ -0,0 +1,252 @@
+package ircx
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+)
+
+const CAP = "CAP"
+
+// DefaultCapabilities are requested when a connection does not configure its
+// own list.
+var DefaultCapabilities = []string{
+	"server-time",
+	"message-tags",
+	"echo-message",
+	"away-notify",
+	"account-tag",
+	"multi-prefix",
+}
+
+// Capabilities negotiates IRCv3 client capabilities (CAP LS 302) during
+// registration and keeps track of which capabilities are enabled for the
+// lifetime of the connection, including CAP NEW and CAP DEL notifications.
+// See https://ircv3.net/specs/extensions/capability-negotiation
+type Capabilities struct {
+	wanted    []string          // the capabilities we would like enabled
+	available map[string]string // advertised capabilities and their values
+	enabled   map[string]bool   // capabilities the server has acknowledged
+	sasl      *SASL             // authentication to run once sasl is enabled
+
+	listing     bool // still receiving a multi-line CAP LS
+	negotiating bool // registration is on hold until we send CAP END
+	requested   int  // outstanding CAP REQ messages
+
+	sync.RWMutex
+}
+
+// NewCapabilities creates a negotiator for the given list of capabilities,
+// or DefaultCapabilities if the list is empty. If sasl is non-nil the sasl
+// capability is also requested and authentication started once it is
+// acknowledged.
+func NewCapabilities(wanted []string, sasl *SASL) *Capabilities {
+	if len(wanted) == 0 {
+		wanted = DefaultCapabilities
+	}
+	if sasl != nil {
+		wanted = append(append([]string(nil), wanted...), "sasl")
+	}
+	return &Capabilities{
+		wanted:    wanted,
+		available: make(map[string]string),
+		enabled:   make(map[string]bool),
+		sasl:      sasl,
+	}
+}
+
+// ParseCapabilities splits a space or comma separated list of capabilities
+func ParseCapabilities(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+}
+
+// Begin starts negotiation. It should be sent before NICK and USER so that
+// registration is held open until negotiation has finished.
+func (c *Capabilities) Begin(w MessageWriter) error {
+	c.Lock()
+	c.listing = true
+	c.negotiating = true
+	c.Unlock()
+	return w.WriteMessage(Wrap(&irc.Message{Command: CAP, Params: []string{"LS", "302"}}))
+}
+
+// Enabled reports whether the server has acknowledged a capability
+func (c *Capabilities) Enabled(name string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.enabled[name]
+}
+
+// Value returns the value advertised for a capability, such as the list of
+// mechanisms for sasl.
+func (c *Capabilities) Value(name string) string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.available[name]
+}
+
+// List returns the enabled capabilities in sorted order
+func (c *Capabilities) List() []string {
+	c.RLock()
+	defer c.RUnlock()
+	var list []string
+	for name := range c.enabled {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Handle processes a CAP message (or a SASL message during registration),
+// writing any replies. It reports whether the message was consumed, and
+// returns an error if negotiation or authentication failed.
+func (c *Capabilities) Handle(msg *Message, w MessageWriter) (bool, error) {
+	if msg.Command == irc.RPL_WELCOME && c.sasl != nil && !c.sasl.Done {
+		// The server doesn't know about CAP, so we were never authenticated
+		return false, c.sasl.failure(irc.RPL_WELCOME, "Server registered us without SASL")
+	}
+	if c.sasl != nil && msg.Command != CAP {
+		return c.sasl.Handle(msg, w)
+	}
+	params := msg.AllParams()
+	if msg.Command != CAP || len(params) < 2 {
+		return false, nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// CAP <nick> <subcommand> [*] :<capabilities>, where the list may be
+	// sent without the colon if it is a single capability
+	subcommand := strings.ToUpper(params[1])
+	more := len(params) > 3 && params[2] == "*"
+	var capabilities string
+	if len(params) > 2 {
+		capabilities = params[len(params)-1]
+	}
+	list := strings.Fields(capabilities)
+
+	switch subcommand {
+	case "LS":
+		for _, item := range list {
+			name, value := splitCapability(item)
+			c.available[name] = value
+		}
+		if more || !c.listing {
+			return true, nil
+		}
+		c.listing = false
+		return true, c.request(w, c.wantedFrom(c.available))
+
+	case "NEW":
+		added := make(map[string]string)
+		for _, item := range list {
+			name, value := splitCapability(item)
+			c.available[name] = value
+			added[name] = value
+		}
+		return true, c.request(w, c.wantedFrom(added))
+
+	case "DEL":
+		for _, item := range list {
+			name, _ := splitCapability(item)
+			delete(c.available, name)
+			delete(c.enabled, name)
+		}
+		return true, nil
+
+	case "ACK":
+		for _, item := range list {
+			if strings.HasPrefix(item, "-") {
+				delete(c.enabled, item[1:])
+			} else {
+				c.enabled[item] = true
+			}
+		}
+		c.answered()
+		if c.negotiating && c.enabled["sasl"] && c.sasl != nil && !c.sasl.Done {
+			// SASL sends CAP END once it has finished
+			c.negotiating = false
+			return true, c.sasl.Start(w)
+		}
+		return true, c.end(w)
+
+	case "NAK":
+		c.answered()
+		if c.negotiating && c.sasl != nil && hasCapability(capabilities, "sasl") {
+			return true, c.sasl.failure(CAP, "Server refused the sasl capability")
+		}
+		return true, c.end(w)
+	}
+	return false, nil
+}
+
+// wantedFrom returns the advertised capabilities that we want but have not
+// yet enabled, in the order they were configured.
+func (c *Capabilities) wantedFrom(advertised map[string]string) []string {
+	var result []string
+	for _, name := range c.wanted {
+		if _, ok := advertised[name]; ok && !c.enabled[name] {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// request sends CAP REQ for the given capabilities, or finishes negotiation
+// if there is nothing to request.
+func (c *Capabilities) request(w MessageWriter, names []string) error {
+	if c.negotiating && c.sasl != nil && !c.hasAvailable("sasl") {
+		return c.sasl.failure(CAP, "Server does not support SASL")
+	}
+	if len(names) == 0 {
+		return c.end(w)
+	}
+	c.requested++
+	return w.WriteMessage(Wrap(&irc.Message{
+		Command:  CAP,
+		Params:   []string{"REQ"},
+		Trailing: strings.Join(names, " "),
+	}))
+}
+
+// end sends CAP END once all requests have been answered during registration
+func (c *Capabilities) end(w MessageWriter) error {
+	if !c.negotiating || c.requested > 0 {
+		return nil
+	}
+	c.negotiating = false
+	return w.WriteMessage(Wrap(&irc.Message{Command: CAP, Params: []string{"END"}}))
+}
+
+func (c *Capabilities) answered() {
+	if c.requested > 0 {
+		c.requested--
+	}
+}
+
+func (c *Capabilities) hasAvailable(name string) bool {
+	_, ok := c.available[name]
+	return ok
+}
+
+func hasCapability(list, capability string) bool {
+	for _, field := range strings.Fields(list) {
+		if strings.EqualFold(strings.TrimPrefix(field, "-"), capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCapability splits a CAP LS 302 item such as "sasl=PLAIN,EXTERNAL"
+func splitCapability(item string) (string, string) {
+	if idx := strings.IndexByte(item, '='); idx >= 0 {
+		return item[:idx], item[idx+1:]
+	}
+	return item, ""
+}
@@ -0,0 +1,120 @@
+package ircx
+
+import "testing"
+
+func handleLines(t *testing.T, caps *Capabilities, w *captureWriter, lines ...string) {
+	for _, line := range lines {
+		if _, err := caps.Handle(ParseMessage(line), w); err != nil {
+			t.Fatalf("Unexpected error handling %q: %s", line, err)
+		}
+	}
+}
+
+func TestCapabilityNegotiation(t *testing.T) {
+	caps := NewCapabilities([]string{"server-time", "multi-prefix", "batch"}, nil)
+	w := &captureWriter{}
+
+	caps.Begin(w)
+	if w.Last() != "CAP LS 302" {
+		t.Fatalf("Incorrect start message: %s", w.Last())
+	}
+
+	handleLines(t, caps, w,
+		":server CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL",
+		":server CAP * LS :server-time away-notify")
+	if w.Last() != "CAP REQ :server-time multi-prefix" {
+		t.Fatalf("Incorrect request: %s", w.Last())
+	}
+	if caps.Value("sasl") != "PLAIN,EXTERNAL" {
+		t.Fatalf("Capability value was not recorded: %q", caps.Value("sasl"))
+	}
+
+	handleLines(t, caps, w, ":server CAP * ACK :multi-prefix server-time")
+	if w.Last() != "CAP END" {
+		t.Fatalf("Negotiation was not ended: %s", w.Last())
+	}
+	if !caps.Enabled("server-time") || caps.Enabled("batch") {
+		t.Fatalf("Incorrect enabled capabilities: %v", caps.List())
+	}
+
+	// Capabilities can come and go once registered
+	handleLines(t, caps, w, ":server CAP bot NEW :batch")
+	if w.Last() != "CAP REQ :batch" {
+		t.Fatalf("New capability was not requested: %s", w.Last())
+	}
+	handleLines(t, caps, w,
+		":server CAP bot ACK :batch",
+		":server CAP bot DEL :server-time")
+	if w.Last() != "CAP REQ :batch" {
+		t.Fatalf("CAP END should only be sent during registration: %s", w.Last())
+	}
+	list := caps.List()
+	if len(list) != 2 || list[0] != "batch" || list[1] != "multi-prefix" {
+		t.Fatalf("Incorrect enabled capabilities: %v", list)
+	}
+}
+
+func TestCapabilityNegotiationWithSASL(t *testing.T) {
+	sasl, _ := NewSASL(SASLConfig{Mechanism: "EXTERNAL"})
+	caps := NewCapabilities([]string{"server-time"}, sasl)
+	w := &captureWriter{}
+
+	caps.Begin(w)
+	handleLines(t, caps, w, ":server CAP * LS :server-time sasl")
+	if w.Last() != "CAP REQ :server-time sasl" {
+		t.Fatalf("Incorrect request: %s", w.Last())
+	}
+	handleLines(t, caps, w, ":server CAP * ACK :server-time sasl")
+	if w.Last() != "AUTHENTICATE EXTERNAL" {
+		t.Fatalf("Authentication was not started: %s", w.Last())
+	}
+	handleLines(t, caps, w, "AUTHENTICATE +", ":server 903 * :SASL authentication successful")
+	if w.Last() != "CAP END" {
+		t.Fatalf("Negotiation was not ended: %s", w.Last())
+	}
+}
+
+func TestCapabilityNegotiationWithoutColon(t *testing.T) {
+	sasl, _ := NewSASL(SASLConfig{Mechanism: "EXTERNAL"})
+	caps := NewCapabilities(nil, sasl)
+	w := &captureWriter{}
+
+	// A single capability may be sent as a middle parameter
+	caps.Begin(w)
+	handleLines(t, caps, w, ":server CAP * LS * multi-prefix", ":server CAP * LS sasl")
+	if w.Last() != "CAP REQ :multi-prefix sasl" {
+		t.Fatalf("Incorrect request: %s", w.Last())
+	}
+	handleLines(t, caps, w, ":server CAP bot ACK sasl")
+	if w.Last() != "AUTHENTICATE EXTERNAL" || !caps.Enabled("sasl") {
+		t.Fatalf("Authentication was not started: %s", w.Last())
+	}
+
+	caps = NewCapabilities(nil, sasl)
+	caps.Begin(w)
+	handleLines(t, caps, w, ":server CAP * LS :sasl")
+	_, err := caps.Handle(ParseMessage(":server CAP bot NAK sasl"), w)
+	if _, ok := err.(*SASLError); !ok {
+		t.Fatalf("Expected a SASLError for the refused capability, got %v", err)
+	}
+}
+
+func TestCapabilityNegotiationMissingSASL(t *testing.T) {
+	sasl, _ := NewSASL(SASLConfig{Mechanism: "EXTERNAL"})
+	caps := NewCapabilities(nil, sasl)
+	w := &captureWriter{}
+
+	caps.Begin(w)
+	_, err := caps.Handle(ParseMessage(":server CAP * LS :server-time"), w)
+	if saslError, ok := err.(*SASLError); !ok || saslError.Code != CAP {
+		t.Fatalf("Expected a CAP SASLError, got %v", err)
+	}
+
+	// A server without CAP support registers us straight away
+	caps = NewCapabilities(nil, sasl)
+	caps.Begin(w)
+	_, err = caps.Handle(ParseMessage(":server 001 bot :Welcome"), w)
+	if _, ok := err.(*SASLError); !ok {
+		t.Fatalf("Expected a SASLError, got %v", err)
+	}
+}
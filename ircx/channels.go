@@ -0,0 +1,219 @@
+package ircx
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+)
+
+// Channel is a channel name along with the key needed to join it, if any
+type Channel struct {
+	Name string
+	Key  string
+}
+
+// ParseChannels parses a comma-separated list of channels, each optionally
+// followed by a space and its key, e.g. "#wallops,#secret hunter2".
+func ParseChannels(list string) []Channel {
+	var channels []Channel
+	for _, item := range strings.Split(list, ",") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			continue
+		}
+		channel := Channel{Name: fields[0]}
+		if len(fields) > 1 {
+			channel.Key = fields[1]
+		}
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// JoinMessage builds the JOIN for a channel
+func (c Channel) JoinMessage() *Message {
+	params := []string{c.Name}
+	if c.Key != "" {
+		params = append(params, c.Key)
+	}
+	return Wrap(&irc.Message{Command: irc.JOIN, Params: params})
+}
+
+// ChannelSet tracks the channels a connection is in, or is trying to join,
+// so they can be rejoined after reconnecting. It starts with the configured
+// channels, follows our own JOIN, PART and KICK messages, and drops channels
+// the server says don't exist. Channels that are full, invite only, ban us or
+// need a different key are kept, as that often changes by the next attempt.
+type ChannelSet struct {
+	channels []Channel
+	keys     map[string]string // keys from JOINs we sent, until confirmed
+
+	sync.RWMutex
+}
+
+func NewChannelSet(configured []Channel) *ChannelSet {
+	return &ChannelSet{
+		channels: append([]Channel(nil), configured...),
+		keys:     make(map[string]string),
+	}
+}
+
+// List returns the channels in the order they were joined
+func (s *ChannelSet) List() []Channel {
+	s.RLock()
+	defer s.RUnlock()
+	return append([]Channel(nil), s.channels...)
+}
+
+// Sent records the keys of a JOIN we are about to send, which the server
+// doesn't echo back to us.
+func (s *ChannelSet) Sent(msg *Message, isupport *ISupport) {
+	if msg.Command != irc.JOIN {
+		return
+	}
+	names := strings.Split(msg.Param(0), ",")
+	keys := strings.Split(msg.Param(1), ",")
+
+	s.Lock()
+	defer s.Unlock()
+	for idx, name := range names {
+		if idx < len(keys) && keys[idx] != "" {
+			s.keys[isupport.Fold(name)] = keys[idx]
+		}
+	}
+}
+
+// Handle updates the set from a message received from the server, where
+// nick is our current nickname.
+func (s *ChannelSet) Handle(msg *Message, nick string, isupport *ISupport) {
+	ours := msg.Prefix != nil && isupport.Fold(msg.Name) == isupport.Fold(nick)
+
+	switch msg.Command {
+	case irc.JOIN:
+		if ours {
+			s.add(msg.Param(0), isupport)
+		}
+	case irc.PART:
+		if ours {
+			s.remove(msg.Param(0), isupport)
+		}
+	case irc.KICK:
+		if isupport.Fold(msg.Param(1)) == isupport.Fold(nick) {
+			s.remove(msg.Param(0), isupport)
+		}
+	case irc.MODE:
+		// Keep track of key changes so we can get back in
+		if isupport.IsChannel(msg.Param(0)) {
+			s.updateKey(msg, isupport)
+		}
+	case irc.ERR_NOSUCHCHANNEL:
+		s.remove(msg.Param(1), isupport)
+	}
+}
+
+func (s *ChannelSet) add(name string, isupport *ISupport) {
+	s.Lock()
+	defer s.Unlock()
+
+	folded := isupport.Fold(name)
+	key, ok := s.keys[folded]
+	delete(s.keys, folded)
+	for idx, channel := range s.channels {
+		if isupport.Fold(channel.Name) == folded {
+			if ok {
+				s.channels[idx].Key = key
+			}
+			return
+		}
+	}
+	s.channels = append(s.channels, Channel{Name: name, Key: key})
+}
+
+func (s *ChannelSet) remove(name string, isupport *ISupport) {
+	s.Lock()
+	defer s.Unlock()
+
+	folded := isupport.Fold(name)
+	for idx, channel := range s.channels {
+		if isupport.Fold(channel.Name) == folded {
+			s.channels = append(s.channels[:idx], s.channels[idx+1:]...)
+			return
+		}
+	}
+}
+
+// updateKey applies +k and -k from a channel MODE message
+func (s *ChannelSet) updateKey(msg *Message, isupport *ISupport) {
+	changes := ParseModes(msg, isupport)
+
+	s.Lock()
+	defer s.Unlock()
+	folded := isupport.Fold(msg.Param(0))
+	for idx, channel := range s.channels {
+		if isupport.Fold(channel.Name) != folded {
+			continue
+		}
+		for _, change := range changes {
+			if change.Mode == 'k' {
+				if change.Add {
+					s.channels[idx].Key = change.Param
+				} else {
+					s.channels[idx].Key = ""
+				}
+			}
+		}
+	}
+}
+
+// ModeChange is a single mode being set or unset
+type ModeChange struct {
+	Add   bool
+	Mode  byte
+	Param string
+}
+
+// ParseModes parses the changes in a channel MODE message (or RPL_CHANNELMODEIS),
+// using CHANMODES and PREFIX to decide which modes take a parameter.
+func ParseModes(msg *Message, isupport *ISupport) []ModeChange {
+	args := append([]string(nil), msg.Params...)
+	if msg.Trailing != "" {
+		args = append(args, msg.Trailing)
+	}
+	// MODE <channel> <modes> [params], RPL_CHANNELMODEIS has our nick first
+	if msg.Command != irc.MODE && len(args) > 0 {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return nil
+	}
+
+	groups := isupport.ChanModes()
+	prefixModes, _ := isupport.Prefix()
+	params := args[2:]
+	var changes []ModeChange
+	add := true
+	for idx := 0; idx < len(args[1]); idx++ {
+		mode := args[1][idx]
+		switch {
+		case mode == '+':
+			add = true
+			continue
+		case mode == '-':
+			add = false
+			continue
+		}
+
+		change := ModeChange{Add: add, Mode: mode}
+		takesParam := strings.IndexByte(groups[0], mode) >= 0 ||
+			strings.IndexByte(groups[1], mode) >= 0 ||
+			strings.IndexByte(prefixModes, mode) >= 0 ||
+			(add && strings.IndexByte(groups[2], mode) >= 0)
+		if takesParam && len(params) > 0 {
+			change.Param = params[0]
+			params = params[1:]
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
@@ -0,0 +1,48 @@
+package ircx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseChannels(t *testing.T) {
+	channels := ParseChannels("#wallops, #secret hunter2 ,,")
+	expected := []Channel{{"#wallops", ""}, {"#secret", "hunter2"}}
+	if !reflect.DeepEqual(channels, expected) {
+		t.Fatalf("Incorrect channels: %v", channels)
+	}
+	if msg := channels[1].JoinMessage(); msg.String() != "JOIN #secret hunter2" {
+		t.Fatalf("Incorrect join message: %s", msg)
+	}
+}
+
+func TestChannelSetTracksMembership(t *testing.T) {
+	isupport := NewISupport()
+	set := NewChannelSet([]Channel{{"#wallops", ""}, {"#banned", ""}, {"#gone", ""}})
+
+	set.Sent(ParseMessage("JOIN #Secret,#open hunter2"), isupport)
+	lines := []string{
+		":server 474 bot #banned :Cannot join channel (+b)",
+		":server 403 bot #gone :No such channel",
+		":bot!~bot@host JOIN #wallops",
+		":bot!~bot@host JOIN :#secret",
+		":bot!~bot@host JOIN #open",
+		":other!~o@host JOIN #elsewhere",
+		":bot!~bot@host PART #open :bye",
+		":op!~op@host MODE #wallops +ko newkey bot",
+	}
+	for _, line := range lines {
+		set.Handle(ParseMessage(line), "Bot", isupport)
+	}
+
+	// #banned is kept to try again after reconnecting
+	expected := []Channel{{"#wallops", "newkey"}, {"#banned", ""}, {"#secret", "hunter2"}}
+	if channels := set.List(); !reflect.DeepEqual(channels, expected) {
+		t.Fatalf("Incorrect channels: %v", channels)
+	}
+
+	set.Handle(ParseMessage(":op!~op@host KICK #wallops bot :go away"), "bot", isupport)
+	if channels := set.List(); len(channels) != 2 || channels[0].Name != "#banned" {
+		t.Fatalf("Kick did not remove channel: %v", channels)
+	}
+}
@@ -0,0 +1,106 @@
+// Package ircx contains the pieces of the IRC protocol that are shared by the
+// wallops proxy and the wallops HTTP server, but which are not provided by the
+// sorcix/irc package.
+package ircx
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+)
+
+var (
+	caBundleError = fmt.Errorf("No certificates found in CA bundle")
+)
+
+// TLSConfig describes if and how a connection to an IRC server should be
+// secured. The zero value is a plain TCP connection.
+//
+// The CA bundle and client certificate can be given either as files or
+// inline as PEM. The files take precedence, and should only be accepted from
+// whoever runs the process, as they can name any file it can read.
+type TLSConfig struct {
+	Enabled            bool   // whether or not to connect using TLS
+	ServerName         string // the name to verify the certificate against (defaults to the host)
+	CAFile             string // a PEM bundle of trusted CAs (defaults to the system pool)
+	InsecureSkipVerify bool   // do not verify the server certificate (test networks only)
+	CertFile           string // a PEM client certificate, used for CertFP
+	KeyFile            string // the PEM private key for CertFile
+
+	CAPEM   string // the contents of a CA bundle, rather than CAFile
+	CertPEM string // the contents of a client certificate, rather than CertFile
+	KeyPEM  string // the contents of the private key for CertPEM
+}
+
+// HasFiles reports whether the configuration refers to any files
+func (c TLSConfig) HasFiles() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.KeyFile != ""
+}
+
+// Config builds the crypto/tls configuration for connecting to host.
+func (c TLSConfig) Config(host string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	ca := []byte(c.CAPEM)
+	if c.CAFile != "" {
+		var err error
+		ca, err = ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.CAFile != "" || c.CAPEM != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, caBundleError
+		}
+		config.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	} else if c.CertPEM != "" || c.KeyPEM != "" {
+		cert, err := tls.X509KeyPair([]byte(c.CertPEM), []byte(c.KeyPEM))
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Dial makes a network connection to the given host and port, performing the
+// TLS handshake if required. The timeout applies to both the TCP connection
+// and the handshake, so a stalled server can't hang registration.
+//
+// The returned connection is a *tls.Conn when TLS is enabled, which supports
+// the same deadline semantics as a *net.TCPConn: a read that times out does
+// not poison the connection, so the missed-deadline heartbeat still works.
+func Dial(host string, port int, config TLSConfig, timeout time.Duration) (net.Conn, error) {
+	endpoint := net.JoinHostPort(host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: timeout}
+	if !config.Enabled {
+		return dialer.Dial("tcp", endpoint)
+	}
+
+	tlsConfig, err := config.Config(host)
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, "tcp", endpoint, tlsConfig)
+}
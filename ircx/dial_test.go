@@ -0,0 +1,98 @@
+package ircx
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startTLSServer starts a TLS listener and writes its certificate to a PEM
+// file that can be used as a CA bundle.
+func startTLSServer(t *testing.T) (host string, port int, caFile string) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ = strconv.Atoi(portStr)
+
+	caFile = filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return host, port, caFile
+}
+
+func TestDialTLSWithCABundle(t *testing.T) {
+	host, port, caFile := startTLSServer(t)
+
+	// httptest certificates are issued for "example.com"
+	config := TLSConfig{Enabled: true, ServerName: "example.com", CAFile: caFile}
+	conn, err := Dial(host, port, config, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial with custom CA bundle: %s", err)
+	}
+	conn.Close()
+}
+
+func TestDialTLSWithInlineCA(t *testing.T) {
+	host, port, caFile := startTLSServer(t)
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := TLSConfig{Enabled: true, ServerName: "example.com", CAPEM: string(ca)}
+	conn, err := Dial(host, port, config, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial with inline CA bundle: %s", err)
+	}
+	conn.Close()
+}
+
+func TestDialTLSUntrusted(t *testing.T) {
+	host, port, _ := startTLSServer(t)
+
+	config := TLSConfig{Enabled: true}
+	conn, err := Dial(host, port, config, time.Second)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("Expected certificate verification to fail")
+	}
+
+	config.InsecureSkipVerify = true
+	conn, err = Dial(host, port, config, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to dial with verification disabled: %s", err)
+	}
+	conn.Close()
+}
+
+func TestConfigInvalidFiles(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := ioutil.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []TLSConfig{
+		{CAFile: empty},
+		{CAFile: filepath.Join(os.TempDir(), "does-not-exist.pem")},
+		{CertFile: empty, KeyFile: empty},
+		{CAPEM: "not a certificate"},
+		{CertPEM: "not a certificate", KeyPEM: "not a key"},
+	}
+	for idx, config := range tests {
+		if _, err := config.Config("localhost"); err == nil {
+			t.Fatalf("Expected an error for config %d", idx)
+		}
+	}
+}
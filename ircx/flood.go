@@ -0,0 +1,274 @@
+package ircx
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+var (
+	QueueFullError   = fmt.Errorf("Send queue is full, message dropped")
+	QueueClosedError = fmt.Errorf("Send queue is closed")
+)
+
+// Priority selects the lane a message is queued in. Messages in a higher
+// priority lane are always sent before those in a lower one.
+type Priority int
+
+const (
+	PriorityHigh   Priority = iota // keepalives and QUIT
+	PriorityNormal                 // everything else
+	numPriorities
+)
+
+// PriorityOf returns the lane a message should be queued in. Only keepalives
+// and QUIT jump the queue; everything else is sent in the order it was
+// queued, so that text sent before a PART, MODE or KICK still arrives first.
+func PriorityOf(msg *Message) Priority {
+	switch msg.Command {
+	case irc.PING, irc.PONG, irc.QUIT:
+		return PriorityHigh
+	}
+	return PriorityNormal
+}
+
+// FloodConfig controls how quickly messages are sent to the server. The zero
+// value uses DefaultFloodConfig.
+type FloodConfig struct {
+	Burst int     // messages that may be sent back-to-back
+	Rate  float64 // messages per second once the burst has been used
+	Size  int     // maximum number of queued messages
+}
+
+var DefaultFloodConfig = FloodConfig{
+	Burst: 5,
+	Rate:  0.5,
+	Size:  256,
+}
+
+func (c FloodConfig) withDefaults() FloodConfig {
+	if c.Burst <= 0 {
+		c.Burst = DefaultFloodConfig.Burst
+	}
+	if c.Rate <= 0 {
+		c.Rate = DefaultFloodConfig.Rate
+	}
+	if c.Size <= 0 {
+		c.Size = DefaultFloodConfig.Size
+	}
+	return c
+}
+
+// WriterFunc adapts a function to the MessageWriter interface
+type WriterFunc func(*Message) error
+
+func (f WriterFunc) WriteMessage(msg *Message) error {
+	return f(msg)
+}
+
+// QueueStats is a snapshot of a send queue
+type QueueStats struct {
+	Depth    [numPriorities]int // messages waiting in each lane
+	Sent     uint64             // messages written successfully
+	Rejected uint64             // messages dropped because the queue was full
+	Failed   uint64             // messages the underlying writer failed to write
+}
+
+// SendQueue rate limits outgoing messages with a token bucket so that bursts
+// from consumers don't get us disconnected for flooding. It satisfies the
+// MessageWriter interface, but WriteMessage only queues the message; errors
+// from the underlying writer are counted in the stats rather than returned.
+type SendQueue struct {
+	writer MessageWriter
+	config FloodConfig
+
+	lanes  [numPriorities][][]*Message // units of messages sent back-to-back
+	tokens float64                     // messages that may be sent immediately
+	last   time.Time                   // when tokens was last refilled
+	stats  QueueStats
+	closed bool
+
+	wake chan struct{}
+	done chan struct{}
+	mu   sync.Mutex
+}
+
+func NewSendQueue(w MessageWriter, config FloodConfig) *SendQueue {
+	config = config.withDefaults()
+	q := &SendQueue{
+		writer: w,
+		config: config,
+		tokens: float64(config.Burst),
+		last:   time.Now(),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// WriteMessage queues a message, returning QueueFullError if the queue is at
+// capacity. High priority messages are always accepted.
+func (q *SendQueue) WriteMessage(msg *Message) error {
+	return q.WriteMessages([]*Message{msg})
+}
+
+// WriteMessages queues messages as one unit, such as a batch, so that
+// nothing else (not even a keepalive) is sent in between them. They are
+// still rate limited. If there isn't room for all of them, none are queued
+// and QueueFullError is returned. The unit is only high priority if every
+// message in it is.
+func (q *SendQueue) WriteMessages(msgs []*Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	lane := PriorityHigh
+	for _, msg := range msgs {
+		if priority := PriorityOf(msg); priority > lane {
+			lane = priority
+		}
+	}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return QueueClosedError
+	}
+	if lane != PriorityHigh && q.depth()+len(msgs) > q.config.Size {
+		q.stats.Rejected += uint64(len(msgs))
+		q.mu.Unlock()
+		return QueueFullError
+	}
+	q.lanes[lane] = append(q.lanes[lane], msgs)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the queue depth and counters
+func (q *SendQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	for lane := range q.lanes {
+		stats.Depth[lane] = laneDepth(q.lanes[lane])
+	}
+	return stats
+}
+
+// Close stops the queue. Messages that have not been sent are discarded.
+func (q *SendQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+}
+
+func (q *SendQueue) depth() int {
+	total := 0
+	for _, lane := range q.lanes {
+		total += laneDepth(lane)
+	}
+	return total
+}
+
+// laneDepth counts the messages in a lane's units
+func laneDepth(lane [][]*Message) int {
+	total := 0
+	for _, unit := range lane {
+		total += len(unit)
+	}
+	return total
+}
+
+func (q *SendQueue) run() {
+	for {
+		// Wait for something to send
+		q.mu.Lock()
+		empty := q.depth() == 0
+		q.mu.Unlock()
+		if empty {
+			select {
+			case <-q.wake:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+
+		// Only pick the unit once the bucket allows us to send, so anything
+		// urgent that arrived while we were waiting goes first. The rest of
+		// the unit follows without anything in between.
+		if !q.wait() {
+			return
+		}
+		for i, msg := range q.pop() {
+			if i > 0 && !q.wait() {
+				return
+			}
+			err := q.writer.WriteMessage(msg)
+
+			q.mu.Lock()
+			if err != nil {
+				q.stats.Failed++
+			} else {
+				q.stats.Sent++
+			}
+			q.mu.Unlock()
+		}
+	}
+}
+
+// wait waits until the bucket allows us to send, returning false if the
+// queue is closed first
+func (q *SendQueue) wait() bool {
+	for delay := q.take(); delay > 0; delay = q.take() {
+		select {
+		case <-time.After(delay):
+		case <-q.done:
+			return false
+		}
+	}
+	return true
+}
+
+// take consumes a token if one is available, otherwise it returns how long
+// to wait until one will be.
+func (q *SendQueue) take() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	q.tokens += now.Sub(q.last).Seconds() * q.config.Rate
+	if q.tokens > float64(q.config.Burst) {
+		q.tokens = float64(q.config.Burst)
+	}
+	q.last = now
+
+	if q.tokens >= 1 {
+		q.tokens--
+		return 0
+	}
+	return time.Duration((1 - q.tokens) / q.config.Rate * float64(time.Second))
+}
+
+func (q *SendQueue) pop() []*Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for lane := range q.lanes {
+		if len(q.lanes[lane]) > 0 {
+			unit := q.lanes[lane][0]
+			q.lanes[lane] = q.lanes[lane][1:]
+			return unit
+		}
+	}
+	return nil
+}
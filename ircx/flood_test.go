@@ -0,0 +1,149 @@
+package ircx
+
+import (
+	"testing"
+	"time"
+)
+
+// blockingWriter records messages, blocking each write until released
+type blockingWriter struct {
+	written chan *Message
+	release chan bool
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{
+		written: make(chan *Message, 10),
+		release: make(chan bool),
+	}
+}
+
+func (w *blockingWriter) WriteMessage(msg *Message) error {
+	w.written <- msg
+	<-w.release
+	return nil
+}
+
+func (w *blockingWriter) next(t *testing.T) string {
+	select {
+	case msg := <-w.written:
+		return msg.String()
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for a message")
+	}
+	return ""
+}
+
+func TestSendQueuePriority(t *testing.T) {
+	w := newBlockingWriter()
+	q := NewSendQueue(w, FloodConfig{Burst: 10, Rate: 1000})
+	defer q.Close()
+
+	q.WriteMessage(ParseMessage("PRIVMSG #a :one"))
+	if line := w.next(t); line != "PRIVMSG #a :one" {
+		t.Fatalf("Unexpected first message: %s", line)
+	}
+
+	// While the writer is busy, queue some chat, a PART and then a PONG
+	q.WriteMessage(ParseMessage("PRIVMSG #a :two"))
+	q.WriteMessage(ParseMessage("PART #a"))
+	q.WriteMessage(ParseMessage("PONG :server"))
+	if stats := q.Stats(); stats.Depth != [numPriorities]int{1, 2} {
+		t.Fatalf("Incorrect queue depth: %v", stats.Depth)
+	}
+
+	// Only the PONG jumps the queue, the PART stays after the chat
+	expected := []string{"PONG :server", "PRIVMSG #a :two", "PART #a"}
+	for _, line := range expected {
+		w.release <- true
+		if actual := w.next(t); actual != line {
+			t.Fatalf("Got %s, expected %s", actual, line)
+		}
+	}
+	w.release <- true
+}
+
+func TestSendQueueUnit(t *testing.T) {
+	w := newBlockingWriter()
+	q := NewSendQueue(w, FloodConfig{Burst: 10, Rate: 1000, Size: 4})
+	defer q.Close()
+
+	q.WriteMessage(ParseMessage("PRIVMSG #a :one"))
+	w.next(t)
+
+	// A batch that doesn't fit is rejected whole
+	batch := []*Message{
+		ParseMessage("BATCH +ref draft/multiline #a"),
+		ParseMessage("@batch=ref PRIVMSG #a :two"),
+		ParseMessage("@batch=ref PRIVMSG #a :three"),
+		ParseMessage("BATCH -ref"),
+	}
+	if err := q.WriteMessages(append(batch, ParseMessage("PRIVMSG #a :four"))); err != QueueFullError {
+		t.Fatalf("Expected the queue to be full, got %v", err)
+	}
+	if stats := q.Stats(); stats.Depth != [numPriorities]int{0, 0} {
+		t.Fatalf("Rejected messages were queued: %v", stats.Depth)
+	}
+
+	// Once the batch has started, a PONG waits for it to end
+	q.WriteMessages(batch)
+	w.release <- true
+	if line := w.next(t); line != "BATCH +ref draft/multiline #a" {
+		t.Fatalf("Unexpected start of the batch: %s", line)
+	}
+	q.WriteMessage(ParseMessage("PONG :server"))
+	expected := []string{"@batch=ref PRIVMSG #a :two", "@batch=ref PRIVMSG #a :three", "BATCH -ref", "PONG :server"}
+	for _, line := range expected {
+		w.release <- true
+		if actual := w.next(t); actual != line {
+			t.Fatalf("Got %s, expected %s", actual, line)
+		}
+	}
+	w.release <- true
+}
+
+func TestSendQueueFull(t *testing.T) {
+	w := newBlockingWriter()
+	q := NewSendQueue(w, FloodConfig{Burst: 10, Rate: 1000, Size: 2})
+	defer q.Close()
+
+	q.WriteMessage(ParseMessage("PRIVMSG #a :one"))
+	w.next(t)
+	q.WriteMessage(ParseMessage("PRIVMSG #a :two"))
+	q.WriteMessage(ParseMessage("PRIVMSG #a :three"))
+
+	if err := q.WriteMessage(ParseMessage("PRIVMSG #a :four")); err != QueueFullError {
+		t.Fatalf("Expected the queue to be full, got %v", err)
+	}
+	if err := q.WriteMessage(ParseMessage("QUIT :bye")); err != nil {
+		t.Fatalf("High priority messages should always be queued: %s", err)
+	}
+	if stats := q.Stats(); stats.Rejected != 1 {
+		t.Fatalf("Incorrect rejected count: %d", stats.Rejected)
+	}
+}
+
+func TestSendQueueRate(t *testing.T) {
+	written := make(chan *Message, 10)
+	q := NewSendQueue(WriterFunc(func(msg *Message) error {
+		written <- msg
+		return nil
+	}), FloodConfig{Burst: 2, Rate: 20})
+	defer q.Close()
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		q.WriteMessage(ParseMessage("PRIVMSG #a :hi"))
+	}
+	for i := 0; i < 4; i++ {
+		<-written
+	}
+
+	// Two messages are sent immediately, the next two 50ms apart
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("Messages were sent too quickly: %v", elapsed)
+	}
+	if stats := q.Stats(); stats.Sent != 4 {
+		t.Fatalf("Incorrect sent count: %d", stats.Sent)
+	}
+}
@@ -0,0 +1,245 @@
+package ircx
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	SubscriberOverflowError = fmt.Errorf("Subscriber fell too far behind")
+	HubClosedError          = fmt.Errorf("Hub has been closed")
+)
+
+// OverflowPolicy decides what happens when a message is published to a
+// subscriber whose buffer is full.
+type OverflowPolicy int
+
+const (
+	DropOldest OverflowPolicy = iota // discard the oldest buffered message to make room
+	Disconnect                       // unsubscribe the subscriber
+	Block                            // wait for the subscriber, holding up the publisher
+)
+
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return Disconnect, nil
+	case "block":
+		return Block, nil
+	}
+	return DropOldest, fmt.Errorf("unknown overflow policy %q, expected drop-oldest, disconnect or block", name)
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case Disconnect:
+		return "disconnect"
+	case Block:
+		return "block"
+	}
+	return "drop-oldest"
+}
+
+// UnmarshalText allows a policy to be given by name in configuration files
+func (p *OverflowPolicy) UnmarshalText(text []byte) error {
+	policy, err := ParseOverflowPolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+func (p OverflowPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// Hub broadcasts messages to any number of subscribers, each with its own
+// bounded buffer, so that one slow subscriber doesn't hold up the others
+// unless its policy is Block.
+type Hub struct {
+	subscribers map[*Subscription]bool
+	closed      bool
+	sync.Mutex
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[*Subscription]bool)}
+}
+
+// Subscribe returns a subscription that receives every message published
+// from now on, buffering up to size of them. If filter isn't nil, only the
+// messages it accepts are delivered; it is called by Publish, in the
+// publisher's goroutine.
+func (h *Hub) Subscribe(size int, policy OverflowPolicy, filter func(*Message) bool) *Subscription {
+	if size < 1 {
+		size = 1
+	}
+	s := &Subscription{
+		hub:      h,
+		policy:   policy,
+		filter:   filter,
+		messages: make(chan *Message, size),
+		done:     make(chan struct{}),
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		s.closeWith(HubClosedError)
+		return s
+	}
+	h.subscribers[s] = true
+	return s
+}
+
+// Publish delivers a message to every subscriber, according to their
+// overflow policies. Publish doesn't return until the message has been
+// buffered (or dropped) for each of them.
+func (h *Hub) Publish(msg *Message) {
+	h.Lock()
+	subscribers := make([]*Subscription, 0, len(h.subscribers))
+	for s := range h.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	h.Unlock()
+
+	for _, s := range subscribers {
+		if s.filter != nil && !s.filter(msg) {
+			continue
+		}
+		if !s.deliver(msg) {
+			s.close(SubscriberOverflowError)
+		}
+	}
+}
+
+// Len returns the number of subscribers
+func (h *Hub) Len() int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.subscribers)
+}
+
+// Close unsubscribes everyone. Subscribing to a closed hub returns a
+// subscription that is already closed.
+func (h *Hub) Close() {
+	h.Lock()
+	h.closed = true
+	subscribers := h.subscribers
+	h.subscribers = make(map[*Subscription]bool)
+	h.Unlock()
+
+	for s := range subscribers {
+		s.close(HubClosedError)
+	}
+}
+
+func (h *Hub) remove(s *Subscription) {
+	h.Lock()
+	delete(h.subscribers, s)
+	h.Unlock()
+}
+
+// Subscription is a subscriber's view of a hub
+type Subscription struct {
+	hub      *Hub
+	policy   OverflowPolicy
+	filter   func(*Message) bool
+	messages chan *Message
+
+	// done is closed first when unsubscribing, to release a publisher
+	// blocked on a full buffer, and then messages is closed under the lock
+	done     chan struct{}
+	doneOnce sync.Once
+	closed   bool
+	err      error
+	dropped  uint64
+	sync.Mutex
+}
+
+// Messages returns the channel messages are delivered on. It is closed once
+// the subscription ends, after any messages still buffered.
+func (s *Subscription) Messages() <-chan *Message {
+	return s.messages
+}
+
+// Unsubscribe stops delivery. It is safe to call more than once, and from
+// any goroutine.
+func (s *Subscription) Unsubscribe() {
+	s.close(nil)
+}
+
+// Err returns why the subscription ended: nil if it was unsubscribed,
+// SubscriberOverflowError if it fell behind with the Disconnect policy, or
+// HubClosedError.
+func (s *Subscription) Err() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
+// Dropped returns how many messages have been discarded under the
+// DropOldest policy
+func (s *Subscription) Dropped() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.dropped
+}
+
+// deliver buffers a message, returning false if the subscriber should be
+// disconnected for falling behind
+func (s *Subscription) deliver(msg *Message) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return true
+	}
+
+	switch s.policy {
+	case Block:
+		select {
+		case s.messages <- msg:
+		case <-s.done:
+		}
+	case Disconnect:
+		select {
+		case s.messages <- msg:
+		default:
+			return false
+		}
+	default:
+		for {
+			select {
+			case s.messages <- msg:
+				return true
+			default:
+			}
+			// The subscriber may have made room in the meantime
+			select {
+			case <-s.messages:
+				s.dropped++
+			default:
+			}
+		}
+	}
+	return true
+}
+
+func (s *Subscription) close(err error) {
+	s.closeWith(err)
+	s.hub.remove(s)
+}
+
+func (s *Subscription) closeWith(err error) {
+	s.doneOnce.Do(func() { close(s.done) })
+	s.Lock()
+	defer s.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.err = err
+		close(s.messages)
+	}
+}
@@ -0,0 +1,159 @@
+package ircx
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func numbered(i int) *Message {
+	return ParseMessage("PRIVMSG #wallops :" + strconv.Itoa(i))
+}
+
+func received(s *Subscription) []string {
+	var texts []string
+	for {
+		select {
+		case msg, ok := <-s.Messages():
+			if !ok {
+				return texts
+			}
+			texts = append(texts, msg.Trailing)
+		default:
+			return texts
+		}
+	}
+}
+
+func TestHubDropOldest(t *testing.T) {
+	hub := NewHub()
+	s := hub.Subscribe(2, DropOldest, nil)
+	for i := 1; i <= 5; i++ {
+		hub.Publish(numbered(i))
+	}
+
+	got := received(s)
+	if len(got) != 2 || got[0] != "4" || got[1] != "5" {
+		t.Errorf("Expected the newest two messages, got %v", got)
+	}
+	if s.Dropped() != 3 {
+		t.Errorf("Dropped %d, expected 3", s.Dropped())
+	}
+}
+
+func TestHubDisconnect(t *testing.T) {
+	hub := NewHub()
+	slow := hub.Subscribe(2, Disconnect, nil)
+	fast := hub.Subscribe(10, Disconnect, nil)
+	for i := 1; i <= 3; i++ {
+		hub.Publish(numbered(i))
+	}
+
+	// The buffered messages are still delivered before the channel closes
+	got := received(slow)
+	if len(got) != 2 {
+		t.Errorf("Expected 2 messages, got %v", got)
+	}
+	if _, ok := <-slow.Messages(); ok {
+		t.Errorf("Expected the slow subscription to be closed")
+	}
+	if slow.Err() != SubscriberOverflowError {
+		t.Errorf("Expected %s, got %v", SubscriberOverflowError, slow.Err())
+	}
+	if got := received(fast); len(got) != 3 {
+		t.Errorf("The fast subscriber got %v", got)
+	}
+	if hub.Len() != 1 {
+		t.Errorf("Expected one subscriber left, got %d", hub.Len())
+	}
+}
+
+func TestHubBlock(t *testing.T) {
+	hub := NewHub()
+	s := hub.Subscribe(1, Block, nil)
+	hub.Publish(numbered(1))
+
+	published := make(chan struct{})
+	go func() {
+		hub.Publish(numbered(2))
+		close(published)
+	}()
+
+	select {
+	case <-published:
+		t.Fatalf("Publish didn't wait for the subscriber")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if msg := <-s.Messages(); msg.Trailing != "1" {
+		t.Errorf("Got %s first", msg)
+	}
+	<-published
+	if msg := <-s.Messages(); msg.Trailing != "2" {
+		t.Errorf("Got %s second", msg)
+	}
+}
+
+func TestHubUnsubscribeReleasesPublisher(t *testing.T) {
+	hub := NewHub()
+	s := hub.Subscribe(1, Block, nil)
+	hub.Publish(numbered(1))
+
+	published := make(chan struct{})
+	go func() {
+		hub.Publish(numbered(2))
+		close(published)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Unsubscribe()
+
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatalf("Publish is still blocked")
+	}
+	if s.Err() != nil || hub.Len() != 0 {
+		t.Errorf("Unexpected state after unsubscribing: %v, %d subscribers", s.Err(), hub.Len())
+	}
+	s.Unsubscribe()
+}
+
+func TestHubFilter(t *testing.T) {
+	hub := NewHub()
+	s := hub.Subscribe(10, DropOldest, func(msg *Message) bool {
+		return msg.Trailing != "2"
+	})
+	for i := 1; i <= 3; i++ {
+		hub.Publish(numbered(i))
+	}
+	if got := received(s); len(got) != 2 || got[0] != "1" || got[1] != "3" {
+		t.Errorf("Got %v", got)
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub()
+	s := hub.Subscribe(10, DropOldest, nil)
+	hub.Close()
+	if _, ok := <-s.Messages(); ok || s.Err() != HubClosedError {
+		t.Errorf("Expected the subscription to be closed by the hub, got %v", s.Err())
+	}
+
+	late := hub.Subscribe(10, DropOldest, nil)
+	if _, ok := <-late.Messages(); ok || late.Err() != HubClosedError {
+		t.Errorf("Expected a closed subscription, got %v", late.Err())
+	}
+	hub.Publish(numbered(1))
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, policy := range []OverflowPolicy{DropOldest, Disconnect, Block} {
+		parsed, err := ParseOverflowPolicy(policy.String())
+		if err != nil || parsed != policy {
+			t.Errorf("ParseOverflowPolicy(%q) = %v, %v", policy, parsed, err)
+		}
+	}
+	if _, err := ParseOverflowPolicy("drop"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,219 @@
+package ircx
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const RPL_ISUPPORT = "005"
+
+// DefaultNickLen is the RFC 1459 nickname length, assumed until the server
+// advertises NICKLEN.
+const DefaultNickLen = 9
+
+// ISupport holds the features a server advertises with RPL_ISUPPORT. Until a
+// token has been advertised its accessor returns the RFC 1459 default.
+// See https://modern.ircdocs.horse/#rplisupport-005
+type ISupport struct {
+	tokens map[string]string
+
+	sync.RWMutex
+}
+
+func NewISupport() *ISupport {
+	return &ISupport{tokens: make(map[string]string)}
+}
+
+// Handle records the tokens from an RPL_ISUPPORT message, returning false
+// for any other message. A token prefixed with "-" is removed.
+func (s *ISupport) Handle(msg *Message) bool {
+	if msg.Command != RPL_ISUPPORT || len(msg.Params) < 2 {
+		return false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// The first parameter is our nickname
+	for _, token := range msg.Params[1:] {
+		if strings.HasPrefix(token, "-") {
+			delete(s.tokens, strings.ToUpper(token[1:]))
+			continue
+		}
+		name, value := token, ""
+		if idx := strings.IndexByte(token, '='); idx >= 0 {
+			name, value = token[:idx], unescapeISupportValue(token[idx+1:])
+		}
+		s.tokens[strings.ToUpper(name)] = value
+	}
+	return true
+}
+
+// Get returns the raw value of a token and whether it has been advertised
+func (s *ISupport) Get(name string) (string, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	value, ok := s.tokens[strings.ToUpper(name)]
+	return value, ok
+}
+
+// Tokens returns a copy of all advertised tokens
+func (s *ISupport) Tokens() map[string]string {
+	s.RLock()
+	defer s.RUnlock()
+	tokens := make(map[string]string, len(s.tokens))
+	for name, value := range s.tokens {
+		tokens[name] = value
+	}
+	return tokens
+}
+
+func (s *ISupport) getDefault(name, fallback string) string {
+	if value, ok := s.Get(name); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// NickLen is the maximum nickname length
+func (s *ISupport) NickLen() int {
+	length, err := strconv.Atoi(s.getDefault("NICKLEN", ""))
+	if err != nil || length <= 0 {
+		return DefaultNickLen
+	}
+	return length
+}
+
+// ChanTypes is the set of characters that begin a channel name
+func (s *ISupport) ChanTypes() string {
+	return s.getDefault("CHANTYPES", "#&")
+}
+
+// Prefix returns the channel membership modes and their matching prefix
+// symbols, in order of rank, e.g. "ov" and "@+".
+func (s *ISupport) Prefix() (modes string, symbols string) {
+	value := s.getDefault("PREFIX", "(ov)@+")
+	end := strings.IndexByte(value, ')')
+	if !strings.HasPrefix(value, "(") || end < 0 || len(value[1:end]) != len(value[end+1:]) {
+		return "ov", "@+"
+	}
+	return value[1:end], value[end+1:]
+}
+
+// ChanModes returns the four CHANMODES groups: list modes, modes that always
+// take a parameter, modes that take a parameter only when set, and modes that
+// never take a parameter.
+func (s *ISupport) ChanModes() [4]string {
+	var groups [4]string
+	parts := strings.Split(s.getDefault("CHANMODES", "beI,k,l,imnpst"), ",")
+	for idx := 0; idx < len(parts) && idx < len(groups); idx++ {
+		groups[idx] = parts[idx]
+	}
+	return groups
+}
+
+// CaseMapping is the casemapping used to compare nicknames and channels
+func (s *ISupport) CaseMapping() string {
+	return strings.ToLower(s.getDefault("CASEMAPPING", "rfc1459"))
+}
+
+// Network is the name of the network, if advertised
+func (s *ISupport) Network() string {
+	return s.getDefault("NETWORK", "")
+}
+
+// TargMax returns the maximum number of targets for each command. A command
+// that is present with a limit of zero has no limit.
+func (s *ISupport) TargMax() map[string]int {
+	limits := make(map[string]int)
+	value, _ := s.Get("TARGMAX")
+	for _, item := range strings.Split(value, ",") {
+		idx := strings.IndexByte(item, ':')
+		if idx <= 0 {
+			continue
+		}
+		limit, _ := strconv.Atoi(item[idx+1:])
+		limits[strings.ToUpper(item[:idx])] = limit
+	}
+	return limits
+}
+
+// IsChannel reports whether a target is a channel name
+func (s *ISupport) IsChannel(target string) bool {
+	return target != "" && strings.IndexByte(s.ChanTypes(), target[0]) >= 0
+}
+
+// Fold maps a nickname or channel name to lower case according to the
+// server's casemapping, for use as a map key.
+func (s *ISupport) Fold(name string) string {
+	mapping := s.CaseMapping()
+	if mapping == "ascii" {
+		return asciiLower(name)
+	}
+	folded := []byte(asciiLower(name))
+	for idx, c := range folded {
+		switch c {
+		case '[':
+			folded[idx] = '{'
+		case ']':
+			folded[idx] = '}'
+		case '\\':
+			folded[idx] = '|'
+		case '~':
+			if mapping == "rfc1459" {
+				folded[idx] = '^'
+			}
+		}
+	}
+	return string(folded)
+}
+
+// ValidNick reports whether a nickname is acceptable to the server, taking
+// the advertised NICKLEN and CHANTYPES into account.
+func (s *ISupport) ValidNick(nick string) bool {
+	if !ValidNickname(nick) || utf8.RuneCountInString(nick) > s.NickLen() {
+		return false
+	}
+	return !s.IsChannel(nick)
+}
+
+// ValidNickname checks a nickname for characters that are never allowed,
+// regardless of the server.
+func ValidNickname(nick string) bool {
+	if nick == "" || strings.ContainsAny(nick, " ,*?!@:.\r\n\x00") {
+		return false
+	}
+	first := nick[0]
+	return !(first == '$' || first == '#' || first == '&' || first == '-' ||
+		(first >= '0' && first <= '9'))
+}
+
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return r
+	}, s)
+}
+
+// unescapeISupportValue decodes \xHH escapes in a token value
+func unescapeISupportValue(value string) string {
+	if !strings.Contains(value, "\\x") {
+		return value
+	}
+	var result []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if b, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				result = append(result, byte(b))
+				i += 3
+				continue
+			}
+		}
+		result = append(result, value[i])
+	}
+	return string(result)
+}
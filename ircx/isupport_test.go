@@ -0,0 +1,76 @@
+package ircx
+
+import "testing"
+
+func TestISupportDefaults(t *testing.T) {
+	s := NewISupport()
+	if s.NickLen() != DefaultNickLen || s.ChanTypes() != "#&" || s.CaseMapping() != "rfc1459" {
+		t.Fatalf("Incorrect defaults")
+	}
+	if modes, symbols := s.Prefix(); modes != "ov" || symbols != "@+" {
+		t.Fatalf("Incorrect default prefix: %s %s", modes, symbols)
+	}
+}
+
+func TestISupportTokens(t *testing.T) {
+	s := NewISupport()
+	lines := []string{
+		":server 005 bot NICKLEN=30 CHANTYPES=# PREFIX=(qaohv)~&@%+ " +
+			"CHANMODES=beI,k,l,imnpst CASEMAPPING=ascii :are supported by this server",
+		":server 005 bot NETWORK=Example\\x20Net TARGMAX=PRIVMSG:4,NOTICE:4,JOIN: " +
+			"EXCEPTS :are supported by this server",
+	}
+	for _, line := range lines {
+		if !s.Handle(ParseMessage(line)) {
+			t.Fatalf("Failed to handle %q", line)
+		}
+	}
+
+	if s.NickLen() != 30 || s.ChanTypes() != "#" || s.Network() != "Example Net" {
+		t.Fatalf("Incorrect tokens: %v", s.Tokens())
+	}
+	if modes, symbols := s.Prefix(); modes != "qaohv" || symbols != "~&@%+" {
+		t.Fatalf("Incorrect prefix: %s %s", modes, symbols)
+	}
+	if groups := s.ChanModes(); groups[0] != "beI" || groups[3] != "imnpst" {
+		t.Fatalf("Incorrect chanmodes: %v", groups)
+	}
+	targmax := s.TargMax()
+	if targmax["PRIVMSG"] != 4 || targmax["JOIN"] != 0 || len(targmax) != 3 {
+		t.Fatalf("Incorrect targmax: %v", targmax)
+	}
+	if _, ok := s.Get("excepts"); !ok {
+		t.Fatalf("Tokens without values should be recorded")
+	}
+
+	s.Handle(ParseMessage(":server 005 bot -EXCEPTS :are supported by this server"))
+	if _, ok := s.Get("EXCEPTS"); ok {
+		t.Fatalf("Negated token was not removed")
+	}
+}
+
+func TestISupportFold(t *testing.T) {
+	s := NewISupport()
+	if s.Fold("Nick[Away]~") != "nick{away}^" {
+		t.Fatalf("Incorrect rfc1459 folding: %s", s.Fold("Nick[Away]~"))
+	}
+	s.Handle(ParseMessage(":server 005 bot CASEMAPPING=ascii :are supported"))
+	if s.Fold("Nick[Away]") != "nick[away]" {
+		t.Fatalf("Incorrect ascii folding: %s", s.Fold("Nick[Away]"))
+	}
+}
+
+func TestValidNick(t *testing.T) {
+	s := NewISupport()
+	for _, nick := range []string{"", "1bot", "#bot", "bot bot", "bot!", "waytoolongnick"} {
+		if s.ValidNick(nick) {
+			t.Fatalf("Expected %q to be invalid", nick)
+		}
+	}
+	s.Handle(ParseMessage(":server 005 bot NICKLEN=16 :are supported"))
+	for _, nick := range []string{"bot", "[bot]", "waytoolongnick"} {
+		if !s.ValidNick(nick) {
+			t.Fatalf("Expected %q to be valid", nick)
+		}
+	}
+}
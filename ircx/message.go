@@ -0,0 +1,255 @@
+package ircx
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// Tags holds the decoded IRCv3 message tags of a message, keyed by tag name
+// (including any client-only "+" prefix or vendor namespace). Tags without a
+// value are present with an empty string.
+// See https://ircv3.net/specs/extensions/message-tags
+type Tags map[string]string
+
+// Message is an IRC message along with its IRCv3 tags. The irc package does
+// not understand tags, so they are removed before it parses the rest of the
+// line.
+type Message struct {
+	*irc.Message
+	Tags Tags
+}
+
+// Wrap converts an untagged message so it can be written
+func Wrap(msg *irc.Message) *Message {
+	return &Message{Message: msg}
+}
+
+// ParseMessage parses a line that may begin with "@tags ". It returns nil if
+// the line is not a valid message.
+func ParseMessage(raw string) *Message {
+	var tags Tags
+	if strings.HasPrefix(raw, "@") {
+		idx := strings.IndexByte(raw, ' ')
+		if idx < 0 {
+			return nil
+		}
+		tags = ParseTags(raw[1:idx])
+		raw = strings.TrimLeft(raw[idx+1:], " ")
+	}
+
+	msg := irc.ParseMessage(raw)
+	if msg == nil {
+		return nil
+	}
+	return &Message{Message: msg, Tags: tags}
+}
+
+// Time returns the time from the server-time tag, if present and valid
+func (m *Message) Time() (time.Time, bool) {
+	value, ok := m.Tags["time"]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// ServerTime formats t as the value of a server-time tag
+func ServerTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// Param returns the parameter at idx, treating the trailing parameter as the
+// last one. Servers differ in whether they send the final parameter of
+// commands like NICK and JOIN as trailing, so this hides the difference.
+// It returns an empty string if there is no such parameter.
+func (m *Message) Param(idx int) string {
+	if idx < len(m.Params) {
+		return m.Params[idx]
+	}
+	if idx == len(m.Params) {
+		return m.Trailing
+	}
+	return ""
+}
+
+// AllParams returns every parameter, with the trailing parameter (if any)
+// as the last one.
+func (m *Message) AllParams() []string {
+	params := append([]string{}, m.Params...)
+	if m.Trailing != "" || m.EmptyTrailing {
+		params = append(params, m.Trailing)
+	}
+	return params
+}
+
+// Bytes returns the message in wire format, without the line ending
+func (m *Message) Bytes() []byte {
+	if len(m.Tags) == 0 {
+		return m.Message.Bytes()
+	}
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte('@')
+	buffer.WriteString(m.Tags.String())
+	buffer.WriteByte(' ')
+	buffer.Write(m.Message.Bytes())
+	return buffer.Bytes()
+}
+
+func (m *Message) String() string {
+	return string(m.Bytes())
+}
+
+// ParseTags decodes the tag section of a message (without the leading @)
+func ParseTags(raw string) Tags {
+	tags := make(Tags)
+	for _, item := range strings.Split(raw, ";") {
+		if item == "" {
+			continue
+		}
+		key, value := item, ""
+		if idx := strings.IndexByte(item, '='); idx >= 0 {
+			key, value = item[:idx], unescapeTagValue(item[idx+1:])
+		}
+		tags[key] = value
+	}
+	return tags
+}
+
+// String encodes the tags in sorted order (without the leading @)
+func (t Tags) String() string {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	items := make([]string, len(keys))
+	for idx, key := range keys {
+		if value := t[key]; value != "" {
+			items[idx] = key + "=" + escapeTagValue(value)
+		} else {
+			items[idx] = key
+		}
+	}
+	return strings.Join(items, ";")
+}
+
+var tagEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+func escapeTagValue(value string) string {
+	return tagEscaper.Replace(value)
+}
+
+// unescapeTagValue reverses escapeTagValue. Unknown escapes drop the
+// backslash, and a trailing lone backslash is removed.
+func unescapeTagValue(value string) string {
+	if strings.IndexByte(value, '\\') < 0 {
+		return value
+	}
+	var buffer bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' {
+			buffer.WriteByte(c)
+			continue
+		}
+		i++
+		if i >= len(value) {
+			break
+		}
+		switch value[i] {
+		case ':':
+			buffer.WriteByte(';')
+		case 's':
+			buffer.WriteByte(' ')
+		case 'r':
+			buffer.WriteByte('\r')
+		case 'n':
+			buffer.WriteByte('\n')
+		default:
+			buffer.WriteByte(value[i])
+		}
+	}
+	return buffer.String()
+}
+
+// MaxLineLength is the longest line that peers may send us: 8191 bytes of
+// tags and 512 for the rest of the message.
+const MaxLineLength = 8191 + 512
+
+var LineTooLongError = fmt.Errorf("Line is too long")
+
+// Decoder reads tagged messages from a stream. Like irc.Decoder, it returns a
+// nil message (and nil error) for lines that cannot be parsed.
+type Decoder struct {
+	reader  *bufio.Reader
+	limited bool // lines longer than the reader's buffer are an error
+	mu      sync.Mutex
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{reader: bufio.NewReader(r)}
+}
+
+// NewLimitedDecoder returns a decoder that reads lines of at most max bytes,
+// line ending included, and returns LineTooLongError for any longer line.
+// The stream can't be read any further after that.
+func NewLimitedDecoder(r io.Reader, max int) *Decoder {
+	return &Decoder{reader: bufio.NewReaderSize(r, max), limited: true}
+}
+
+func (d *Decoder) Decode() (*Message, error) {
+	d.mu.Lock()
+	line, err := d.readLine()
+	d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return ParseMessage(line), nil
+}
+
+func (d *Decoder) readLine() (string, error) {
+	if !d.limited {
+		return d.reader.ReadString('\n')
+	}
+	line, err := d.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", LineTooLongError
+	}
+	return string(line), err
+}
+
+// Encoder writes tagged messages to a stream
+type Encoder struct {
+	writer io.Writer
+	mu     sync.Mutex
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{writer: w}
+}
+
+func (e *Encoder) Encode(msg *Message) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := fmt.Fprintf(e.writer, "%s\r\n", msg.Bytes())
+	return err
+}
@@ -0,0 +1,92 @@
+package ircx
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTaggedMessage(t *testing.T) {
+	raw := "@time=2011-10-19T16:40:51.620Z;msgid=abc;account=bob;+draft/reply=x\\sy\\:z\\\\ " +
+		":bob!b@host PRIVMSG #channel :hello there\r\n"
+	msg := ParseMessage(raw)
+	if msg == nil {
+		t.Fatalf("Failed to parse tagged message")
+	}
+	if msg.Command != "PRIVMSG" || msg.Trailing != "hello there" || msg.Name != "bob" {
+		t.Fatalf("Message body was not parsed: %#v", msg.Message)
+	}
+
+	expected := Tags{
+		"time":         "2011-10-19T16:40:51.620Z",
+		"msgid":        "abc",
+		"account":      "bob",
+		"+draft/reply": "x y;z\\",
+	}
+	if len(msg.Tags) != len(expected) {
+		t.Fatalf("Incorrect tags: %v", msg.Tags)
+	}
+	for key, value := range expected {
+		if msg.Tags[key] != value {
+			t.Fatalf("Tag %s was %q, expected %q", key, msg.Tags[key], value)
+		}
+	}
+
+	when, ok := msg.Time()
+	if !ok || !when.Equal(time.Date(2011, 10, 19, 16, 40, 51, 620e6, time.UTC)) {
+		t.Fatalf("Incorrect server time: %v", when)
+	}
+}
+
+func TestUnescapeTagValue(t *testing.T) {
+	tests := map[string]string{
+		"plain":     "plain",
+		"a\\sb":     "a b",
+		"a\\r\\n":   "a\r\n",
+		"\\b\\":     "b",
+		"semi\\:co": "semi;co",
+	}
+	for input, expected := range tests {
+		if actual := unescapeTagValue(input); actual != expected {
+			t.Fatalf("Unescaping %q gave %q, expected %q", input, actual, expected)
+		}
+	}
+}
+
+func TestEncodeTaggedMessage(t *testing.T) {
+	msg := ParseMessage("PRIVMSG #channel :hi")
+	msg.Tags = Tags{"label": "a;b c", "+typing": ""}
+
+	var buffer bytes.Buffer
+	NewEncoder(&buffer).Encode(msg)
+	expected := "@+typing;label=a\\:b\\sc PRIVMSG #channel :hi\r\n"
+	if buffer.String() != expected {
+		t.Fatalf("Incorrect encoding %q, expected %q", buffer.String(), expected)
+	}
+
+	// and it should survive a round trip
+	decoded, err := NewDecoder(&buffer).Decode()
+	if err != nil || decoded.Tags["label"] != "a;b c" {
+		t.Fatalf("Message did not round trip: %v %v", decoded, err)
+	}
+}
+
+func TestLimitedDecoder(t *testing.T) {
+	input := "PRIVMSG #channel :hi\r\nPRIVMSG #channel :" + strings.Repeat("a", 64) + "\r\n"
+	decoder := NewLimitedDecoder(strings.NewReader(input), 32)
+	if msg, err := decoder.Decode(); err != nil || msg.Trailing != "hi" {
+		t.Fatalf("Expected the short line, got %v %v", msg, err)
+	}
+	if msg, err := decoder.Decode(); err != LineTooLongError {
+		t.Fatalf("Expected %s, got %v %v", LineTooLongError, msg, err)
+	}
+}
+
+func TestParseInvalidMessage(t *testing.T) {
+	for _, raw := range []string{"", "@tags-only", "@a=b \r\n"} {
+		if msg := ParseMessage(raw); msg != nil {
+			t.Fatalf("Expected %q to be invalid, got %v", raw, msg)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package ircx
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+var GaveUpError = fmt.Errorf("Gave up reconnecting")
+
+// ReconnectPolicy controls how often, and for how long, a dropped connection
+// is retried. Delays grow exponentially from InitialDelay up to MaxDelay,
+// with up to Jitter added so that many connections don't retry in lockstep.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration // the delay before the first attempt
+	MaxDelay     time.Duration // the cap on the delay between attempts
+	Jitter       time.Duration // a random amount up to this is added to each delay
+	MaxAttempts  int           // give up after this many failures, zero retries forever
+	StableAfter  time.Duration // a connection up for this long resets the attempt count
+}
+
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialDelay: 2 * time.Second,
+	MaxDelay:     5 * time.Minute,
+	Jitter:       time.Second,
+	MaxAttempts:  0,
+	StableAfter:  5 * time.Minute,
+}
+
+// Delay returns how long to wait before the given (zero-based) attempt
+func (p ReconnectPolicy) Delay(attempt uint) time.Duration {
+	delay := p.MaxDelay
+	if attempt < 32 {
+		if backoff := p.InitialDelay * (1 << attempt); backoff > 0 && backoff < p.MaxDelay {
+			delay = backoff
+		}
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(p.Jitter) + 1))
+	}
+	return delay
+}
+
+// Backoff applies a ReconnectPolicy to a single connection
+type Backoff struct {
+	policy    ReconnectPolicy
+	attempt   uint
+	connected time.Time
+}
+
+func NewBackoff(policy ReconnectPolicy) *Backoff {
+	return &Backoff{policy: policy, connected: time.Now()}
+}
+
+// Connected records that a connection was established
+func (b *Backoff) Connected() {
+	b.connected = time.Now()
+}
+
+// Attempts returns the number of attempts made since the last stable
+// connection.
+func (b *Backoff) Attempts() int {
+	return int(b.attempt)
+}
+
+// Next returns how long to wait before the next attempt, or false if the
+// policy has given up. If the previous connection was stable the attempt
+// count starts again, so a connection that drops once a day is never given
+// up on, but one that keeps dropping straight away is.
+func (b *Backoff) Next() (time.Duration, bool) {
+	if !b.connected.IsZero() && time.Since(b.connected) >= b.policy.StableAfter {
+		b.attempt = 0
+	}
+	b.connected = time.Time{}
+
+	if b.policy.MaxAttempts > 0 && int(b.attempt) >= b.policy.MaxAttempts {
+		return 0, false
+	}
+	delay := b.policy.Delay(b.attempt)
+	b.attempt++
+	return delay, true
+}
+
+// IsPermanent reports whether a connection error will not be fixed by
+// retrying, such as the server rejecting our SASL credentials.
+func IsPermanent(err error) bool {
+	_, ok := err.(*SASLError)
+	return ok
+}
@@ -0,0 +1,66 @@
+package ircx
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectDelayIsCapped(t *testing.T) {
+	policy := ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 10 * time.Second}
+	expected := []time.Duration{1, 2, 4, 8, 10, 10}
+	for attempt, seconds := range expected {
+		if delay := policy.Delay(uint(attempt)); delay != seconds*time.Second {
+			t.Fatalf("Attempt %d: got %v, expected %ds", attempt, delay, seconds)
+		}
+	}
+	if delay := policy.Delay(100); delay != policy.MaxDelay {
+		t.Fatalf("Large attempts should not overflow: %v", delay)
+	}
+
+	policy.Jitter = time.Second
+	for i := 0; i < 10; i++ {
+		if delay := policy.Delay(0); delay < time.Second || delay > 2*time.Second {
+			t.Fatalf("Jitter out of range: %v", delay)
+		}
+	}
+}
+
+func TestBackoffGivesUp(t *testing.T) {
+	b := NewBackoff(ReconnectPolicy{
+		InitialDelay: time.Millisecond,
+		MaxDelay:     time.Second,
+		MaxAttempts:  3,
+		StableAfter:  time.Hour,
+	})
+	for i := 0; i < 3; i++ {
+		if _, ok := b.Next(); !ok {
+			t.Fatalf("Gave up after %d attempts", i)
+		}
+	}
+	if _, ok := b.Next(); ok {
+		t.Fatalf("Expected to give up after 3 attempts")
+	}
+}
+
+func TestBackoffResetsAfterStableConnection(t *testing.T) {
+	b := NewBackoff(ReconnectPolicy{
+		InitialDelay: time.Millisecond,
+		MaxDelay:     time.Second,
+		MaxAttempts:  2,
+		StableAfter:  10 * time.Millisecond,
+	})
+	b.Next()
+	b.Next()
+	b.Connected()
+
+	// An unstable connection doesn't reset the count
+	if _, ok := b.Next(); ok {
+		t.Fatalf("Expected to give up after an unstable connection")
+	}
+
+	b.Connected()
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := b.Next(); !ok || b.Attempts() != 1 {
+		t.Fatalf("Expected attempts to reset after a stable connection")
+	}
+}
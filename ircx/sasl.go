@@ -0,0 +1,374 @@
+package ircx
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// Commands and numerics used by SASL authentication, see
+// https://ircv3.net/specs/extensions/sasl-3.1
+const (
+	AUTHENTICATE = "AUTHENTICATE"
+
+	RPL_LOGGEDIN    = "900"
+	RPL_LOGGEDOUT   = "901"
+	ERR_NICKLOCKED  = "902"
+	RPL_SASLSUCCESS = "903"
+	ERR_SASLFAIL    = "904"
+	ERR_SASLTOOLONG = "905"
+	ERR_SASLABORTED = "906"
+	ERR_SASLALREADY = "907"
+	RPL_SASLMECHS   = "908"
+)
+
+// Payloads sent with AUTHENTICATE are base64 encoded and split into chunks
+// of at most this many bytes.
+const saslChunkSize = 400
+
+var (
+	unknownMechanismError = fmt.Errorf("Unknown SASL mechanism")
+	scramNonceError       = fmt.Errorf("SCRAM server nonce does not extend client nonce")
+	scramSignatureError   = fmt.Errorf("SCRAM server signature does not match")
+	scramMessageError     = fmt.Errorf("Malformed SCRAM server message")
+)
+
+// MessageWriter is satisfied by the message writers of both proxies
+type MessageWriter interface {
+	WriteMessage(*Message) error
+}
+
+// SASLConfig contains the credentials used to authenticate with services
+// during registration. The zero value disables SASL.
+type SASLConfig struct {
+	Mechanism string // PLAIN, EXTERNAL or SCRAM-SHA-256
+	Username  string // the account name to authenticate as
+	Password  string // the account password (unused by EXTERNAL)
+}
+
+func (c SASLConfig) Enabled() bool {
+	return c.Mechanism != ""
+}
+
+// Valid reports whether the configuration names a supported mechanism and
+// includes the credentials that mechanism requires.
+func (c SASLConfig) Valid() bool {
+	switch strings.ToUpper(c.Mechanism) {
+	case "":
+		return true
+	case "EXTERNAL":
+		return true
+	case "PLAIN", "SCRAM-SHA-256":
+		return c.Username != "" && c.Password != ""
+	}
+	return false
+}
+
+// SASLError is returned from registration when the server rejects or aborts
+// authentication. Code is the numeric that ended the exchange, CAP if the
+// server refused the sasl capability, or RPL_WELCOME if the server does not
+// support capability negotiation at all.
+type SASLError struct {
+	Mechanism  string
+	Code       string
+	Reason     string
+	Mechanisms []string // mechanisms the server offered, if it told us
+}
+
+func (e *SASLError) Error() string {
+	msg := fmt.Sprintf("SASL %s authentication failed (%s): %s",
+		e.Mechanism, e.Code, e.Reason)
+	if len(e.Mechanisms) > 0 {
+		msg += fmt.Sprintf(" [server supports %s]", strings.Join(e.Mechanisms, ","))
+	}
+	return msg
+}
+
+// saslMechanism implements the client side of a single SASL mechanism. Next
+// is given each decoded server challenge and returns the response to send.
+type saslMechanism interface {
+	Name() string
+	Next(challenge []byte) ([]byte, error)
+}
+
+// SASL drives an authentication exchange during registration. It is run by
+// Capabilities once the server has acknowledged the sasl capability.
+type SASL struct {
+	mechanism  saslMechanism
+	pending    string   // base64 challenge chunks that have not been decoded yet
+	mechanisms []string // from RPL_SASLMECHS
+	Account    string   // the account we are logged in as, from RPL_LOGGEDIN
+	Done       bool     // whether or not authentication has succeeded
+}
+
+func NewSASL(config SASLConfig) (*SASL, error) {
+	var mechanism saslMechanism
+	switch strings.ToUpper(config.Mechanism) {
+	case "PLAIN":
+		mechanism = &plainMechanism{config.Username, config.Password}
+	case "EXTERNAL":
+		mechanism = &externalMechanism{}
+	case "SCRAM-SHA-256":
+		nonce, err := scramNonce()
+		if err != nil {
+			return nil, err
+		}
+		mechanism = &scramMechanism{
+			username: config.Username,
+			password: config.Password,
+			nonce:    nonce,
+		}
+	default:
+		return nil, unknownMechanismError
+	}
+	return &SASL{mechanism: mechanism}, nil
+}
+
+// Start begins the exchange once the sasl capability has been enabled
+func (s *SASL) Start(w MessageWriter) error {
+	return w.WriteMessage(Wrap(&irc.Message{
+		Command: AUTHENTICATE,
+		Params:  []string{s.mechanism.Name()},
+	}))
+}
+
+// Handle processes a message received during registration, writing any
+// replies. It reports whether the message was part of the SASL exchange, and
+// returns a *SASLError if the server rejected authentication. CAP messages
+// are handled by Capabilities, which calls Start once sasl is enabled.
+func (s *SASL) Handle(msg *Message, w MessageWriter) (bool, error) {
+	switch msg.Command {
+	case AUTHENTICATE:
+		return true, s.respond(msg, w)
+
+	case RPL_LOGGEDIN:
+		if len(msg.Params) >= 3 {
+			s.Account = msg.Params[2]
+		}
+		return true, nil
+
+	case RPL_SASLMECHS:
+		if len(msg.Params) >= 2 {
+			s.mechanisms = strings.Split(msg.Params[1], ",")
+		}
+		return true, nil
+
+	case RPL_SASLSUCCESS, ERR_SASLALREADY:
+		s.Done = true
+		return true, w.WriteMessage(Wrap(&irc.Message{Command: CAP, Params: []string{"END"}}))
+
+	case ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED, ERR_NICKLOCKED:
+		return true, s.failure(msg.Command, msg.Trailing)
+	}
+	return false, nil
+}
+
+func (s *SASL) failure(code, reason string) error {
+	return &SASLError{
+		Mechanism:  s.mechanism.Name(),
+		Code:       code,
+		Reason:     reason,
+		Mechanisms: s.mechanisms,
+	}
+}
+
+// respond handles a (possibly partial) challenge from the server
+func (s *SASL) respond(msg *Message, w MessageWriter) error {
+	chunk := msg.Trailing
+	if len(msg.Params) > 0 {
+		chunk = msg.Params[0]
+	}
+
+	// A full-size chunk means more is coming
+	if chunk != "+" {
+		s.pending += chunk
+	}
+	if len(chunk) == saslChunkSize {
+		return nil
+	}
+
+	challenge, err := base64.StdEncoding.DecodeString(s.pending)
+	s.pending = ""
+	if err != nil {
+		w.WriteMessage(Wrap(&irc.Message{Command: AUTHENTICATE, Params: []string{"*"}}))
+		return s.failure(AUTHENTICATE, err.Error())
+	}
+
+	response, err := s.mechanism.Next(challenge)
+	if err != nil {
+		w.WriteMessage(Wrap(&irc.Message{Command: AUTHENTICATE, Params: []string{"*"}}))
+		return s.failure(AUTHENTICATE, err.Error())
+	}
+
+	for _, chunk := range splitResponse(response) {
+		err = w.WriteMessage(Wrap(&irc.Message{Command: AUTHENTICATE, Params: []string{chunk}}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitResponse encodes a response and splits it into AUTHENTICATE chunks. An
+// empty response, or one that is an exact multiple of the chunk size, is
+// terminated with a "+".
+func splitResponse(response []byte) []string {
+	encoded := base64.StdEncoding.EncodeToString(response)
+	var chunks []string
+	for len(encoded) >= saslChunkSize {
+		chunks = append(chunks, encoded[:saslChunkSize])
+		encoded = encoded[saslChunkSize:]
+	}
+	if encoded == "" {
+		encoded = "+"
+	}
+	return append(chunks, encoded)
+}
+
+// plainMechanism implements RFC 4616
+type plainMechanism struct {
+	username string
+	password string
+}
+
+func (m *plainMechanism) Name() string {
+	return "PLAIN"
+}
+
+func (m *plainMechanism) Next(challenge []byte) ([]byte, error) {
+	response := m.username + "\x00" + m.username + "\x00" + m.password
+	return []byte(response), nil
+}
+
+// externalMechanism relies on the TLS client certificate (CertFP)
+type externalMechanism struct{}
+
+func (m *externalMechanism) Name() string {
+	return "EXTERNAL"
+}
+
+func (m *externalMechanism) Next(challenge []byte) ([]byte, error) {
+	return nil, nil
+}
+
+// scramMechanism implements SCRAM-SHA-256 (RFC 7677) without channel binding
+type scramMechanism struct {
+	username string
+	password string
+	nonce    string
+
+	step            int
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func (m *scramMechanism) Name() string {
+	return "SCRAM-SHA-256"
+}
+
+func (m *scramMechanism) Next(challenge []byte) ([]byte, error) {
+	m.step++
+	switch m.step {
+	case 1:
+		name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(m.username)
+		m.clientFirstBare = "n=" + name + ",r=" + m.nonce
+		return []byte("n,," + m.clientFirstBare), nil
+	case 2:
+		return m.clientFinal(string(challenge))
+	case 3:
+		attrs := scramAttributes(string(challenge))
+		if e, ok := attrs["e"]; ok {
+			return nil, fmt.Errorf("SCRAM server error: %s", e)
+		}
+		signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+		if err != nil || !hmac.Equal(signature, m.serverSignature) {
+			return nil, scramSignatureError
+		}
+		return nil, nil
+	}
+	return nil, scramMessageError
+}
+
+func (m *scramMechanism) clientFinal(serverFirst string) ([]byte, error) {
+	attrs := scramAttributes(serverFirst)
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, m.nonce) || len(nonce) == len(m.nonce) {
+		return nil, scramNonceError
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, scramMessageError
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return nil, scramMessageError
+	}
+
+	salted := pbkdf2SHA256([]byte(m.password), salt, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSHA256(salted, []byte("Server Key"))
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + nonce
+	authMessage := []byte(m.clientFirstBare + "," + serverFirst + "," + withoutProof)
+
+	clientSignature := hmacSHA256(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	m.serverSignature = hmacSHA256(serverKey, authMessage)
+
+	final := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	return []byte(final), nil
+}
+
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(msg, ",") {
+		if len(field) >= 2 && field[1] == '=' {
+			attrs[field[:1]] = field[2:]
+		}
+	}
+	return attrs
+}
+
+func scramNonce() (string, error) {
+	b := make([]byte, 18)
+	_, err := crand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a single 32-byte block, which is all SCRAM-SHA-256
+// requires (RFC 2898, section 5.2)
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
@@ -0,0 +1,129 @@
+package ircx
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// captureWriter records messages that are written
+type captureWriter struct {
+	messages []*Message
+}
+
+func (w *captureWriter) WriteMessage(msg *Message) error {
+	w.messages = append(w.messages, msg)
+	return nil
+}
+
+func (w *captureWriter) Last() string {
+	if len(w.messages) == 0 {
+		return ""
+	}
+	return w.messages[len(w.messages)-1].String()
+}
+
+// Test vector from RFC 7677, section 3
+func TestSCRAMSHA256(t *testing.T) {
+	mech := &scramMechanism{
+		username: "user",
+		password: "pencil",
+		nonce:    "rOprNGfwEbeRWgbNEkqO",
+	}
+
+	first, _ := mech.Next(nil)
+	if string(first) != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Fatalf("Incorrect client-first message: %s", first)
+	}
+
+	serverFirst := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	final, err := mech.Next([]byte(serverFirst))
+	if err != nil {
+		t.Fatalf("Failed to compute client-final message: %s", err)
+	}
+	expected := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(final) != expected {
+		t.Fatalf("Incorrect client-final message: %s", final)
+	}
+
+	_, err = mech.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	if err != nil {
+		t.Fatalf("Failed to verify server signature: %s", err)
+	}
+}
+
+func TestSCRAMBadServerSignature(t *testing.T) {
+	mech := &scramMechanism{username: "user", password: "pencil", nonce: "abc"}
+	mech.Next(nil)
+	mech.Next([]byte("r=abcdef,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=1"))
+	if _, err := mech.Next([]byte("v=AAAA")); err != scramSignatureError {
+		t.Fatalf("Expected signature error, got %v", err)
+	}
+}
+
+func TestSASLPlainExchange(t *testing.T) {
+	sasl, err := NewSASL(SASLConfig{Mechanism: "plain", Username: "bot", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &captureWriter{}
+	sasl.Start(w)
+	if w.Last() != "AUTHENTICATE PLAIN" {
+		t.Fatalf("Incorrect start message: %s", w.Last())
+	}
+
+	steps := []struct {
+		line     string
+		expected string
+	}{
+		{"AUTHENTICATE +", "AUTHENTICATE " +
+			base64.StdEncoding.EncodeToString([]byte("bot\x00bot\x00secret"))},
+		{":server 900 * * bot :You are now logged in as bot", ""},
+		{":server 903 * :SASL authentication successful", "CAP END"},
+	}
+
+	for idx, step := range steps {
+		before := len(w.messages)
+		handled, err := sasl.Handle(ParseMessage(step.line), w)
+		if !handled || err != nil {
+			t.Fatalf("Step %d not handled: %v", idx, err)
+		}
+		if step.expected == "" && len(w.messages) != before {
+			t.Fatalf("Step %d sent unexpected message %s", idx, w.Last())
+		} else if step.expected != "" && w.Last() != step.expected {
+			t.Fatalf("Step %d sent %q, expected %q", idx, w.Last(), step.expected)
+		}
+	}
+
+	if !sasl.Done || sasl.Account != "bot" {
+		t.Fatalf("Authentication did not complete: %v %q", sasl.Done, sasl.Account)
+	}
+}
+
+func TestSASLFailure(t *testing.T) {
+	sasl, _ := NewSASL(SASLConfig{Mechanism: "PLAIN", Username: "bot", Password: "wrong"})
+	w := &captureWriter{}
+
+	sasl.Handle(ParseMessage(":server 908 bot PLAIN,EXTERNAL :are available SASL mechanisms"), w)
+	_, err := sasl.Handle(ParseMessage(":server 904 bot :SASL authentication failed"), w)
+	saslError, ok := err.(*SASLError)
+	if !ok {
+		t.Fatalf("Expected a *SASLError, got %v", err)
+	}
+	if saslError.Code != ERR_SASLFAIL || len(saslError.Mechanisms) != 2 {
+		t.Fatalf("Incorrect error details: %#v", saslError)
+	}
+}
+
+func TestSplitResponse(t *testing.T) {
+	if chunks := splitResponse(nil); len(chunks) != 1 || chunks[0] != "+" {
+		t.Fatalf("Empty response should be sent as +, got %v", chunks)
+	}
+
+	// 300 bytes encodes to exactly 400 characters
+	chunks := splitResponse(make([]byte, 300))
+	if len(chunks) != 2 || len(chunks[0]) != saslChunkSize || chunks[1] != "+" {
+		t.Fatalf("Full-size response was not terminated: %v", chunks)
+	}
+}
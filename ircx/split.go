@@ -0,0 +1,225 @@
+package ircx
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sorcix/irc"
+)
+
+const (
+	BATCH = "BATCH"
+
+	// The maximum length of a line, including the CRLF
+	maxLineLength = 512
+
+	// Limits used to estimate our prefix before the server has told us our
+	// full hostmask
+	maxUserLength = 10
+	maxHostLength = 63
+
+	// MaxTargetLength is the longest target we will send text to. It is the
+	// RFC 1459 channel name limit, and leaves room for the text even with a
+	// long prefix.
+	MaxTargetLength = 200
+)
+
+// TextLimitError is returned when the prefix and target leave no room on the
+// line for any text
+var TextLimitError = fmt.Errorf("No room on the line for text")
+
+// PrefixLen returns the length of the prefix the server will add to messages
+// we send, given our nick and hostmask (nick!user@host) if it is known.
+func PrefixLen(nick, hostmask string) int {
+	if hostmask != "" {
+		return len(hostmask)
+	}
+	return len(nick) + 1 + maxUserLength + 1 + maxHostLength
+}
+
+// HostmaskFromWelcome extracts our nick!user@host from RPL_WELCOME, which
+// conventionally ends with it. It returns an empty string if it is missing.
+func HostmaskFromWelcome(msg *Message) string {
+	fields := strings.Fields(msg.Trailing)
+	if len(fields) == 0 {
+		return ""
+	}
+	last := fields[len(fields)-1]
+	if prefix := irc.ParsePrefix(last); prefix.IsHostmask() {
+		return prefix.String()
+	}
+	return ""
+}
+
+// MaxTextLength returns the number of bytes of text that fit in a single
+// command sent to target, once the server has added our prefix. It is less
+// than one if the target is too long for any text to fit.
+func MaxTextLength(command, target string, prefixLen int) int {
+	// ":prefix COMMAND target :text\r\n"
+	overhead := 1 + prefixLen + 1 + len(command) + 1 + len(target) + 2 + 2
+	return maxLineLength - overhead
+}
+
+// SplitText splits text into lines of at most max bytes. Embedded newlines
+// always start a new line, empty lines are dropped, and long lines are broken
+// after the last space that fits, or at the last rune boundary if there is
+// none. The second result reports, for each line, whether it continues the
+// previous line rather than starting a new one. It returns TextLimitError if
+// max is less than one.
+func SplitText(text string, max int) ([]string, []bool, error) {
+	if max < 1 {
+		return nil, nil, TextLimitError
+	}
+	var lines []string
+	var continued []bool
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.Replace(text, "\r", "\n", -1)
+
+	for _, line := range strings.Split(text, "\n") {
+		first := true
+		for line != "" {
+			end := len(line)
+			if end > max {
+				end = splitPoint(line, max)
+			}
+			lines = append(lines, line[:end])
+			continued = append(continued, !first)
+			line = line[end:]
+			first = false
+		}
+	}
+	return lines, continued, nil
+}
+
+// splitPoint finds where to break a line that is longer than max bytes. The
+// space is kept at the end of the first part, so that joining the parts
+// gives back the original line.
+func splitPoint(line string, max int) int {
+	if idx := strings.LastIndexByte(line[:max], ' '); idx > 0 {
+		return idx + 1
+	}
+	idx := max
+	for idx > 0 && !utf8.RuneStart(line[idx]) {
+		idx--
+	}
+	if idx == 0 {
+		// a single rune longer than the limit, send it anyway
+		_, size := utf8.DecodeRuneInString(line)
+		return size
+	}
+	return idx
+}
+
+// MultilineLimits returns the limits advertised with the draft/multiline
+// capability, and whether the capability (and batch, which it requires) is
+// enabled. See https://ircv3.net/specs/extensions/multiline
+func (c *Capabilities) MultilineLimits() (maxBytes, maxLines int, ok bool) {
+	if c == nil || !c.Enabled("draft/multiline") || !c.Enabled("batch") {
+		return 0, 0, false
+	}
+	for _, item := range strings.Split(c.Value("draft/multiline"), ",") {
+		name, value := splitCapability(item)
+		limit, _ := strconv.Atoi(value)
+		switch name {
+		case "max-bytes":
+			maxBytes = limit
+		case "max-lines":
+			maxLines = limit
+		}
+	}
+	return maxBytes, maxLines, maxBytes > 0
+}
+
+// TextMessages builds the PRIVMSG or NOTICE messages needed to send text to
+// target, splitting it to fit within the line length. If caps has
+// draft/multiline enabled, multi-line text is sent as one or more batches so
+// clients can reassemble it.
+func TextMessages(command, target, text string, prefixLen int, caps *Capabilities) ([]*Message, error) {
+	lines, continued, err := SplitText(text, MaxTextLength(command, target, prefixLen))
+	if err != nil {
+		return nil, err
+	}
+
+	maxBytes, maxLines, multiline := caps.MultilineLimits()
+	if !multiline || len(lines) < 2 {
+		messages := make([]*Message, len(lines))
+		for idx, line := range lines {
+			messages[idx] = Wrap(&irc.Message{
+				Command:  command,
+				Params:   []string{target},
+				Trailing: line,
+			})
+		}
+		return messages, nil
+	}
+
+	var messages []*Message
+	var batch string
+	bytes, count := 0, 0
+	for idx, line := range lines {
+		// Start a new batch if this line would exceed the limits
+		size := len(line)
+		if batch != "" && (bytes+size+1 > maxBytes || (maxLines > 0 && count == maxLines)) {
+			messages = append(messages, endBatch(batch))
+			batch = ""
+		}
+		if batch == "" {
+			batch = batchReference()
+			bytes, count = 0, 0
+			messages = append(messages, Wrap(&irc.Message{
+				Command: BATCH,
+				Params:  []string{"+" + batch, "draft/multiline", target},
+			}))
+		}
+
+		msg := Wrap(&irc.Message{Command: command, Params: []string{target}, Trailing: line})
+		msg.Tags = Tags{"batch": batch}
+		if continued[idx] && count > 0 {
+			msg.Tags["draft/multiline-concat"] = ""
+		}
+		messages = append(messages, msg)
+		bytes += size + 1
+		count++
+	}
+	return append(messages, endBatch(batch)), nil
+}
+
+// GroupBatches groups messages so that each batch, from its BATCH +reference
+// to its BATCH -reference, is one group and every other message is a group
+// of its own. Each group can be queued with SendQueue.WriteMessages so that
+// nothing else is sent inside a batch.
+func GroupBatches(msgs []*Message) [][]*Message {
+	var groups [][]*Message
+	open := ""
+	for _, msg := range msgs {
+		if open == "" {
+			groups = append(groups, nil)
+		}
+		last := len(groups) - 1
+		groups[last] = append(groups[last], msg)
+
+		if msg.Command != BATCH || len(msg.Params) == 0 {
+			continue
+		}
+		reference := msg.Params[0]
+		if open == "" && strings.HasPrefix(reference, "+") {
+			open = reference[1:]
+		} else if reference == "-"+open {
+			open = ""
+		}
+	}
+	return groups
+}
+
+func endBatch(reference string) *Message {
+	return Wrap(&irc.Message{Command: BATCH, Params: []string{"-" + reference}})
+}
+
+func batchReference() string {
+	b := make([]byte, 6)
+	crand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
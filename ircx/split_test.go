@@ -0,0 +1,113 @@
+package ircx
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitTextNewlines(t *testing.T) {
+	lines, continued, _ := SplitText("one\r\ntwo\n\nthree", 100)
+	if strings.Join(lines, "|") != "one|two|three" {
+		t.Fatalf("Incorrect lines: %q", lines)
+	}
+	for idx, c := range continued {
+		if c {
+			t.Fatalf("Line %d should not be a continuation", idx)
+		}
+	}
+}
+
+func TestSplitTextWords(t *testing.T) {
+	lines, continued, _ := SplitText("the quick brown fox jumps", 11)
+	if strings.Join(lines, "|") != "the quick |brown fox |jumps" {
+		t.Fatalf("Incorrect lines: %q", lines)
+	}
+	if continued[0] || !continued[1] || !continued[2] {
+		t.Fatalf("Incorrect continuations: %v", continued)
+	}
+}
+
+func TestSplitTextRunes(t *testing.T) {
+	text := strings.Repeat("é", 10) // two bytes each
+	lines, _, _ := SplitText(text, 5)
+	if strings.Join(lines, "") != text {
+		t.Fatalf("Text was not preserved: %q", lines)
+	}
+	for _, line := range lines {
+		if len(line) > 5 || !utf8.ValidString(line) {
+			t.Fatalf("Invalid line %q", line)
+		}
+	}
+}
+
+func TestTextMessagesFitLineLength(t *testing.T) {
+	prefixLen := PrefixLen("bot", "bot!~bot@example.com")
+	text := strings.Repeat("word ", 300)
+	messages, _ := TextMessages("PRIVMSG", "#channel", text, prefixLen, nil)
+	if len(messages) < 3 {
+		t.Fatalf("Expected text to be split, got %d messages", len(messages))
+	}
+	for _, msg := range messages {
+		relayed := ":bot!~bot@example.com " + msg.String() + "\r\n"
+		if len(relayed) > maxLineLength {
+			t.Fatalf("Message is too long when relayed: %d bytes", len(relayed))
+		}
+	}
+}
+
+func TestTextMessagesLongTarget(t *testing.T) {
+	prefixLen := PrefixLen("bot", "bot!~bot@example.com")
+	target := "#" + strings.Repeat("a", 500)
+	messages, err := TextMessages("PRIVMSG", target, "hello", prefixLen, nil)
+	if err != TextLimitError || messages != nil {
+		t.Fatalf("Expected TextLimitError, got %v %v", messages, err)
+	}
+	if _, _, err := SplitText("hello", 0); err != TextLimitError {
+		t.Fatalf("Expected TextLimitError for a zero limit, got %v", err)
+	}
+}
+
+func TestTextMessagesMultiline(t *testing.T) {
+	caps := NewCapabilities([]string{"batch", "draft/multiline"}, nil)
+	w := &captureWriter{}
+	caps.Begin(w)
+	handleLines(t, caps, w,
+		":server CAP * LS :batch draft/multiline=max-bytes=12,max-lines=2",
+		":server CAP * ACK :batch draft/multiline")
+
+	messages, _ := TextMessages("PRIVMSG", "#channel", "one\ntwo\nthree", 10, caps)
+	var commands []string
+	for _, msg := range messages {
+		commands = append(commands, msg.Command)
+	}
+	expected := "BATCH PRIVMSG PRIVMSG BATCH BATCH PRIVMSG BATCH"
+	if strings.Join(commands, " ") != expected {
+		t.Fatalf("Incorrect batches: %s", strings.Join(commands, " "))
+	}
+
+	reference := messages[0].Params[0][1:]
+	if messages[1].Tags["batch"] != reference || messages[3].Params[0] != "-"+reference {
+		t.Fatalf("Messages were not tagged with the batch: %v", messages)
+	}
+
+	// Each batch is queued as one group, and anything else on its own
+	var sizes []int
+	for _, group := range GroupBatches(append(messages, ParseMessage("PART #channel"))) {
+		sizes = append(sizes, len(group))
+	}
+	if len(sizes) != 3 || sizes[0] != 4 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Fatalf("Incorrect groups: %v", sizes)
+	}
+}
+
+func TestHostmaskFromWelcome(t *testing.T) {
+	msg := ParseMessage(":server 001 bot :Welcome to the Network bot!~bot@example.com")
+	if hostmask := HostmaskFromWelcome(msg); hostmask != "bot!~bot@example.com" {
+		t.Fatalf("Incorrect hostmask: %q", hostmask)
+	}
+	msg = ParseMessage(":server 001 bot :Welcome to the Network, bot")
+	if hostmask := HostmaskFromWelcome(msg); hostmask != "" {
+		t.Fatalf("Expected no hostmask, got %q", hostmask)
+	}
+}
@@ -0,0 +1,448 @@
+package ircx
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// Commands and numerics used for state tracking that are not provided by the
+// irc package
+const (
+	ACCOUNT          = "ACCOUNT"
+	CHGHOST          = "CHGHOST"
+	RPL_TOPICWHOTIME = "333"
+)
+
+// User is what we know about another user on the network
+type User struct {
+	Nick        string
+	User        string
+	Host        string
+	Account     string // the services account, if known and logged in
+	Away        bool
+	AwayMessage string
+}
+
+// Hostmask returns nick!user@host, or just the nick if we haven't seen the
+// rest yet.
+func (u User) Hostmask() string {
+	if u.User == "" || u.Host == "" {
+		return u.Nick
+	}
+	return u.Nick + "!" + u.User + "@" + u.Host
+}
+
+// Member is a user in a channel along with their membership prefixes (such as
+// "@+"), highest rank first.
+type Member struct {
+	Nick     string
+	Prefixes string
+}
+
+// ChannelInfo is a snapshot of a channel's state
+type ChannelInfo struct {
+	Name       string
+	Topic      string
+	TopicSetBy string
+	TopicSetAt time.Time
+	Modes      map[string]string // channel modes and their parameters, if any
+	Members    []Member          // sorted by rank, then nickname
+}
+
+type channelState struct {
+	name       string
+	topic      string
+	topicSetBy string
+	topicSetAt time.Time
+	modes      map[byte]string
+	members    map[string]*Member // keyed by folded nick
+	names      bool               // receiving RPL_NAMREPLY
+}
+
+// State tracks the channels we are in, their topic, modes and members, and
+// the users we share them with. It is fed every message received from the
+// server via Handle, and can be queried concurrently. Nicknames and channel
+// names are compared using the server's casemapping.
+type State struct {
+	nick     string
+	isupport *ISupport
+	channels map[string]*channelState // keyed by folded name
+	users    map[string]*User         // keyed by folded nick
+
+	sync.RWMutex
+}
+
+func NewState(nick string, isupport *ISupport) *State {
+	return &State{
+		nick:     nick,
+		isupport: isupport,
+		channels: make(map[string]*channelState),
+		users:    map[string]*User{isupport.Fold(nick): &User{Nick: nick}},
+	}
+}
+
+// Nick returns our current nickname
+func (s *State) Nick() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.nick
+}
+
+// Channels returns the names of the channels we are in, sorted
+func (s *State) Channels() []string {
+	s.RLock()
+	defer s.RUnlock()
+	names := make([]string, 0, len(s.channels))
+	for _, channel := range s.channels {
+		names = append(names, channel.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Channel returns a snapshot of a channel we are in
+func (s *State) Channel(name string) (ChannelInfo, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	channel, ok := s.channels[s.isupport.Fold(name)]
+	if !ok {
+		return ChannelInfo{}, false
+	}
+
+	info := ChannelInfo{
+		Name:       channel.name,
+		Topic:      channel.topic,
+		TopicSetBy: channel.topicSetBy,
+		TopicSetAt: channel.topicSetAt,
+		Modes:      make(map[string]string),
+	}
+	for mode, param := range channel.modes {
+		info.Modes[string(mode)] = param
+	}
+	for _, member := range channel.members {
+		info.Members = append(info.Members, *member)
+	}
+
+	_, symbols := s.isupport.Prefix()
+	rank := func(m Member) int {
+		if m.Prefixes == "" {
+			return len(symbols)
+		}
+		return strings.IndexByte(symbols, m.Prefixes[0])
+	}
+	sort.Slice(info.Members, func(i, j int) bool {
+		a, b := info.Members[i], info.Members[j]
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		return s.isupport.Fold(a.Nick) < s.isupport.Fold(b.Nick)
+	})
+	return info, true
+}
+
+// User returns what we know about a user we share a channel with
+func (s *State) User(nick string) (User, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	user, ok := s.users[s.isupport.Fold(nick)]
+	if !ok {
+		return User{}, false
+	}
+	return *user, true
+}
+
+// CommonChannels returns the names of the channels we share with a user,
+// sorted
+func (s *State) CommonChannels(nick string) []string {
+	s.RLock()
+	defer s.RUnlock()
+	folded := s.isupport.Fold(nick)
+	var names []string
+	for _, channel := range s.channels {
+		if _, ok := channel.members[folded]; ok {
+			names = append(names, channel.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handle updates the state from a message received from the server
+func (s *State) Handle(msg *Message) {
+	s.Lock()
+	defer s.Unlock()
+
+	// Any message from a user tells us their hostmask, and with account-tag
+	// their account
+	var user *User
+	if msg.Prefix != nil && msg.Prefix.IsHostmask() {
+		user = s.users[s.isupport.Fold(msg.Name)]
+		if user != nil {
+			user.User, user.Host = msg.Prefix.User, msg.Prefix.Host
+			if account, ok := msg.Tags["account"]; ok {
+				user.Account = account
+			}
+		}
+	}
+
+	switch msg.Command {
+	case irc.JOIN, irc.PART, irc.QUIT, irc.NICK, irc.TOPIC:
+		// These mean nothing without knowing who sent them
+		if msg.Prefix == nil {
+			return
+		}
+	}
+
+	switch msg.Command {
+	case irc.JOIN:
+		s.join(msg)
+	case irc.PART:
+		s.part(msg.Param(0), msg.Name)
+	case irc.KICK:
+		s.part(msg.Param(0), msg.Param(1))
+	case irc.QUIT:
+		s.quit(msg.Name)
+	case irc.NICK:
+		s.rename(msg.Name, msg.Param(0))
+	case irc.TOPIC:
+		if channel := s.channel(msg.Param(0)); channel != nil {
+			channel.topic = msg.Param(1)
+			channel.topicSetBy = msg.Prefix.String()
+			channel.topicSetAt = time.Now()
+		}
+	case irc.RPL_TOPIC:
+		if channel := s.channel(msg.Param(1)); channel != nil {
+			channel.topic = msg.Param(2)
+		}
+	case irc.RPL_NOTOPIC:
+		if channel := s.channel(msg.Param(1)); channel != nil {
+			channel.topic = ""
+		}
+	case RPL_TOPICWHOTIME:
+		if channel := s.channel(msg.Param(1)); channel != nil {
+			channel.topicSetBy = msg.Param(2)
+			if seconds, err := strconv.ParseInt(msg.Param(3), 10, 64); err == nil {
+				channel.topicSetAt = time.Unix(seconds, 0)
+			}
+		}
+	case irc.RPL_NAMREPLY:
+		s.names(msg)
+	case irc.RPL_ENDOFNAMES:
+		if channel := s.channel(msg.Param(1)); channel != nil {
+			channel.names = false
+		}
+	case irc.MODE, irc.RPL_CHANNELMODEIS:
+		s.mode(msg)
+	case irc.AWAY:
+		if user != nil {
+			user.AwayMessage = msg.Param(0)
+			user.Away = user.AwayMessage != ""
+		}
+	case irc.RPL_AWAY:
+		if away := s.users[s.isupport.Fold(msg.Param(1))]; away != nil {
+			away.Away, away.AwayMessage = true, msg.Param(2)
+		}
+	case irc.RPL_UNAWAY, irc.RPL_NOWAWAY:
+		if self := s.users[s.isupport.Fold(s.nick)]; self != nil {
+			self.Away = msg.Command == irc.RPL_NOWAWAY
+		}
+	case ACCOUNT:
+		if user != nil {
+			user.Account = msg.Param(0)
+		}
+	case CHGHOST:
+		if user != nil {
+			user.User, user.Host = msg.Param(0), msg.Param(1)
+		}
+	}
+
+	if user != nil && user.Account == "*" {
+		user.Account = ""
+	}
+}
+
+func (s *State) channel(name string) *channelState {
+	return s.channels[s.isupport.Fold(name)]
+}
+
+// user returns the user with the given nick, creating them if necessary
+func (s *State) user(nick string) *User {
+	folded := s.isupport.Fold(nick)
+	user, ok := s.users[folded]
+	if !ok {
+		user = &User{Nick: nick}
+		s.users[folded] = user
+	}
+	return user
+}
+
+func (s *State) isSelf(nick string) bool {
+	return s.isupport.Fold(nick) == s.isupport.Fold(s.nick)
+}
+
+func (s *State) join(msg *Message) {
+	name := msg.Param(0)
+	folded := s.isupport.Fold(name)
+	if s.isSelf(msg.Name) {
+		s.channels[folded] = &channelState{
+			name:    name,
+			modes:   make(map[byte]string),
+			members: make(map[string]*Member),
+		}
+	}
+	channel := s.channels[folded]
+	if channel == nil {
+		return
+	}
+
+	user := s.user(msg.Name)
+	user.User, user.Host = msg.Prefix.User, msg.Prefix.Host
+	// extended-join adds the account and realname
+	if len(msg.Params) > 1 && msg.Params[1] != "*" {
+		user.Account = msg.Params[1]
+	}
+	channel.members[s.isupport.Fold(msg.Name)] = &Member{Nick: msg.Name}
+}
+
+func (s *State) part(name, nick string) {
+	folded := s.isupport.Fold(name)
+	channel := s.channels[folded]
+	if channel == nil {
+		return
+	}
+	if s.isSelf(nick) {
+		delete(s.channels, folded)
+		for member := range channel.members {
+			s.forget(member)
+		}
+		return
+	}
+	delete(channel.members, s.isupport.Fold(nick))
+	s.forget(s.isupport.Fold(nick))
+}
+
+func (s *State) quit(nick string) {
+	folded := s.isupport.Fold(nick)
+	for _, channel := range s.channels {
+		delete(channel.members, folded)
+	}
+	s.forget(folded)
+}
+
+// forget removes a user once we no longer share any channels with them
+func (s *State) forget(folded string) {
+	if folded == s.isupport.Fold(s.nick) {
+		return
+	}
+	for _, channel := range s.channels {
+		if _, ok := channel.members[folded]; ok {
+			return
+		}
+	}
+	delete(s.users, folded)
+}
+
+func (s *State) rename(from, to string) {
+	if to == "" {
+		return
+	}
+	oldFolded, newFolded := s.isupport.Fold(from), s.isupport.Fold(to)
+	if s.isSelf(from) {
+		s.nick = to
+	}
+	if user, ok := s.users[oldFolded]; ok {
+		delete(s.users, oldFolded)
+		user.Nick = to
+		s.users[newFolded] = user
+	}
+	for _, channel := range s.channels {
+		if member, ok := channel.members[oldFolded]; ok {
+			delete(channel.members, oldFolded)
+			member.Nick = to
+			channel.members[newFolded] = member
+		}
+	}
+}
+
+// names handles RPL_NAMREPLY, "<nick> <type> <channel> :[prefixes]nick ...",
+// with support for multi-prefix and userhost-in-names.
+func (s *State) names(msg *Message) {
+	channel := s.channel(msg.Param(2))
+	if channel == nil {
+		return
+	}
+	if !channel.names {
+		// A new listing replaces whatever we had
+		channel.names = true
+		channel.members = make(map[string]*Member)
+	}
+
+	_, symbols := s.isupport.Prefix()
+	for _, item := range strings.Fields(msg.Param(3)) {
+		idx := 0
+		for idx < len(item) && strings.IndexByte(symbols, item[idx]) >= 0 {
+			idx++
+		}
+		prefix := irc.ParsePrefix(item[idx:])
+		user := s.user(prefix.Name)
+		if prefix.IsHostmask() {
+			user.User, user.Host = prefix.User, prefix.Host
+		}
+		channel.members[s.isupport.Fold(prefix.Name)] = &Member{
+			Nick:     prefix.Name,
+			Prefixes: item[:idx],
+		}
+	}
+}
+
+func (s *State) mode(msg *Message) {
+	target := msg.Param(0)
+	if msg.Command == irc.RPL_CHANNELMODEIS {
+		target = msg.Param(1)
+	}
+	channel := s.channel(target)
+	if channel == nil {
+		return
+	}
+
+	groups := s.isupport.ChanModes()
+	modes, symbols := s.isupport.Prefix()
+	for _, change := range ParseModes(msg, s.isupport) {
+		if idx := strings.IndexByte(modes, change.Mode); idx >= 0 {
+			member := channel.members[s.isupport.Fold(change.Param)]
+			if member != nil {
+				member.Prefixes = updatePrefixes(member.Prefixes, symbols[idx], change.Add, symbols)
+			}
+			continue
+		}
+		if strings.IndexByte(groups[0], change.Mode) >= 0 {
+			// list modes such as bans aren't tracked
+			continue
+		}
+		if change.Add {
+			channel.modes[change.Mode] = change.Param
+		} else {
+			delete(channel.modes, change.Mode)
+		}
+	}
+}
+
+// updatePrefixes adds or removes a prefix symbol, keeping them in rank order
+func updatePrefixes(prefixes string, symbol byte, add bool, symbols string) string {
+	var result []byte
+	for idx := 0; idx < len(symbols); idx++ {
+		has := strings.IndexByte(prefixes, symbols[idx]) >= 0
+		if symbols[idx] == symbol {
+			has = add
+		}
+		if has {
+			result = append(result, symbols[idx])
+		}
+	}
+	return string(result)
+}
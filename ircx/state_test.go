@@ -0,0 +1,142 @@
+package ircx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestState(t *testing.T, lines ...string) *State {
+	isupport := NewISupport()
+	isupport.Handle(ParseMessage(":server 005 bot PREFIX=(ov)@+ CHANMODES=b,k,l,imnt :are supported"))
+	state := NewState("bot", isupport)
+	for _, line := range lines {
+		msg := ParseMessage(line)
+		if msg == nil {
+			t.Fatalf("Invalid test line %q", line)
+		}
+		state.Handle(msg)
+	}
+	return state
+}
+
+func TestStateChannelMembers(t *testing.T) {
+	state := newTestState(t,
+		":bot!~bot@host JOIN #Wallops",
+		":server 353 bot = #wallops :bot @Alice +bob!~b@bob.host",
+		":server 366 bot #wallops :End of /NAMES list.",
+		":server 332 bot #wallops :Welcome to wallops",
+		":server 333 bot #wallops alice!~a@host 1400000000",
+		":server 324 bot #wallops +ntl 10",
+		":carol!~c@carol.host JOIN #wallops",
+		":alice!~a@host MODE #wallops +v-o+k carol alice secret",
+		":bob!~b@bob.host NICK :Robert",
+	)
+
+	info, ok := state.Channel("#WALLOPS")
+	if !ok {
+		t.Fatalf("Channel lookup should ignore case")
+	}
+	if info.Topic != "Welcome to wallops" || info.TopicSetBy != "alice!~a@host" {
+		t.Fatalf("Incorrect topic: %+v", info)
+	}
+	expectedModes := map[string]string{"n": "", "t": "", "l": "10", "k": "secret"}
+	if !reflect.DeepEqual(info.Modes, expectedModes) {
+		t.Fatalf("Incorrect modes: %v", info.Modes)
+	}
+	expectedMembers := []Member{
+		{"carol", "+"}, {"Robert", "+"}, {"Alice", ""}, {"bot", ""},
+	}
+	if !reflect.DeepEqual(info.Members, expectedMembers) {
+		t.Fatalf("Incorrect members: %v", info.Members)
+	}
+
+	user, ok := state.User("robert")
+	if !ok || user.Hostmask() != "Robert!~b@bob.host" {
+		t.Fatalf("Incorrect user after nick change: %+v", user)
+	}
+}
+
+func TestStateUsersLeave(t *testing.T) {
+	state := newTestState(t,
+		":bot!~bot@host JOIN #a",
+		":bot!~bot@host JOIN #b",
+		":alice!~a@host JOIN #a",
+		":alice!~a@host JOIN #b",
+		":bob!~b@host JOIN #a",
+		":alice!~a@host PART #a",
+		":bob!~b@host QUIT :bye",
+	)
+	if _, ok := state.User("bob"); ok {
+		t.Fatalf("User should be forgotten after quitting")
+	}
+	if _, ok := state.User("alice"); !ok {
+		t.Fatalf("User still shares a channel and should be known")
+	}
+
+	state.Handle(ParseMessage(":op!~op@host KICK #b bot :bye"))
+	if channels := state.Channels(); len(channels) != 1 || channels[0] != "#a" {
+		t.Fatalf("Incorrect channels after kick: %v", channels)
+	}
+	if _, ok := state.User("alice"); ok {
+		t.Fatalf("User should be forgotten once we leave their channels")
+	}
+}
+
+func TestStateWithoutPrefix(t *testing.T) {
+	state := newTestState(t,
+		":bot!~bot@host JOIN #a",
+		"JOIN #a",
+		"PART #a",
+		"QUIT :bye",
+		"NICK :someone",
+		"TOPIC #a :no setter",
+	)
+	if channels := state.Channels(); len(channels) != 1 || channels[0] != "#a" {
+		t.Fatalf("Incorrect channels: %v", channels)
+	}
+	if info, _ := state.Channel("#a"); info.Topic != "" {
+		t.Fatalf("Topic without a setter should be ignored: %q", info.Topic)
+	}
+}
+
+func TestStateAccountAndAway(t *testing.T) {
+	state := newTestState(t,
+		":bot!~bot@host JOIN #a",
+		":alice!~a@host JOIN #a alice_acct :Alice",
+		":alice!~a@host AWAY :gone fishing",
+		"@account=alice2 :alice!~a@newhost PRIVMSG #a :hi",
+	)
+	user, _ := state.User("alice")
+	if !user.Away || user.AwayMessage != "gone fishing" {
+		t.Fatalf("Away status not recorded: %+v", user)
+	}
+	if user.Account != "alice2" || user.Host != "newhost" {
+		t.Fatalf("Account tag or hostmask not recorded: %+v", user)
+	}
+
+	state.Handle(ParseMessage(":alice!~a@newhost ACCOUNT *"))
+	state.Handle(ParseMessage(":alice!~a@newhost AWAY"))
+	user, _ = state.User("alice")
+	if user.Away || user.Account != "" {
+		t.Fatalf("Logout or return not recorded: %+v", user)
+	}
+}
+
+func TestStateCommonChannels(t *testing.T) {
+	state := newTestState(t,
+		":bot!~bot@host JOIN #wallops",
+		":bot!~bot@host JOIN #go",
+		":bot!~bot@host JOIN #empty",
+		":server 353 bot = #wallops :bot @Alice",
+		":server 353 bot = #go :bot alice bob",
+	)
+	if got := state.CommonChannels("ALICE"); !reflect.DeepEqual(got, []string{"#go", "#wallops"}) {
+		t.Errorf("Alice shares %v", got)
+	}
+	if got := state.CommonChannels("bot"); len(got) != 3 {
+		t.Errorf("We are in %v", got)
+	}
+	if got := state.CommonChannels("carol"); len(got) != 0 {
+		t.Errorf("Carol shares %v", got)
+	}
+}
@@ -7,46 +7,93 @@ import (
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/jnwhiteh/wallops/chatlog"
+	"github.com/jnwhiteh/wallops/config"
+	"github.com/jnwhiteh/wallops/history"
+	"github.com/jnwhiteh/wallops/ircx"
 	"github.com/sorcix/irc"
 )
 
-const proxyTimeout = time.Second * 30
-const pongTimeout = time.Second * 15
-const missedDeadlineLimit = 5
+// live holds the settings that can be changed by reloading the configuration
+var live = config.NewLive(DefaultFileConfig().Timeouts, config.Debug)
 
 type ProxyConfig struct {
-	host     string
-	port     int
-	password string
-	nick     string
-	realName string
+	host      string
+	port      int
+	password  string
+	nick      string
+	realName  string
+	tls       ircx.TLSConfig       // how to secure the connection, if at all
+	sasl      ircx.SASLConfig      // credentials for authenticating with services
+	caps      []string             // capabilities to request (defaults if empty)
+	flood     ircx.FloodConfig     // rate limits for outgoing messages
+	channels  []ircx.Channel       // channels to join once connected
+	reconnect ircx.ReconnectPolicy // how to retry when the connection drops
+	console   bufferConfig         // how received messages are buffered for the console
+	clients   bufferConfig         // how they are buffered for each IRC client
+	backlog   ircx.BacklogLimits   // how much text is kept for clients to catch up on
+	chatlog   chatlog.Options      // where to log conversations, if anywhere
 }
 
-func Connect(config ProxyConfig) (*Proxy, error) {
-	var proxy *Proxy
+// bufferConfig controls a subscriber to the messages we receive
+type bufferConfig struct {
+	size     int                 // messages buffered for the subscriber
+	overflow ircx.OverflowPolicy // what to do when the buffer is full
+}
 
-	// Make a network connection
-	endpoint := fmt.Sprintf("%s:%d", config.host, config.port)
-	conn, err := net.Dial("tcp", endpoint)
+// Connect connects and registers with the server. The features the server
+// advertised on a previous connection, if any, are used until it advertises
+// them again.
+func Connect(config ProxyConfig, previous *ircx.ISupport) (proxy *Proxy, err error) {
+	// Make a network connection, using TLS if configured
+	endpoint := net.JoinHostPort(config.host, strconv.Itoa(config.port))
+	timeout := live.Timeouts().Proxy
+	conn, err := ircx.Dial(config.host, config.port, config.tls, timeout)
 	if err != nil {
 		return proxy, err
 	}
 
+	// Registration can fail in many places, none of which should leak the
+	// connection
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
 	// Set a reasonable read deadline for the "connection"
-	conn.SetDeadline(time.Now().Add(proxyTimeout))
+	conn.SetDeadline(time.Now().Add(timeout))
 
 	// Create IRC protocol encoder/decoders
-	encoder := irc.NewEncoder(conn)
-	decoder := irc.NewDecoder(bufio.NewReader(conn))
+	encoder := ircx.NewEncoder(conn)
+	decoder := ircx.NewDecoder(conn)
 	reader := &safeReader{decoder}
 	writer := &writer{encoder}
 
+	// Negotiate capabilities (and authenticate, if configured) before
+	// registering, so the server holds registration until we send CAP END
+	var sasl *ircx.SASL
+	if config.sasl.Enabled() {
+		sasl, err = ircx.NewSASL(config.sasl)
+		if err != nil {
+			return proxy, err
+		}
+	}
+	caps := ircx.NewCapabilities(config.caps, sasl)
+	err = caps.Begin(writer)
+	if err != nil {
+		return proxy, err
+	}
+
 	// Send PASS (server password)
 	if config.password != "" {
 		msg := &irc.Message{Command: irc.PASS, Params: []string{config.password}}
-		err = send(encoder, msg)
+		err = writer.WriteMessage(ircx.Wrap(msg))
 		if err != nil {
 			return proxy, err
 		}
@@ -54,7 +101,7 @@ func Connect(config ProxyConfig) (*Proxy, error) {
 
 	// Send NICK (nickname)
 	msg := &irc.Message{Command: irc.NICK, Params: []string{config.nick}}
-	err = send(encoder, msg)
+	err = writer.WriteMessage(ircx.Wrap(msg))
 	if err != nil {
 		return proxy, err
 	}
@@ -64,25 +111,43 @@ func Connect(config ProxyConfig) (*Proxy, error) {
 		Command: irc.USER,
 		Params:  []string{config.nick, "host", "server", config.realName},
 	}
-	err = send(encoder, msg)
+	err = writer.WriteMessage(ircx.Wrap(msg))
 	if err != nil {
 		return proxy, err
 	}
 
 	// Wait for the welcome message and handle nickname in-use responses
 	currentNick := config.nick
+	hostmask := ""
+	isupport := ircx.NewISupport()
+
+	// RPL_ISUPPORT only arrives after RPL_WELCOME, so until then assume the
+	// server allows the nick length it did when we were last connected
+	nickLen := ircx.DefaultNickLen
+	if previous != nil {
+		nickLen = previous.NickLen()
+	}
 
 	for {
-		msg, err := safeDecode(decoder)
+		msg, err := reader.ReadMessage()
 		if err != nil {
 			return proxy, err
 		}
+		received(msg)
+		handled, err := caps.Handle(msg, writer)
+		if err != nil {
+			return proxy, err
+		}
+		if handled {
+			continue
+		}
 		if msg.Command == irc.RPL_WELCOME {
+			hostmask = ircx.HostmaskFromWelcome(msg)
 			break
 		} else if msg.Command == irc.ERR_NICKNAMEINUSE {
-			currentNick = randomNick(config.nick)
+			currentNick = randomNick(config.nick, nickLen)
 			msg := &irc.Message{Command: irc.NICK, Params: []string{currentNick}}
-			err = send(encoder, msg)
+			err = writer.WriteMessage(ircx.Wrap(msg))
 			if err != nil {
 				return proxy, err
 			}
@@ -91,42 +156,146 @@ func Connect(config ProxyConfig) (*Proxy, error) {
 				Command: irc.PONG,
 				Params:  []string{fmt.Sprintf(":%s", msg.Trailing)},
 			}
-			send(encoder, pong)
+			writer.WriteMessage(ircx.Wrap(pong))
+		}
+	}
+
+	// Wait for the rest of the registration burst, recording the features
+	// the server supports from RPL_ISUPPORT
+	for {
+		msg, err := reader.ReadMessage()
+		if err != nil {
+			return proxy, err
+		}
+		received(msg)
+		if isupport.Handle(msg) {
+			continue
+		}
+		if msg.Command == irc.RPL_ENDOFMOTD || msg.Command == irc.ERR_NOMOTD {
+			break
+		} else if msg.Command == irc.PING {
+			pong := &irc.Message{
+				Command: irc.PONG,
+				Params:  []string{fmt.Sprintf(":%s", msg.Trailing)},
+			}
+			writer.WriteMessage(ircx.Wrap(pong))
+		}
+	}
+	if !isupport.ValidNick(currentNick) {
+		log.Printf("%sNickname %s is not valid on this network%s", colorWarning,
+			currentNick, colorReset)
+		if utf8.RuneCountInString(currentNick) > isupport.NickLen() {
+			// Most likely a fallback picked before we knew NICKLEN. The
+			// state follows the server's reply once we are running.
+			msg := &irc.Message{Command: irc.NICK, Params: []string{randomNick(config.nick, isupport.NickLen())}}
+			err = writer.WriteMessage(ircx.Wrap(msg))
+			if err != nil {
+				return proxy, err
+			}
 		}
 	}
 
 	// Build a new proxy object
-	proxy = &Proxy{config, endpoint, currentNick, conn, reader, writer}
+	proxy = &Proxy{
+		config:      config,
+		addr:        endpoint,
+		currentNick: currentNick,
+		hostmask:    hostmask,
+		caps:        caps,
+		isupport:    isupport,
+		channels:    ircx.NewChannelSet(config.channels),
+		state:       ircx.NewState(currentNick, isupport),
+		conn:        conn,
+		reader:      reader,
+		writer:      writer,
+		backlog:     ircx.NewBacklog(config.backlog),
+		clients:     make(map[*client]*ircx.Subscription),
+		attach:      make(chan *client),
+		detach:      make(chan *client),
+		fromClients: make(chan clientMessage),
+		fromConsole: make(chan *ircx.Message),
+	}
 	return proxy, err
 }
 
-// Creates a new proxy object, "reconnects" and transfers everything to the
-// existing proxy object.
-func (p *Proxy) Reconnect() error {
-	newProxy, err := Connect(p.config)
-	if err != nil {
-		return err
-	}
-
+// adopt transfers the connection and state of a newly connected proxy
+// object to the existing one. It is called from the run loop.
+func (p *Proxy) adopt(newProxy *Proxy) {
+	previousNick := p.currentNick
+	p.currentNick = newProxy.currentNick
+	p.hostmask = newProxy.hostmask
+	p.caps = newProxy.caps
+	p.isupport = newProxy.isupport
+	p.state = newProxy.state
+
+	// The send queue writes from its own goroutine
+	p.Lock()
 	p.conn = newProxy.conn
 	p.reader = newProxy.reader
 	p.writer = newProxy.writer
-	return nil
+	p.Unlock()
+
+	if p.currentNick != previousNick {
+		p.nickChanged(previousNick)
+	}
+
+	// Rejoin the channels we were in before the connection dropped
+	p.JoinChannels()
+}
+
+// reconnectResult is the outcome of reconnecting: either a newly connected
+// proxy object, or why we gave up
+type reconnectResult struct {
+	proxy *Proxy
+	err   error
 }
 
 // Proxy contains the current state of the proxy server
 type Proxy struct {
 	config ProxyConfig // the configuration of the proxy server
 
-	addr        string // the address of the server the proxy is connected to
-	currentNick string // the current nickname
+	addr        string             // the address of the server the proxy is connected to
+	currentNick string             // the current nickname
+	hostmask    string             // our nick!user@host, if the server told us
+	caps        *ircx.Capabilities // the capabilities enabled by the server
+	isupport    *ircx.ISupport     // the features advertised by the server
+	channels    *ircx.ChannelSet   // the channels we are in (or joining)
+	state       *ircx.State        // channel membership and user state
 
-	conn   net.Conn // the underlying network connection
+	conn   net.Conn // the underlying network connection (TCP or TLS)
 	reader messageReader
 	writer messageWriter
+	queue  *ircx.SendQueue // rate limits messages sent to the writer
+
+	backoff *ircx.Backoff // tracks reconnect attempts
+
+	// Broadcasts the messages we receive to the console and IRC clients
+	hub *ircx.Hub
+
+	// Keeps text for IRC clients to catch up on when they attach
+	backlog *ircx.Backlog
+
+	// Writes conversations to disk, if configured
+	chatlog *chatlog.Logger
+
+	// Keeps conversations to search, if configured
+	history *history.Index
+
+	// IRC clients attached to the proxy, only touched by the run loop
+	clients     map[*client]*ircx.Subscription
+	attach      chan *client       // clients that have registered
+	detach      chan *client       // clients that have gone away
+	fromClients chan clientMessage // messages to relay upstream
+	fromConsole chan *ircx.Message // messages typed at the console
+
+	// Guards the connection, which the send queue writes to while the run
+	// loop replaces it on reconnect
+	sync.RWMutex
 }
 
-func (p *Proxy) Run() {
+// Run relays messages until the connection drops and the reconnect policy
+// gives up, at which point the proxy is dead and the reason is returned.
+func (p *Proxy) Run() error {
 	// At this point we want to be able to relay messages
 	//
 	// The deadline for a write should be 30 seconds. When a write fails to
@@ -137,15 +306,57 @@ func (p *Proxy) Run() {
 	// between the server and the client. When the timeout has triggered a
 	// certain number of times, we should initiate a PING to the server.
 
-	incoming := make(chan *irc.Message, 10)
+	// Everything sent from here on is rate limited, and keeps its place in
+	// the queue across reconnects
+	p.queue = ircx.NewSendQueue(ircx.WriterFunc(p.writeNow), p.config.flood)
+	p.backoff = ircx.NewBackoff(p.config.reconnect)
+	if p.config.chatlog.Dir != "" {
+		p.chatlog = chatlog.New(p.network(), p.config.chatlog)
+		defer p.chatlog.Close()
+	}
+	p.JoinChannels()
+
+	// Messages are processed here, in the order they arrive, and then
+	// broadcast to everyone else who wants them. The hub only holds us up
+	// for subscribers whose overflow policy is to block.
+	p.hub = ircx.NewHub()
+	defer p.hub.Close()
+	console := p.hub.Subscribe(p.config.console.size, p.config.console.overflow, nil)
+	go PrintToConsole(console)
+
+	incoming := make(chan *ircx.Message, 10)
 	failure := make(chan error)
+	reconnected := make(chan reconnectResult)
 	go p.ReadMessages(incoming, failure)
 	go p.SendFromConsole()
 
 	for {
 		select {
 		case msg := <-incoming:
+			p.logChat(msg)
 			p.Process(msg)
+			p.record(msg)
+			p.archive(msg)
+			p.hub.Publish(msg)
+		case c := <-p.attach:
+			// The burst is built before subscribing, so the client sees
+			// the state of things, then what it missed and then every
+			// change from here on
+			initial := append(p.welcome(c), c.replay(p.backlog.Unread(c.user))...)
+			sub := p.hub.Subscribe(p.config.clients.size, p.config.clients.overflow, p.forClients)
+			p.clients[c] = sub
+			go c.writeMessages(sub, initial)
+		case c := <-p.detach:
+			if sub, ok := p.clients[c]; ok {
+				sub.Unsubscribe()
+				delete(p.clients, c)
+				p.backlog.MarkRead(c.user, p.backlog.Latest())
+			}
+			log.Printf("Client %s disconnected", c.conn.RemoteAddr())
+		case in := <-p.fromClients:
+			p.fromClient(in.client, in.msg)
+		case msg := <-p.fromConsole:
+			p.sendConsole(msg)
 		case err := <-failure:
 			tcpError, ok := err.(net.Error)
 			if ok && tcpError.Timeout() {
@@ -153,24 +364,56 @@ func (p *Proxy) Run() {
 			} else {
 				log.Printf("Unknown error while reading: %s", err)
 			}
-			for i := uint(0); i < 300; i++ {
-				delay := getExponentialBackoffDelay(i)
-				log.Printf("%sWaiting for %v%s", colorWarning, delay, colorReset)
-				time.Sleep(delay)
-				log.Printf("Attempting to reconnect")
-				reconnectError := p.Reconnect()
-				if reconnectError != nil {
-					log.Printf("Failed to reconnect: %s", reconnectError)
-				}
-
-				go p.ReadMessages(incoming, failure)
-				break
+			connected.Set(0)
+
+			// Retry in the background, so clients and the console are
+			// still served while we wait
+			p.conn.Close()
+			go p.reconnect(p.isupport, reconnected)
+		case result := <-reconnected:
+			if result.err != nil {
+				p.queue.Close()
+				return result.err
 			}
+			p.adopt(result.proxy)
+			go p.ReadMessages(incoming, failure)
+		}
+	}
+}
+
+// reconnect retries the connection according to the reconnect policy and
+// reports the new connection, or an error once the policy gives up or the
+// failure is one that retrying won't fix. It runs in its own goroutine, and
+// only touches the backoff, which nothing else does while we're disconnected.
+func (p *Proxy) reconnect(previous *ircx.ISupport, result chan<- reconnectResult) {
+	for {
+		delay, ok := p.backoff.Next()
+		if !ok {
+			result <- reconnectResult{err: ircx.GaveUpError}
+			return
+		}
+		log.Printf("%sWaiting for %v%s", colorWarning, delay, colorReset)
+		time.Sleep(delay)
+
+		log.Printf("Attempting to reconnect (attempt %d)", p.backoff.Attempts())
+		newProxy, err := Connect(p.config, previous)
+		if err == nil {
+			reconnectOutcomes.Inc("succeeded")
+			connected.Set(1)
+			p.backoff.Connected()
+			result <- reconnectResult{proxy: newProxy}
+			return
+		}
+		reconnectOutcomes.Inc("failed")
+		log.Printf("Failed to reconnect: %s", err)
+		if ircx.IsPermanent(err) {
+			result <- reconnectResult{err: err}
+			return
 		}
 	}
 }
 
-func (p *Proxy) ReadMessages(ch chan<- *irc.Message, failure chan<- error) {
+func (p *Proxy) ReadMessages(ch chan<- *ircx.Message, failure chan<- error) {
 	p.ExtendReadDeadline()
 
 	var waitingForPong string
@@ -178,6 +421,8 @@ func (p *Proxy) ReadMessages(ch chan<- *irc.Message, failure chan<- error) {
 	for {
 		msg, err := p.reader.ReadMessage()
 		if err == nil {
+			messagesReceived.Inc()
+
 			// Valid message, send to consumer
 			ch <- msg
 			skippedDeadlines = 0
@@ -195,23 +440,24 @@ func (p *Proxy) ReadMessages(ch chan<- *irc.Message, failure chan<- error) {
 				log.Printf("%s*** Missed read deadline (%d)%s", colorWarning,
 					skippedDeadlines, colorReset)
 				skippedDeadlines++
+				missedReadDeadlines.Inc()
 
 				if waitingForPong != "" {
 					// We've timed out without a pong, trigger timeout
 					failure <- err
 					return
 
-				} else if skippedDeadlines >= missedDeadlineLimit {
+				} else if skippedDeadlines >= live.Timeouts().MissedDeadlines {
 					// There's not much more we can do here
 					waitingForPong = fmt.Sprintf("%d", time.Now().Nanosecond())
 					ping := &irc.Message{
 						Command:  irc.PING,
 						Trailing: waitingForPong,
 					}
-					p.Send(ping)
+					p.Send(ircx.Wrap(ping))
 
 					// Prepare to wait for the pong
-					next := time.Now().Add(pongTimeout)
+					next := time.Now().Add(live.Timeouts().Pong)
 					p.conn.SetReadDeadline(next)
 				} else {
 					// We have a few more deadlines to go
@@ -226,54 +472,238 @@ func (p *Proxy) ReadMessages(ch chan<- *irc.Message, failure chan<- error) {
 	}
 }
 
+// PrintToConsole logs the messages received from the server until the
+// subscription ends. If the console can't keep up, messages are dropped
+// according to the subscription's overflow policy.
+func PrintToConsole(sub *ircx.Subscription) {
+	var dropped uint64
+	for msg := range sub.Messages() {
+		if n := sub.Dropped(); n > dropped {
+			log.Printf("%s*** %d messages not shown%s", colorWarning, n-dropped, colorReset)
+			dropped = n
+		}
+		logRecv(msg)
+	}
+	if err := sub.Err(); err != nil && err != ircx.HubClosedError {
+		log.Printf("%sStopped showing messages: %s%s", colorWarning, err, colorReset)
+	}
+}
+
+// SendFromConsole reads messages typed at the console and hands them to the
+// run loop to send, as it owns the state that sending them depends on
 func (p *Proxy) SendFromConsole() {
 	// Connect a reader to os.Stdin and send those messages
 	console := bufio.NewReader(os.Stdin)
 	for {
 		line, err := console.ReadString('\n')
 		if err == nil {
-			msg := irc.ParseMessage(line)
-			if msg != nil {
-				log.Printf("%s::: %s%s", colorConsole, msg, colorReset)
-				p.Send(msg)
+			msg := ircx.ParseMessage(line)
+			if msg == nil {
+				continue
 			}
+			log.Printf("%s::: %s%s", colorConsole, msg, colorReset)
+			p.fromConsole <- msg
+		}
+	}
+}
+
+// sendConsole sends a message typed at the console. It runs in the run loop.
+func (p *Proxy) sendConsole(msg *ircx.Message) {
+	if isText(msg) && len(msg.Tags) == 0 {
+		// Long lines are split rather than truncated
+		err := p.SendText(msg.Command, msg.Params[0], msg.Trailing)
+		if err != nil {
+			log.Printf("%sFailed to send: %s%s", colorWarning, err, colorReset)
 		}
+		return
 	}
+	p.Send(msg)
 }
 
 func (p *Proxy) ExtendReadDeadline() {
-	next := time.Now().Add(proxyTimeout)
+	next := time.Now().Add(live.Timeouts().Proxy)
 	p.conn.SetReadDeadline(next)
 }
 
-func (p *Proxy) Send(msg *irc.Message) {
-	next := time.Now().Add(proxyTimeout)
-	p.conn.SetWriteDeadline(next)
-	p.writer.WriteMessage(msg)
+func (p *Proxy) Send(msg *ircx.Message) {
+	err := p.WriteMessage(msg)
+	if err != nil {
+		log.Printf("%sFailed to send %s: %s%s", colorWarning, msg, err, colorReset)
+	}
+}
+
+// JoinChannels joins every channel in the channel set. It is called once
+// registration has finished, and again after reconnecting.
+func (p *Proxy) JoinChannels() {
+	for _, channel := range p.channels.List() {
+		p.Send(channel.JoinMessage())
+	}
+}
+
+// SendText sends a PRIVMSG or NOTICE to a target, splitting long or
+// multi-line text into as many messages as are needed so that the server
+// doesn't truncate it.
+func (p *Proxy) SendText(command, target, text string) error {
+	prefixLen := ircx.PrefixLen(p.currentNick, p.hostmask)
+	msgs, err := ircx.TextMessages(command, target, text, prefixLen, p.caps)
+	if err != nil {
+		return err
+	}
+	for _, group := range ircx.GroupBatches(msgs) {
+		err := p.writeGroup(group)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteMessage queues a message to be sent, allowing the proxy to be used as
+// the writer for the ircx helpers. Without a send queue the message is written
+// immediately.
+func (p *Proxy) WriteMessage(msg *ircx.Message) error {
+	return p.writeGroup([]*ircx.Message{msg})
+}
+
+// writeGroup queues messages to be sent back-to-back, with nothing else in
+// between, as a batch must be. Either all of them are queued or none are.
+func (p *Proxy) writeGroup(msgs []*ircx.Message) error {
+	if p.channels != nil {
+		for _, msg := range msgs {
+			p.channels.Sent(msg, p.isupport)
+		}
+	}
+	var err error
+	if p.queue != nil {
+		err = p.queue.WriteMessages(msgs)
+	} else {
+		for _, msg := range msgs {
+			if err = p.writeNow(msg); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// Text is only recorded once it is on its way
+	for _, msg := range msgs {
+		p.recordSent(msg)
+	}
+	return nil
+}
+
+// writeNow writes a message to the connection with a write deadline
+func (p *Proxy) writeNow(msg *ircx.Message) error {
+	p.RLock()
+	conn, writer := p.conn, p.writer
+	p.RUnlock()
+
+	next := time.Now().Add(live.Timeouts().Proxy)
+	conn.SetWriteDeadline(next)
+	return writer.WriteMessage(msg)
 }
 
-func (p *Proxy) Process(msg *irc.Message) {
+func (p *Proxy) Process(msg *ircx.Message) {
 	if msg.Command == irc.PING {
 		pong := &irc.Message{
 			Command: irc.PONG,
 			Params:  []string{fmt.Sprintf(":%s", msg.Trailing)},
 		}
-		p.Send(pong)
+		p.Send(ircx.Wrap(pong))
+	} else if msg.Command == ircx.CAP && p.caps != nil {
+		// Servers with cap-notify can add and remove capabilities
+		_, err := p.caps.Handle(msg, p)
+		if err != nil {
+			log.Printf("Failed to update capabilities: %s", err)
+		}
+	} else if msg.Command == ircx.RPL_ISUPPORT && p.isupport != nil {
+		p.isupport.Handle(msg)
+	}
+
+	if p.channels != nil {
+		p.channels.Handle(msg, p.currentNick, p.isupport)
+	}
+
+	// Keep track of our own nick and hostmask, which determines how long the
+	// messages we send can be
+	if p.state != nil {
+		p.state.Handle(msg)
+		p.currentNick = p.state.Nick()
+		if self, ok := p.state.User(p.currentNick); ok && self.Host != "" {
+			p.hostmask = self.Hostmask()
+		}
 	}
 }
 
 var (
-	help *bool   = flag.Bool("help", false, "Display usage information")
-	host *string = flag.String("host", "localhost", "The host to connect to")
-	port *int    = flag.Int("port", 6667, "The port to connect to")
+	help       *bool   = flag.Bool("help", false, "Display usage information")
+	configPath *string = flag.String("config", "", "A YAML configuration file; flags given on the command line override it")
+	host       *string = flag.String("host", "localhost", "The host to connect to")
+	port       *int    = flag.Int("port", 6667, "The port to connect to")
+	password   *string = flag.String("password", "", "The server password, if any")
+	nick       *string = flag.String("nick", "bjornbot", "The nickname to use")
+	realName   *string = flag.String("realname", "Bjornbot", "The real name to use")
+
+	useTLS        *bool   = flag.Bool("tls", false, "Connect to the server using TLS")
+	tlsServerName *string = flag.String("tls-servername", "", "The name to verify the server certificate against")
+	tlsCAFile     *string = flag.String("tls-ca", "", "A PEM bundle of CAs to trust instead of the system pool")
+	tlsInsecure   *bool   = flag.Bool("tls-insecure", false, "Skip verification of the server certificate")
+	tlsCertFile   *string = flag.String("tls-cert", "", "A PEM client certificate (for CertFP)")
+	tlsKeyFile    *string = flag.String("tls-key", "", "The PEM private key for -tls-cert")
+
+	saslMechanism *string = flag.String("sasl", "", "The SASL mechanism to use (PLAIN, EXTERNAL or SCRAM-SHA-256)")
+	saslUsername  *string = flag.String("sasl-user", "", "The account name to authenticate as")
+	saslPassword  *string = flag.String("sasl-password", "", "The account password")
+
+	capabilities *string = flag.String("caps", "", "Comma-separated IRCv3 capabilities to request (defaults to a standard set)")
+
+	floodBurst *int     = flag.Int("flood-burst", ircx.DefaultFloodConfig.Burst, "Messages that may be sent to the server back-to-back")
+	floodRate  *float64 = flag.Float64("flood-rate", ircx.DefaultFloodConfig.Rate, "Messages per second once the burst has been used")
+	sendQueue  *int     = flag.Int("sendq", ircx.DefaultFloodConfig.Size, "Maximum number of messages waiting to be sent")
+
+	join *string = flag.String("join", "", "Comma-separated channels to join, each optionally followed by a space and key")
+
+	reconnectAttempts *int           = flag.Int("reconnect-attempts", ircx.DefaultReconnectPolicy.MaxAttempts, "Give up after this many failed reconnects (0 retries forever)")
+	reconnectMaxDelay *time.Duration = flag.Duration("reconnect-max-delay", ircx.DefaultReconnectPolicy.MaxDelay, "The longest delay between reconnect attempts")
+
+	deadlineTimeout *time.Duration = flag.Duration("proxy-timeout", DefaultFileConfig().Timeouts.Proxy, "The read and write deadline for the connection")
+	pongWait        *time.Duration = flag.Duration("pong-timeout", DefaultFileConfig().Timeouts.Pong, "How long to wait for the server to answer a PING")
+	missedDeadlines *int           = flag.Int("missed-deadlines", DefaultFileConfig().Timeouts.MissedDeadlines, "Quiet read deadlines before the server is sent a PING")
+
+	logLevel *string = flag.String("log-level", "debug", "debug to log every message sent and received, or info")
+
+	clientsAddr     *string = flag.String("listen", "", "An address such as localhost:6697 on which to accept IRC clients, or empty to not accept them")
+	clientsPassword *string = flag.String("listen-password", "", "The password IRC clients must send with PASS")
+	clientBuffer    *int    = flag.Int("client-buffer", DefaultFileConfig().Clients.Buffer, "Messages buffered for each IRC client")
+	clientOverflow  *string = flag.String("client-overflow", DefaultFileConfig().Clients.Overflow.String(), "What to do when an IRC client falls behind: drop-oldest, disconnect or block")
+	consoleBuffer   *int    = flag.Int("console-buffer", DefaultFileConfig().Console.Buffer, "Messages buffered for the console")
+	consoleOverflow *string = flag.String("console-overflow", DefaultFileConfig().Console.Overflow.String(), "What to do when the console falls behind: drop-oldest, disconnect or block")
+
+	backlogSize *int           = flag.Int("backlog-size", DefaultFileConfig().Backlog.Size, "Messages kept for each channel and query to replay to IRC clients (0 keeps none)")
+	backlogAge  *time.Duration = flag.Duration("backlog-age", DefaultFileConfig().Backlog.MaxAge, "How long to keep messages to replay to IRC clients (0 for no limit)")
+
+	chatlogDir       *string = flag.String("chatlog", "", "A directory in which to log conversations, or empty to not log them")
+	chatlogTimestamp *string = flag.String("chatlog-timestamp", DefaultFileConfig().ChatLog.Timestamp, "The Go time layout that starts each chat log line")
+	chatlogTimezone  *string = flag.String("chatlog-timezone", DefaultFileConfig().ChatLog.Timezone, "The time zone for chat log timestamps and rotation, such as Local, UTC or Europe/London")
+	chatlogCompress  *bool   = flag.Bool("chatlog-compress", DefaultFileConfig().ChatLog.Compress, "Compress each day's chat logs with gzip once it is over")
+
+	historyDir *string = flag.String("history", "", "A directory in which to keep a searchable history of conversations, or empty to not keep one")
+
+	metricsAddr *string = flag.String("metrics", "", "An address such as localhost:9668 on which to serve /metrics, or empty to not serve them")
 )
 
 func PrintUsage() {
-	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s search [options] [words...] (see %s search -help)\n", os.Args[0], os.Args[0])
 	flag.PrintDefaults()
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "search" {
+		os.Exit(search(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	// Parse commandline options
 	flag.Parse()
 	if *help {
@@ -281,17 +711,33 @@ func main() {
 		return
 	}
 
-	config := ProxyConfig{
-		host:     *host,
-		port:     *port,
-		password: "",
-		nick:     "bjornbot",
-		realName: "Bjornbot",
+	fileConfig, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+	live.Update(fileConfig.Timeouts, fileConfig.Log.Level)
+	go reloadOnHangup(fileConfig)
+	if fileConfig.Metrics.Listen != "" {
+		go serveMetrics(fileConfig.Metrics.Listen)
 	}
 
-	proxy, err := Connect(config)
+	proxy, err := Connect(fileConfig.ProxyConfig(), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
-	proxy.Run()
+	if fileConfig.History.Dir != "" {
+		proxy.history, err = history.Open(fileConfig.History.Dir)
+		if err != nil {
+			log.Fatalf("Failed to open the history: %s", err)
+		}
+	}
+	if fileConfig.Clients.Listen != "" {
+		err = proxy.ListenForClients(fileConfig.Clients.Listen, fileConfig.Clients.Password)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	connected.Set(1)
+	err = proxy.Run()
+	log.Fatalf("Connection is dead: %s", err)
 }
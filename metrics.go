@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/jnwhiteh/wallops/metrics"
+)
+
+// registry holds the metrics served by the metrics listener, if enabled
+var registry = metrics.NewRegistry()
+
+var (
+	connected = registry.NewGauge("wallops_proxy_connected",
+		"1 while the proxy is connected to the server, 0 while it is reconnecting")
+	messagesReceived = registry.NewCounter("wallops_proxy_messages_received_total",
+		"Messages received from the server")
+	messagesSent = registry.NewCounter("wallops_proxy_messages_sent_total",
+		"Messages sent to the server")
+	missedReadDeadlines = registry.NewCounter("wallops_proxy_missed_deadlines_total",
+		"Read deadlines missed while the server was quiet")
+	reconnectOutcomes = registry.NewCounter("wallops_proxy_reconnect_attempts_total",
+		"Attempts to reconnect to the server, by outcome (succeeded or failed)", "outcome")
+)
+
+// serveMetrics serves /metrics on addr until the process exits
+func serveMetrics(addr string) {
+	muxer := http.NewServeMux()
+	muxer.Handle("/metrics", registry)
+	log.Printf("Serving metrics on http://%s/metrics", addr)
+	log.Printf("%sMetrics listener failed: %s%s", colorWarning, http.ListenAndServe(addr, muxer), colorReset)
+}
@@ -0,0 +1,425 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format.
+//
+// Each metric may have labels, whose values are given when the metric is
+// updated, in the order the labels were declared:
+//
+//	requests := registry.NewCounter("requests_total", "Requests served", "handler")
+//	requests.Inc("/send")
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The content type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets suit latencies measured in seconds, from a few milliseconds
+// to ten seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Kind is the type of a metric, as reported in its TYPE line
+type Kind string
+
+const (
+	CounterKind   Kind = "counter"
+	GaugeKind     Kind = "gauge"
+	HistogramKind Kind = "histogram"
+)
+
+// A metric is anything that can write its samples
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds a set of metrics, which are written in the order they were
+// registered.
+type Registry struct {
+	metrics []metric
+	names   map[string]bool
+	sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.Lock()
+	defer r.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric in the text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.Unlock()
+
+	counter := &countingWriter{w: w}
+	buf := bufio.NewWriter(counter)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	err := buf.Flush()
+	return counter.n, err
+}
+
+// ServeHTTP serves the metrics, so that a registry can be mounted at /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+// family is the name, help and labels shared by a metric's series
+type family struct {
+	name   string
+	help   string
+	kind   Kind
+	labels []string
+}
+
+func (f *family) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+// writeSample writes one line. An extra label (such as a histogram's "le")
+// follows the family's own, if its name isn't empty.
+func (f *family) writeSample(w *bufio.Writer, suffix string, values []string, value float64, extraName, extraValue string) {
+	w.WriteString(f.name)
+	w.WriteString(suffix)
+	if len(f.labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, name := range f.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", name, escapeLabel(values[i]))
+		}
+		if extraName != "" {
+			if len(f.labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, escapeLabel(extraValue))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", f.name, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// series holds the value of every combination of label values seen so far
+type series struct {
+	values map[string][]string
+	sync.Mutex
+}
+
+// sortedKeys must be called with the lock held
+func (s *series) sortedKeys() []string {
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value that only goes up, such as the number of requests
+// served.
+type Counter struct {
+	family
+	series
+	counts map[string]float64
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		family: family{name, help, CounterKind, labels},
+		series: series{values: make(map[string][]string)},
+		counts: make(map[string]float64),
+	}
+	r.register(name, c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter, and panics if delta is negative
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("metrics: counter %s can't go down", c.name))
+	}
+	key := c.key(labelValues)
+	c.series.Lock()
+	defer c.series.Unlock()
+	if _, ok := c.values[key]; !ok {
+		c.values[key] = append([]string{}, labelValues...)
+	}
+	c.counts[key] += delta
+}
+
+// Value returns the current count
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.series.Lock()
+	defer c.series.Unlock()
+	return c.counts[key]
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.series.Lock()
+	defer c.series.Unlock()
+	for _, key := range c.sortedKeys() {
+		c.writeSample(w, "", c.values[key], c.counts[key], "", "")
+	}
+}
+
+// Gauge is a value that goes up and down, such as a queue length
+type Gauge struct {
+	family
+	series
+	gauges map[string]float64
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		family: family{name, help, GaugeKind, labels},
+		series: series{values: make(map[string][]string)},
+		gauges: make(map[string]float64),
+	}
+	r.register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.update(labelValues, func(float64) float64 { return value })
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.update(labelValues, func(old float64) float64 { return old + delta })
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *Gauge) update(labelValues []string, f func(float64) float64) {
+	key := g.key(labelValues)
+	g.series.Lock()
+	defer g.series.Unlock()
+	if _, ok := g.values[key]; !ok {
+		g.values[key] = append([]string{}, labelValues...)
+	}
+	g.gauges[key] = f(g.gauges[key])
+}
+
+// Value returns the current value
+func (g *Gauge) Value(labelValues ...string) float64 {
+	key := g.key(labelValues)
+	g.series.Lock()
+	defer g.series.Unlock()
+	return g.gauges[key]
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.series.Lock()
+	defer g.series.Unlock()
+	for _, key := range g.sortedKeys() {
+		g.writeSample(w, "", g.values[key], g.gauges[key], "", "")
+	}
+}
+
+// Histogram counts observations, such as request latencies, in buckets
+type Histogram struct {
+	family
+	series
+	buckets []float64 // upper bounds, in increasing order
+	counts  map[string]*histogramCounts
+}
+
+type histogramCounts struct {
+	buckets []uint64 // observations in each bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds, or
+// DefaultBuckets if buckets is nil. An implicit +Inf bucket is always added.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		family:  family{name, help, HistogramKind, labels},
+		series:  series{values: make(map[string][]string)},
+		buckets: buckets,
+		counts:  make(map[string]*histogramCounts),
+	}
+	r.register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.series.Lock()
+	defer h.series.Unlock()
+	counts, ok := h.counts[key]
+	if !ok {
+		h.values[key] = append([]string{}, labelValues...)
+		counts = &histogramCounts{buckets: make([]uint64, len(h.buckets))}
+		h.counts[key] = counts
+	}
+	i := sort.SearchFloat64s(h.buckets, value)
+	if i < len(h.buckets) {
+		counts.buckets[i]++
+	}
+	counts.count++
+	counts.sum += value
+}
+
+// Count returns how many observations have been made
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+	h.series.Lock()
+	defer h.series.Unlock()
+	if counts, ok := h.counts[key]; ok {
+		return counts.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.series.Lock()
+	defer h.series.Unlock()
+	for _, key := range h.sortedKeys() {
+		values, counts := h.values[key], h.counts[key]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += counts.buckets[i]
+			h.writeSample(w, "_bucket", values, float64(cumulative), "le", formatFloat(bound))
+		}
+		h.writeSample(w, "_bucket", values, float64(counts.count), "le", "+Inf")
+		h.writeSample(w, "_sum", values, counts.sum, "", "")
+		h.writeSample(w, "_count", values, float64(counts.count), "", "")
+	}
+}
+
+// Collector reports values that are read when the metrics are written,
+// such as the number of open connections, rather than being updated as they
+// change.
+type Collector struct {
+	family
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+// NewCollector registers a metric whose samples are produced by collect
+// each time the metrics are written. collect calls emit once per sample;
+// samples emitted more than once with the same labels are added together.
+func (r *Registry) NewCollector(name, help string, kind Kind, labels []string, collect func(emit func(value float64, labelValues ...string))) *Collector {
+	c := &Collector{
+		family:  family{name, help, kind, labels},
+		collect: collect,
+	}
+	r.register(name, c)
+	return c
+}
+
+func (c *Collector) write(w *bufio.Writer) {
+	type sample struct {
+		key    string
+		values []string
+		value  float64
+	}
+	var samples []*sample
+	seen := make(map[string]*sample)
+	c.collect(func(value float64, labelValues ...string) {
+		key := c.key(labelValues)
+		if s, ok := seen[key]; ok {
+			s.value += value
+			return
+		}
+		seen[key] = &sample{key, labelValues, value}
+		samples = append(samples, seen[key])
+	})
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].key < samples[j].key
+	})
+
+	c.writeHeader(w)
+	for _, s := range samples {
+		c.writeSample(w, "", s.values, s.value, "", "")
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
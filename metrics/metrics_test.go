@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func render(t *testing.T, r *Registry) string {
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests served", "handler", "code")
+	c.Inc("/send", "200")
+	c.Add(2, "/send", "200")
+	c.Inc("/events", "404")
+
+	expected := `# HELP requests_total Requests served
+# TYPE requests_total counter
+requests_total{handler="/events",code="404"} 1
+requests_total{handler="/send",code="200"} 3
+`
+	if got := render(t, r); got != expected {
+		t.Errorf("Got:\n%s\nExpected:\n%s", got, expected)
+	}
+	if c.Value("/send", "200") != 3 {
+		t.Errorf("Value = %v, expected 3", c.Value("/send", "200"))
+	}
+}
+
+func TestGauge(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGauge("connected", "Whether we are connected")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	g.Set(0.5)
+	g.Add(0.25)
+
+	expected := `# HELP connected Whether we are connected
+# TYPE connected gauge
+connected 0.75
+`
+	if got := render(t, r); got != expected {
+		t.Errorf("Got:\n%s\nExpected:\n%s", got, expected)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("latency_seconds", "Latency", []float64{1, 0.25}, "outcome")
+	h.Observe(0.125, "ok")
+	h.Observe(0.25, "ok")
+	h.Observe(0.5, "ok")
+	h.Observe(3, "ok")
+
+	expected := `# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{outcome="ok",le="0.25"} 2
+latency_seconds_bucket{outcome="ok",le="1"} 3
+latency_seconds_bucket{outcome="ok",le="+Inf"} 4
+latency_seconds_sum{outcome="ok"} 3.875
+latency_seconds_count{outcome="ok"} 4
+`
+	if got := render(t, r); got != expected {
+		t.Errorf("Got:\n%s\nExpected:\n%s", got, expected)
+	}
+	if h.Count("ok") != 4 || h.Count("failed") != 0 {
+		t.Errorf("Unexpected counts %d and %d", h.Count("ok"), h.Count("failed"))
+	}
+}
+
+func TestCollector(t *testing.T) {
+	r := NewRegistry()
+	r.NewCollector("lag_ms", "Lag", GaugeKind, []string{"server"}, func(emit func(float64, ...string)) {
+		emit(20, "irc.b.net")
+		emit(10, "irc.a.net")
+	})
+
+	expected := `# HELP lag_ms Lag
+# TYPE lag_ms gauge
+lag_ms{server="irc.a.net"} 10
+lag_ms{server="irc.b.net"} 20
+`
+	if got := render(t, r); got != expected {
+		t.Errorf("Got:\n%s\nExpected:\n%s", got, expected)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("escaped_total", "Help with a \\ and\na newline", "label")
+	c.Inc("a \"quoted\"\\value\n")
+
+	got := render(t, r)
+	if !strings.Contains(got, `# HELP escaped_total Help with a \\ and\na newline`) {
+		t.Errorf("Help was not escaped:\n%s", got)
+	}
+	if !strings.Contains(got, `escaped_total{label="a \"quoted\"\\value\n"} 1`) {
+		t.Errorf("Label was not escaped:\n%s", got)
+	}
+}
+
+func TestWrongLabelCount(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("labelled_total", "Labelled", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic")
+		}
+	}()
+	c.Inc("only one")
+}
+
+func TestServeHTTP(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("served_total", "Served").Inc()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ContentType {
+		t.Errorf("Unexpected response %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "served_total 1\n") {
+		t.Errorf("Unexpected body:\n%s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/metrics", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST got %d", w.Code)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jnwhiteh/wallops/chatlog"
+	"github.com/jnwhiteh/wallops/config"
+	"github.com/jnwhiteh/wallops/history"
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/sorcix/irc"
+)
+
+// search runs the search subcommand, which looks through the history kept
+// by the proxy, and returns the exit status
+func search(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configFile := flags.String("config", "", "The proxy's configuration file, to find the history directory in")
+	dir := flags.String("history", "", "The history directory, if not given by -config")
+	network := flags.String("network", "", "Only messages on this network")
+	channel := flags.String("channel", "", "Only messages in this channel, or private messages with this nick")
+	nick := flags.String("nick", "", "Only messages sent by this nick")
+	since := flags.String("since", "", "Only messages since this time: 2006-01-02, 2006-01-02T15:04, RFC 3339, or how long ago such as 36h or 7d")
+	until := flags.String("until", "", "Only messages before this time, in the same formats as -since")
+	limit := flags.Int("limit", history.DefaultLimit, "Results per page")
+	before := flags.Uint64("before", 0, "Show the next page, using the id printed at the end of the previous one")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s search [options] [words...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	if *dir == "" && *configFile != "" {
+		c := DefaultFileConfig()
+		if err := config.Load(*configFile, &c); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		*dir = c.History.Dir
+	}
+	if *dir == "" {
+		fmt.Fprintln(stderr, "No history to search: give -history, or -config with history.dir set")
+		return 2
+	}
+
+	query := history.Query{
+		Network: *network,
+		Channel: *channel,
+		Nick:    *nick,
+		Text:    strings.Join(flags.Args(), " "),
+		Limit:   *limit,
+		Before:  *before,
+	}
+	now := time.Now()
+	for _, bound := range []struct {
+		flag  string
+		value string
+		into  *time.Time
+	}{{"-since", *since, &query.Since}, {"-until", *until, &query.Until}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := history.ParseTime(bound.value, now)
+		if err != nil {
+			fmt.Fprintf(stderr, "Invalid %s: %s\n", bound.flag, err)
+			return 2
+		}
+		*bound.into = t
+	}
+
+	if _, err := os.Stat(*dir); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	index, err := history.Open(*dir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer index.Close()
+	page, err := index.Search(query)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	for _, record := range page.Records {
+		fmt.Fprintf(stdout, "%s %s %s %s\n", record.Time.Local().Format("2006-01-02 15:04:05"),
+			record.Network, record.Channel, formatRecord(record))
+	}
+	if page.Next != 0 {
+		fmt.Fprintf(stderr, "More results with -before %d\n", page.Next)
+	}
+	return 0
+}
+
+// formatRecord shows a record the way the chat log would
+func formatRecord(record history.Record) string {
+	msg := &irc.Message{
+		Prefix:   &irc.Prefix{Name: record.Nick},
+		Command:  record.Command,
+		Params:   []string{record.Channel},
+		Trailing: record.Text,
+	}
+	if line, ok := chatlog.Format(ircx.Wrap(msg)); ok {
+		return line
+	}
+	return fmt.Sprintf("<%s> %s", record.Nick, record.Text)
+}
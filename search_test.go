@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jnwhiteh/wallops/history"
+	"github.com/jnwhiteh/wallops/ircx"
+)
+
+func TestSearchCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	proxy := newBouncedProxy()
+	proxy.config.host = "irc.example.net"
+	proxy.history, err = history.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"@time=2020-01-01T12:00:00.000Z :alice!a@example.net PRIVMSG #wallops :the deploy is broken",
+		"@time=2020-01-01T12:01:00.000Z :alice!a@example.net PRIVMSG bot :\x01ACTION fixes the deploy\x01",
+		"@time=2020-01-01T12:02:00.000Z :irc.example.net NOTICE bot :deploy notice from the server",
+	} {
+		proxy.archive(ircx.ParseMessage(line))
+	}
+	proxy.recordSent(ircx.ParseMessage("PRIVMSG #wallops :thanks for the deploy"))
+	proxy.history.Close()
+
+	var stdout, stderr bytes.Buffer
+	status := search([]string{"-history", dir, "-limit", "2", "-since", "2020-01-01", "DEPLOY"}, &stdout, &stderr)
+	if status != 0 {
+		t.Fatalf("search exited with %d: %s", status, stderr.String())
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "Example #wallops <bot> thanks for the deploy") ||
+		!strings.HasSuffix(lines[1], "Example alice * alice fixes the deploy") {
+		t.Errorf("Unexpected results %q", lines)
+	}
+	if stderr.String() != "More results with -before 2\n" {
+		t.Errorf("Unexpected pagination hint %q", stderr.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	search([]string{"-history", dir, "-before", "2", "deploy"}, &stdout, &stderr)
+	if !strings.HasSuffix(strings.TrimSpace(stdout.String()), "<alice> the deploy is broken") || stderr.Len() != 0 {
+		t.Errorf("Unexpected second page %q, %q", stdout.String(), stderr.String())
+	}
+
+	if status := search([]string{"deploy"}, &stdout, &stderr); status != 2 {
+		t.Errorf("Expected a usage error without a history directory, got %d", status)
+	}
+}
+
+func TestRecordSentOnlyOnceQueued(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	proxy := newBouncedProxy()
+	proxy.history, err = history.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.history.Close()
+
+	proxy.queue = ircx.NewSendQueue(ircx.WriterFunc(func(*ircx.Message) error { return nil }), ircx.FloodConfig{})
+	proxy.queue.Close()
+	if err := proxy.WriteMessage(ircx.ParseMessage("PRIVMSG #wallops :never sent")); err != ircx.QueueClosedError {
+		t.Fatalf("Expected the queue to be closed, got %v", err)
+	}
+	if n := proxy.history.Len(); n != 0 {
+		t.Errorf("Expected nothing to be recorded, got %d records", n)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jnwhiteh/wallops/config"
+)
+
+// FileConfig is the configuration file for the server. Every setting can also
+// be given as a flag, which takes precedence over the file.
+type FileConfig struct {
+	Listen  string `yaml:"listen"`  // the address the API listens on
+	State   string `yaml:"state"`   // where the pool is saved, or empty
+	History string `yaml:"history"` // where searchable history is kept, or empty
+
+	HTTP struct {
+		ReadTimeout  time.Duration `yaml:"read_timeout"`
+		WriteTimeout time.Duration `yaml:"write_timeout"`
+	} `yaml:"http"`
+
+	Timeouts config.Timeouts `yaml:"timeouts"`
+
+	Log struct {
+		Level config.LogLevel `yaml:"level"`
+	} `yaml:"log"`
+}
+
+func DefaultFileConfig() FileConfig {
+	var c FileConfig
+	c.Listen = "localhost:9667"
+	c.State = "wallops-state.json"
+	c.HTTP.ReadTimeout = 10 * time.Second
+	c.HTTP.WriteTimeout = 10 * time.Second
+	c.Timeouts = config.Timeouts{
+		Proxy:           time.Second * 15,
+		Pong:            time.Second * 15,
+		MissedDeadlines: 5,
+	}
+	c.Log.Level = config.Debug
+	return c
+}
+
+func (c *FileConfig) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return config.Invalid("listen", "%q is not a host:port address", c.Listen)
+	}
+	if c.HTTP.ReadTimeout <= 0 {
+		return config.Invalid("http.read_timeout", "must be positive, got %v", c.HTTP.ReadTimeout)
+	}
+	if c.HTTP.WriteTimeout <= 0 {
+		return config.Invalid("http.write_timeout", "must be positive, got %v", c.HTTP.WriteTimeout)
+	}
+	return c.Timeouts.Validate()
+}
+
+// applyFlags overrides the file with any flags given on the command line
+func (c *FileConfig) applyFlags() {
+	overrides := map[string]func(){
+		"listen":           func() { c.Listen = *listenAddr },
+		"state":            func() { c.State = *statePath },
+		"history":          func() { c.History = *historyDir },
+		"proxy-timeout":    func() { c.Timeouts.Proxy = *deadlineTimeout },
+		"pong-timeout":     func() { c.Timeouts.Pong = *pongWait },
+		"missed-deadlines": func() { c.Timeouts.MissedDeadlines = *missedDeadlines },
+		"log-level":        func() { c.Log.Level, _ = config.ParseLogLevel(*logLevel) },
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if override, ok := overrides[f.Name]; ok {
+			override()
+		}
+	})
+}
+
+// loadConfig builds the configuration from the defaults, the file given
+// with -config (if any) and the flags, in that order.
+func loadConfig() (FileConfig, error) {
+	c := DefaultFileConfig()
+	if *configPath != "" {
+		err := config.Load(*configPath, &c)
+		if err != nil {
+			return c, err
+		}
+	}
+	if _, err := config.ParseLogLevel(*logLevel); err != nil {
+		return c, config.Invalid("-log-level", "%s", err)
+	}
+	c.applyFlags()
+	return c, c.Validate()
+}
+
+// reloadOnHangup reloads the configuration whenever we receive SIGHUP. The
+// timeouts and log level apply to every connection straight away, but
+// changes to anything else need a restart.
+func reloadOnHangup(current FileConfig) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		next, err := loadConfig()
+		if err != nil {
+			log.Printf("Not reloading configuration: %s", err)
+			continue
+		}
+		live.Update(next.Timeouts, next.Log.Level)
+		log.Printf("Reloaded configuration (log level %s, timeouts %+v)", next.Log.Level, next.Timeouts)
+
+		if next.Listen != current.Listen || next.State != current.State || next.History != current.History || next.HTTP != current.HTTP {
+			log.Printf("Changes to listen, state, history and http need a restart")
+		}
+	}
+}
@@ -1,35 +1,543 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
+	"log"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"github.com/jnwhiteh/wallops/config"
+	"github.com/jnwhiteh/wallops/ircx"
 	"github.com/sorcix/irc"
 )
 
 var (
-	proxyTimeout = time.Second * 15
+	closedError       = fmt.Errorf("Connection closed")
+	notConnectedError = fmt.Errorf("Not connected")
+
+	// quitMessage is sent when the last token for a connection unregisters
+	quitMessage = "Unregistered"
+
+	// live holds the settings that can be changed by reloading the
+	// configuration
+	live = config.NewLive(DefaultFileConfig().Timeouts, config.Debug)
+
+	// lagInterval is how often we PING the server to measure lag
+	lagInterval = time.Minute
+
+	// reconnectPolicy controls how dropped connections are retried
+	reconnectPolicy = ircx.DefaultReconnectPolicy
+)
+
+// The prefix of the PINGs we use to measure lag
+const lagPrefix = "lag-"
+
+// The states a connection can be in, as reported by Status
+const (
+	StatusConnected    = "connected"
+	StatusReconnecting = "reconnecting"
+	StatusDead         = "dead"
 )
 
 func NewConnection(config ServerConfig) (*Proxy, error) {
-	proxy := &Proxy{config: config}
+	proxy := newProxy(config, ircx.ParseChannels(config.Channels))
 	err := proxy.Connect()
 	if err != nil {
+		proxy.queue.Close()
 		return nil, err
 	}
+	proxy.JoinChannels()
 	return proxy, nil
 }
 
+// RestoreConnection connects to a server for tokens that were registered
+// before a restart, joining the channels the connection was in. Unlike
+// NewConnection it doesn't give up when the server can't be reached, since
+// the tokens are still relying on it, and instead starts reconnecting.
+func RestoreConnection(config ServerConfig, channels []ircx.Channel) *Proxy {
+	proxy := newProxy(config, channels)
+	err := proxy.Connect()
+	if err != nil && ircx.IsPermanent(err) {
+		log.Printf("Failed to restore connection to %s: %s", config.Host, err)
+		proxy.setStatus(StatusDead, err)
+		proxy.queue.Close()
+		return proxy
+	} else if err != nil {
+		log.Printf("Failed to restore connection to %s: %s", config.Host, err)
+		proxy.setStatus(StatusReconnecting, err)
+	} else {
+		proxy.JoinChannels()
+	}
+	go proxy.Run()
+	return proxy
+}
+
+// newProxy creates a proxy that hasn't connected yet
+func newProxy(config ServerConfig, channels []ircx.Channel) *Proxy {
+	proxy := &Proxy{
+		config:   config,
+		owner:    historyOwner(config),
+		channels: ircx.NewChannelSet(channels),
+		events:   newEventLog(eventBufferSize),
+		status:   StatusConnected,
+		dead:     make(chan struct{}),
+	}
+	proxy.queue = ircx.NewSendQueue(ircx.WriterFunc(proxy.writeNow), config.Flood)
+	return proxy
+}
+
 type Proxy struct {
 	config ServerConfig
+	owner  string // who our records in the history belong to
 
 	currentNick string
+	connectedAt time.Time          // when we last finished registering
+	lag         time.Duration      // the round trip time of our last lag PING
+	hostmask    string             // our nick!user@host, if the server told us
+	caps        *ircx.Capabilities // the capabilities enabled by the server
+	isupport    *ircx.ISupport     // the features advertised by the server
+	channels    *ircx.ChannelSet   // the channels we are in (or joining)
+	state       *ircx.State        // channel membership and user state
 
-	conn   net.Conn // the underlying network connection
+	conn   net.Conn // the underlying network connection (TCP or TLS)
 	reader messageReader
 	writer messageWriter
+	queue  *ircx.SendQueue // rate limits messages sent to the writer
+
+	status  string              // one of the Status constants
+	err     error               // why the connection was lost, if it was
+	closing bool                // set by Close, so we don't reconnect
+	hooks   map[string]*webhook // delivers incoming messages for each token
+	echoes  []*pendingEcho      // sent messages waiting to be echoed back
+	events  *eventLog           // recent messages, for event streams
+	dead    chan struct{}       // closed once the status is StatusDead
+
+	// Counted for /metrics, across reconnects
+	received        atomic.Uint64
+	sent            atomic.Uint64
+	missedDeadlines atomic.Uint64
+
+	// Guards the connection and the state that is replaced on reconnect
+	sync.RWMutex
+}
+
+// Status returns the state of the connection and, if it has been lost, the
+// error that caused it. Once the status is StatusDead the proxy will not
+// reconnect and should be discarded.
+func (p *Proxy) Status() (string, error) {
+	p.RLock()
+	defer p.RUnlock()
+	return p.status, p.err
+}
+
+func (p *Proxy) setStatus(status string, err error) {
+	p.Lock()
+	p.status = status
+	p.err = err
+	if status == StatusDead && p.dead != nil {
+		close(p.dead)
+	}
+	p.Unlock()
+}
+
+// Dead returns a channel that is closed when the proxy gives up
+// reconnecting.
+func (p *Proxy) Dead() <-chan struct{} {
+	return p.dead
+}
+
+// AddWebhook starts delivering incoming messages to a token's MessageUrl,
+// signed with the token's secret.
+func (p *Proxy) AddWebhook(token, url, secret string) {
+	p.Lock()
+	if p.hooks == nil {
+		p.hooks = make(map[string]*webhook)
+	}
+	p.hooks[token] = newWebhook(token, url, secret)
+	p.Unlock()
+}
+
+// RemoveWebhook stops delivering messages for a token. Messages that are
+// already queued are still delivered.
+func (p *Proxy) RemoveWebhook(token string) {
+	p.Lock()
+	hook, ok := p.hooks[token]
+	delete(p.hooks, token)
+	p.Unlock()
+
+	if ok {
+		hook.Close()
+	}
+}
+
+// Webhook returns the delivery status for a token's MessageUrl
+func (p *Proxy) Webhook(token string) (WebhookResponse, bool) {
+	p.RLock()
+	hook, ok := p.hooks[token]
+	p.RUnlock()
+
+	if !ok {
+		return WebhookResponse{}, false
+	}
+	return hook.Status(), true
+}
+
+// deliver passes a message on to every token's webhook, and to any event
+// streams.
+func (p *Proxy) deliver(msg *ircx.Message) {
+	if !shouldDeliver(msg) {
+		return
+	}
+	p.events.Add(msg)
+
+	p.RLock()
+	defer p.RUnlock()
+	for _, hook := range p.hooks {
+		hook.Deliver(msg)
+	}
+}
+
+// Info describes the connection, for the token and connection endpoints
+func (p *Proxy) Info() ConnectionStatus {
+	p.RLock()
+	defer p.RUnlock()
+
+	info := ConnectionStatus{
+		Server:         net.JoinHostPort(p.config.Host, strconv.Itoa(p.config.Port)),
+		Status:         p.status,
+		Nickname:       p.currentNick,
+		ConnectedSince: p.connectedAt,
+		LagMs:          int64(p.lag / time.Millisecond),
+		Tokens:         len(p.hooks),
+	}
+	if p.err != nil {
+		info.Error = p.err.Error()
+	}
+	if p.state != nil {
+		info.Channels = p.state.Channels()
+	}
+	return info
+}
+
+// Channel returns a snapshot of a channel we are in
+func (p *Proxy) Channel(name string) (ircx.ChannelInfo, bool) {
+	p.RLock()
+	state := p.state
+	p.RUnlock()
+	if state == nil {
+		return ircx.ChannelInfo{}, false
+	}
+	return state.Channel(name)
+}
+
+// ISupport returns the features advertised by the server
+func (p *Proxy) ISupport() *ircx.ISupport {
+	p.RLock()
+	defer p.RUnlock()
+	return p.isupport
+}
+
+// Close sends QUIT and closes the connection, after which the proxy is dead
+// and won't reconnect.
+func (p *Proxy) Close(reason string) {
+	p.Lock()
+	p.closing = true
+	conn := p.conn
+	p.Unlock()
+
+	if conn == nil {
+		// Run will notice we're closing when it next tries to reconnect
+		return
+	}
+
+	// Skip the queue, since there may be plenty of messages ahead of us
+	quit := &irc.Message{Command: irc.QUIT, Trailing: reason}
+	err := p.writeNow(ircx.Wrap(quit))
+	if err != nil {
+		log.Printf("Failed to send QUIT to %s: %s", p.config.Host, err)
+	}
+	conn.Close()
+}
+
+func (p *Proxy) isClosing() bool {
+	p.RLock()
+	defer p.RUnlock()
+	return p.closing
+}
+
+// Run processes messages from the server until the connection drops, then
+// reconnects according to the reconnect policy. If the policy gives up, the
+// server rejects us in a way retrying won't fix, or the proxy is closed, the
+// proxy is marked dead and Run returns.
+func (p *Proxy) Run() {
+	backoff := ircx.NewBackoff(reconnectPolicy)
+	for {
+		// A restored proxy may not have connected yet
+		if p.conn != nil {
+			stop := make(chan struct{})
+			go p.measureLag(stop)
+			err := p.ReadMessages()
+			close(stop)
+			p.conn.Close()
+			if p.isClosing() {
+				p.setStatus(StatusDead, closedError)
+				p.queue.Close()
+				return
+			}
+			log.Printf("Lost connection to %s: %s", p.config.Host, err)
+			p.setStatus(StatusReconnecting, err)
+		}
+
+		err := p.reconnect(backoff)
+		if err != nil {
+			if err != closedError {
+				reconnectsAbandoned.Inc()
+			}
+			log.Printf("Giving up on %s: %s", p.config.Host, err)
+			p.setStatus(StatusDead, err)
+			p.queue.Close()
+			return
+		}
+		p.setStatus(StatusConnected, nil)
+		p.JoinChannels()
+	}
+}
+
+// measureLag sends a PING every lagInterval until stopped. Process records
+// how long the server takes to answer.
+func (p *Proxy) measureLag(stop <-chan struct{}) {
+	ticker := time.NewTicker(lagInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ping := &irc.Message{
+				Command:  irc.PING,
+				Trailing: lagPrefix + strconv.FormatInt(time.Now().UnixNano(), 10),
+			}
+			p.Send(ircx.Wrap(ping))
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reconnect retries the connection until it succeeds or the backoff gives up
+func (p *Proxy) reconnect(backoff *ircx.Backoff) error {
+	for {
+		delay, ok := backoff.Next()
+		if !ok {
+			return ircx.GaveUpError
+		}
+		log.Printf("Waiting for %v before reconnecting to %s", delay, p.config.Host)
+		time.Sleep(delay)
+		if p.isClosing() {
+			return closedError
+		}
+
+		err := p.Connect()
+		if err == nil && p.isClosing() {
+			// Closed while we were connecting
+			p.conn.Close()
+			return closedError
+		} else if err == nil {
+			reconnectAttempts.Inc("succeeded")
+			backoff.Connected()
+			return nil
+		}
+		reconnectAttempts.Inc("failed")
+		log.Printf("Failed to reconnect to %s: %s", p.config.Host, err)
+		if ircx.IsPermanent(err) {
+			return err
+		}
+	}
+}
+
+// ReadMessages processes messages from the server until the connection
+// fails. If the server goes quiet for too long we PING it, and give up on the
+// connection if it doesn't answer.
+func (p *Proxy) ReadMessages() error {
+	p.ExtendReadDeadline()
+
+	var waitingForPong string
+	skippedDeadlines := 0
+	for {
+		msg, err := p.reader.ReadMessage()
+		if err == nil {
+			p.received.Add(1)
+			p.Process(msg)
+			p.deliver(msg)
+			p.archive(msg)
+			skippedDeadlines = 0
+
+			if msg.Command == irc.PONG && msg.Trailing == waitingForPong {
+				waitingForPong = ""
+			} else {
+				p.ExtendReadDeadline()
+			}
+			continue
+		}
+
+		tcpError, ok := err.(net.Error)
+		if !ok || !tcpError.Timeout() {
+			return err
+		}
+
+		skippedDeadlines++
+		p.missedDeadlines.Add(1)
+		if waitingForPong != "" {
+			// We've timed out without a pong
+			return err
+		} else if skippedDeadlines >= live.Timeouts().MissedDeadlines {
+			waitingForPong = fmt.Sprintf("%d", time.Now().Nanosecond())
+			ping := &irc.Message{
+				Command:  irc.PING,
+				Trailing: waitingForPong,
+			}
+			p.Send(ircx.Wrap(ping))
+			p.conn.SetReadDeadline(time.Now().Add(live.Timeouts().Pong))
+		} else {
+			p.ExtendReadDeadline()
+		}
+	}
+}
+
+func (p *Proxy) ExtendReadDeadline() {
+	p.conn.SetReadDeadline(time.Now().Add(live.Timeouts().Proxy))
+}
+
+// Send queues a message to be sent to the server, returning
+// ircx.QueueFullError if too many messages are already waiting.
+func (p *Proxy) Send(msg *ircx.Message) error {
+	return p.SendGroup([]*ircx.Message{msg})
+}
+
+// SendGroup queues messages to be sent back-to-back, with nothing else in
+// between, as a batch must be. Either all of them are queued or none are.
+func (p *Proxy) SendGroup(msgs []*ircx.Message) error {
+	if p.channels != nil {
+		for _, msg := range msgs {
+			p.channels.Sent(msg, p.ISupport())
+		}
+	}
+	var err error
+	if p.queue != nil {
+		err = p.queue.WriteMessages(msgs)
+	} else {
+		for _, msg := range msgs {
+			if err = p.writeNow(msg); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		p.archiveSent(msg)
+	}
+	return nil
+}
+
+// JoinChannels joins every channel in the channel set. It is called once
+// registration has finished, and should be called again after reconnecting.
+func (p *Proxy) JoinChannels() error {
+	for _, channel := range p.channels.List() {
+		err := p.Send(channel.JoinMessage())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Process answers keepalives and keeps the connection's state up to date
+// with a message received from the server.
+func (p *Proxy) Process(msg *ircx.Message) {
+	switch msg.Command {
+	case irc.PING:
+		pong := &irc.Message{
+			Command: irc.PONG,
+			Params:  []string{fmt.Sprintf(":%s", msg.Trailing)},
+		}
+		p.Send(ircx.Wrap(pong))
+	case ircx.CAP:
+		_, err := p.caps.Handle(msg, ircx.WriterFunc(p.Send))
+		if err != nil {
+			log.Printf("Failed to update capabilities: %s", err)
+		}
+	case irc.PONG:
+		if strings.HasPrefix(msg.Trailing, lagPrefix) {
+			sent, err := strconv.ParseInt(msg.Trailing[len(lagPrefix):], 10, 64)
+			if err == nil {
+				p.Lock()
+				p.lag = time.Since(time.Unix(0, sent))
+				p.Unlock()
+			}
+		}
+	case ircx.RPL_ISUPPORT:
+		p.isupport.Handle(msg)
+	}
+
+	p.matchEcho(msg)
+	p.channels.Handle(msg, p.currentNick, p.isupport)
+	p.state.Handle(msg)
+
+	p.Lock()
+	p.currentNick = p.state.Nick()
+	if self, ok := p.state.User(p.currentNick); ok && self.Host != "" {
+		p.hostmask = self.Hostmask()
+	}
+	p.Unlock()
+}
+
+// SendText sends a PRIVMSG or NOTICE to a target, splitting long or
+// multi-line text into as many messages as are needed so that the server
+// doesn't truncate it.
+func (p *Proxy) SendText(command, target, text string) error {
+	msgs, err := p.TextMessages(command, target, text)
+	if err != nil {
+		return err
+	}
+	for _, group := range ircx.GroupBatches(msgs) {
+		err := p.SendGroup(group)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TextMessages builds the messages SendText would send
+func (p *Proxy) TextMessages(command, target, text string) ([]*ircx.Message, error) {
+	p.RLock()
+	prefixLen := ircx.PrefixLen(p.currentNick, p.hostmask)
+	caps := p.caps
+	p.RUnlock()
+
+	return ircx.TextMessages(command, target, text, prefixLen, caps)
+}
+
+// writeNow writes a message to the connection with a write deadline
+func (p *Proxy) writeNow(msg *ircx.Message) error {
+	p.RLock()
+	conn, writer := p.conn, p.writer
+	p.RUnlock()
+
+	if conn == nil {
+		return notConnectedError
+	}
+	conn.SetWriteDeadline(time.Now().Add(live.Timeouts().Proxy))
+	err := writer.WriteMessage(msg)
+	if err == nil {
+		p.sent.Add(1)
+	}
+	return err
 }
 
 func (p *Proxy) formatIncoming(msg interface{}) string {
@@ -44,29 +552,52 @@ func (p *Proxy) formatOutgoing(msg interface{}) string {
 	return fmt.Sprintf("%s--> %s%s", color, msg, colorReset)
 }
 
-func (p *Proxy) Connect() error {
-	// Make a network connection
-	endpoint := fmt.Sprintf("%s:%d", p.config.Host, p.config.Port)
-	conn, err := net.Dial("tcp", endpoint)
+func (p *Proxy) Connect() (err error) {
+	// Make a network connection, using TLS if configured
+	timeout := live.Timeouts().Proxy
+	conn, err := ircx.Dial(p.config.Host, p.config.Port, p.config.TLS, timeout)
 	if err != nil {
 		return err
 	}
 
+	// Registration can fail in many places, none of which should leak the
+	// connection
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
 	// Set a reasonable read deadline for the "connection"
-	conn.SetDeadline(time.Now().Add(proxyTimeout))
+	conn.SetDeadline(time.Now().Add(timeout))
 
 	// Create IRC protocol encoder/decoders
-	encoder := irc.NewEncoder(conn)
-	decoder := irc.NewDecoder(bufio.NewReader(conn))
+	encoder := ircx.NewEncoder(conn)
+	decoder := ircx.NewDecoder(conn)
 	reader := &safeReader{decoder, p.formatIncoming}
 	writer := &writer{encoder, p.formatOutgoing}
 
+	// Negotiate capabilities (and authenticate, if configured) before
+	// registering, so the server holds registration until we send CAP END
+	var sasl *ircx.SASL
+	if p.config.SASL.Enabled() {
+		sasl, err = ircx.NewSASL(p.config.SASL)
+		if err != nil {
+			return err
+		}
+	}
+	caps := ircx.NewCapabilities(ircx.ParseCapabilities(p.config.Capabilities), sasl)
+	err = caps.Begin(writer)
+	if err != nil {
+		return err
+	}
+
 	// Send PASS (server password)
 	if p.config.Password != "" {
 		msg := &irc.Message{
 			Command: irc.PASS,
 			Params:  []string{p.config.Password}}
-		writer.WriteMessage(msg)
+		err = writer.WriteMessage(ircx.Wrap(msg))
 		if err != nil {
 			return err
 		}
@@ -74,7 +605,7 @@ func (p *Proxy) Connect() error {
 
 	// Send NICK (nickname)
 	msg := &irc.Message{Command: irc.NICK, Params: []string{p.config.Nickname}}
-	writer.WriteMessage(msg)
+	err = writer.WriteMessage(ircx.Wrap(msg))
 	if err != nil {
 		return err
 	}
@@ -85,43 +616,103 @@ func (p *Proxy) Connect() error {
 		Params:   []string{p.config.Nickname, "host", "server"},
 		Trailing: p.config.Realname,
 	}
-	err = writer.WriteMessage(msg)
+	err = writer.WriteMessage(ircx.Wrap(msg))
 	if err != nil {
 		return err
 	}
 
 	// Wait for the welcome message and handle nickname in-use responses
 	currentNick := p.config.Nickname
+	hostmask := ""
+	isupport := ircx.NewISupport()
+
+	// RPL_ISUPPORT only arrives after RPL_WELCOME, so until then assume the
+	// server allows the nick length it did when we were last connected
+	nickLen := ircx.DefaultNickLen
+	if previous := p.ISupport(); previous != nil {
+		nickLen = previous.NickLen()
+	}
 
 	for {
 		msg, err := reader.ReadMessage()
 		if err != nil {
 			return err
 		}
+		handled, err := caps.Handle(msg, writer)
+		if err != nil {
+			return err
+		}
+		if handled {
+			continue
+		}
 		if msg.Command == irc.RPL_WELCOME {
+			hostmask = ircx.HostmaskFromWelcome(msg)
 			break
 		} else if msg.Command == irc.ERR_NICKNAMEINUSE {
-			currentNick = randomNick(p.config.Nickname)
+			currentNick = randomNick(p.config.Nickname, nickLen)
 			msg := &irc.Message{Command: irc.NICK, Params: []string{currentNick}}
-			err = writer.WriteMessage(msg)
+			err = writer.WriteMessage(ircx.Wrap(msg))
+			if err != nil {
+				return err
+			}
+		} else if msg.Command == irc.PING {
+			pong := &irc.Message{
+				Command: irc.PONG,
+				Params:  []string{fmt.Sprintf(":%s", msg.Trailing)},
+			}
+			err = writer.WriteMessage(ircx.Wrap(pong))
 			if err != nil {
 				return err
 			}
+		}
+	}
+
+	// Wait for the rest of the registration burst, recording the features
+	// the server supports from RPL_ISUPPORT
+	for {
+		msg, err := reader.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if isupport.Handle(msg) {
+			continue
+		}
+		if msg.Command == irc.RPL_ENDOFMOTD || msg.Command == irc.ERR_NOMOTD {
+			break
 		} else if msg.Command == irc.PING {
 			pong := &irc.Message{
 				Command: irc.PONG,
 				Params:  []string{fmt.Sprintf(":%s", msg.Trailing)},
 			}
-			err = writer.WriteMessage(pong)
+			err = writer.WriteMessage(ircx.Wrap(pong))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !isupport.ValidNick(currentNick) {
+		log.Printf("Nickname %s is not valid on this network", currentNick)
+		if utf8.RuneCountInString(currentNick) > isupport.NickLen() {
+			// Most likely a fallback picked before we knew NICKLEN. The
+			// state follows the server's reply once we are running.
+			msg := &irc.Message{Command: irc.NICK, Params: []string{randomNick(p.config.Nickname, isupport.NickLen())}}
+			err = writer.WriteMessage(ircx.Wrap(msg))
 			if err != nil {
 				return err
 			}
 		}
 	}
 
+	p.Lock()
+	p.connectedAt = time.Now().UTC()
 	p.conn = conn
 	p.reader = reader
 	p.writer = writer
 	p.currentNick = currentNick
+	p.hostmask = hostmask
+	p.caps = caps
+	p.isupport = isupport
+	p.state = ircx.NewState(currentNick, isupport)
+	p.Unlock()
 	return nil
 }
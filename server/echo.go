@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/sorcix/irc"
+)
+
+// How the result of sending a message is reported in SendResponse
+const (
+	SendQueued = "queued" // accepted, but the server hasn't confirmed it
+	SendSent   = "sent"   // the server has echoed the message back to us
+)
+
+const TAGMSG = "TAGMSG"
+
+// echoTimeout is how long a send waits for the server to echo its messages
+var echoTimeout = 5 * time.Second
+
+// pendingEcho is a message we have sent and are waiting to see echoed
+type pendingEcho struct {
+	key   string
+	msgid chan string // receives the echo's msgid tag (which may be empty)
+}
+
+// echoKey identifies a message we sent so that its echo can be recognised.
+// Messages inside a batch aren't echoed individually, the batch is.
+func echoKey(msg *ircx.Message, isupport *ircx.ISupport) (string, bool) {
+	if _, ok := msg.Tags["batch"]; ok {
+		return "", false
+	}
+	switch msg.Command {
+	case irc.PRIVMSG, irc.NOTICE, TAGMSG:
+		return strings.Join([]string{msg.Command, isupport.Fold(msg.Param(0)), msg.Param(1)}, " "), true
+	case ircx.BATCH:
+		// The server picks its own reference, so match on type and target
+		if !strings.HasPrefix(msg.Param(0), "+") {
+			return "", false
+		}
+		return strings.Join([]string{msg.Command, msg.Param(1), isupport.Fold(msg.Param(2))}, " "), true
+	}
+	return "", false
+}
+
+// SendAndWait sends messages to the server. If echo-message is enabled it
+// waits for the server to echo them, returning SendSent and the msgid of each
+// echo. Otherwise, or if the echoes don't arrive in time, it returns
+// SendQueued.
+func (p *Proxy) SendAndWait(msgs []*ircx.Message) (string, []string, error) {
+	p.RLock()
+	caps, isupport := p.caps, p.isupport
+	p.RUnlock()
+
+	var pending []*pendingEcho
+	if caps != nil && caps.Enabled("echo-message") {
+		for _, msg := range msgs {
+			if key, ok := echoKey(msg, isupport); ok {
+				pending = append(pending, &pendingEcho{key, make(chan string, 1)})
+			}
+		}
+		p.Lock()
+		p.echoes = append(p.echoes, pending...)
+		p.Unlock()
+	}
+
+	for _, group := range ircx.GroupBatches(msgs) {
+		err := p.SendGroup(group)
+		if err != nil {
+			p.forgetEchoes(pending)
+			return "", nil, err
+		}
+	}
+	if len(pending) == 0 {
+		return SendQueued, nil, nil
+	}
+
+	timeout := time.After(echoTimeout)
+	var msgids []string
+	for _, echo := range pending {
+		select {
+		case msgid := <-echo.msgid:
+			if msgid != "" {
+				msgids = append(msgids, msgid)
+			}
+		case <-timeout:
+			p.forgetEchoes(pending)
+			return SendQueued, msgids, nil
+		}
+	}
+	return SendSent, msgids, nil
+}
+
+func (p *Proxy) forgetEchoes(echoes []*pendingEcho) {
+	p.Lock()
+	defer p.Unlock()
+	for _, echo := range echoes {
+		for idx, other := range p.echoes {
+			if other == echo {
+				p.echoes = append(p.echoes[:idx], p.echoes[idx+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// matchEcho passes the msgid of a message we sent, echoed back to us by the
+// server, to whoever is waiting for it.
+func (p *Proxy) matchEcho(msg *ircx.Message) {
+	if msg.Prefix == nil {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if len(p.echoes) == 0 || p.isupport.Fold(msg.Prefix.Name) != p.isupport.Fold(p.currentNick) {
+		return
+	}
+	key, ok := echoKey(msg, p.isupport)
+	if !ok {
+		return
+	}
+	for idx, echo := range p.echoes {
+		if echo.key == key {
+			echo.msgid <- msg.Tags["msgid"]
+			p.echoes = append(p.echoes[:idx], p.echoes[idx+1:]...)
+			return
+		}
+	}
+}
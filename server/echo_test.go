@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jnwhiteh/wallops/ircx"
+)
+
+// newPipeProxy returns a registered proxy with the given capabilities
+// enabled, whose connection is one end of a pipe. What it sends can be read
+// from the returned decoder.
+func newPipeProxy(caps ...string) (*Proxy, *ircx.Decoder, net.Conn) {
+	client, server := net.Pipe()
+	isupport := ircx.NewISupport()
+	capabilities := ircx.NewCapabilities(caps, nil)
+	if len(caps) > 0 {
+		ack := ircx.ParseMessage("CAP * ACK :" + strings.Join(caps, " "))
+		capabilities.Handle(ack, ircx.WriterFunc(func(*ircx.Message) error { return nil }))
+	}
+
+	proxy := &Proxy{
+		currentNick: "bot",
+		caps:        capabilities,
+		isupport:    isupport,
+		channels:    ircx.NewChannelSet(nil),
+		state:       ircx.NewState("bot", isupport),
+		events:      newEventLog(10),
+		conn:        client,
+		writer:      &writer{encoder: ircx.NewEncoder(client)},
+		status:      StatusConnected,
+		dead:        make(chan struct{}),
+	}
+	return proxy, ircx.NewDecoder(server), server
+}
+
+// echoFrom reads count messages sent by the proxy and echoes each one back,
+// as a server with echo-message would.
+func echoFrom(proxy *Proxy, decoder *ircx.Decoder, count int) {
+	for idx := 0; idx < count; idx++ {
+		msg, err := decoder.Decode()
+		if err != nil {
+			return
+		}
+		echo := ircx.ParseMessage(":bot!b@host " + msg.Message.String())
+		echo.Tags = ircx.Tags{"msgid": msg.Param(1)}
+		proxy.Process(echo)
+	}
+}
+
+func TestSendWithoutEcho(t *testing.T) {
+	proxy, decoder, server := newPipeProxy()
+	defer server.Close()
+
+	go decoder.Decode()
+	status, msgids, err := proxy.SendAndWait([]*ircx.Message{ircx.ParseMessage("PRIVMSG #chan :hi")})
+	if err != nil || status != SendQueued || len(msgids) != 0 {
+		t.Fatalf("Expected the message to be queued, got %s %v %v", status, msgids, err)
+	}
+}
+
+func TestSendWaitsForEcho(t *testing.T) {
+	proxy, decoder, server := newPipeProxy("echo-message")
+	defer server.Close()
+
+	go echoFrom(proxy, decoder, 2)
+	status, msgids, err := proxy.SendAndWait([]*ircx.Message{
+		ircx.ParseMessage("PRIVMSG #chan :first"),
+		ircx.ParseMessage("PRIVMSG #Chan :second"),
+	})
+	if err != nil || status != SendSent {
+		t.Fatalf("Expected the messages to be sent, got %s %v", status, err)
+	}
+	if len(msgids) != 2 || msgids[0] != "first" || msgids[1] != "second" {
+		t.Fatalf("Incorrect msgids: %v", msgids)
+	}
+	proxy.RLock()
+	defer proxy.RUnlock()
+	if len(proxy.echoes) != 0 {
+		t.Fatalf("Echoes were not cleaned up: %v", proxy.echoes)
+	}
+}
+
+func TestSendEchoTimeout(t *testing.T) {
+	timeout := echoTimeout
+	echoTimeout = 10 * time.Millisecond
+	defer func() { echoTimeout = timeout }()
+
+	proxy, decoder, server := newPipeProxy("echo-message")
+	defer server.Close()
+
+	go decoder.Decode()
+	status, _, err := proxy.SendAndWait([]*ircx.Message{ircx.ParseMessage("PRIVMSG #chan :lost")})
+	if err != nil || status != SendQueued {
+		t.Fatalf("Expected the message to be queued, got %s %v", status, err)
+	}
+	proxy.RLock()
+	defer proxy.RUnlock()
+	if len(proxy.echoes) != 0 {
+		t.Fatalf("Echoes were not cleaned up: %v", proxy.echoes)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/jnwhiteh/wallops/ircx"
+)
+
+// eventBufferSize is how many recent messages are kept for each connection,
+// so that an event stream can resume where it left off after reconnecting.
+var eventBufferSize = 1000
+
+// event is a message received from the server, numbered in the order it
+// arrived.
+type event struct {
+	id      uint64
+	payload MessagePayload // without a token, as it is shared by all tokens
+}
+
+// eventLog keeps the most recent messages received on a connection (at
+// least size of them, and at most twice that) and wakes anyone waiting for
+// new ones.
+type eventLog struct {
+	size   int
+	last   uint64  // the id of the most recent event, ids start at 1
+	events []event // oldest first
+
+	// Closed (and replaced) whenever an event is added
+	added chan struct{}
+
+	sync.Mutex
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{
+		size:  size,
+		added: make(chan struct{}),
+	}
+}
+
+// Add records a message and wakes any waiting streams
+func (l *eventLog) Add(msg *ircx.Message) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.last++
+	l.events = append(l.events, event{l.last, NewMessagePayload("", msg)})
+	if len(l.events) >= 2*l.size {
+		// Trim in bulk so that adding an event stays cheap
+		l.events = append(l.events[:0], l.events[len(l.events)-l.size:]...)
+	}
+
+	close(l.added)
+	l.added = make(chan struct{})
+}
+
+// Since returns the events after the given id, along with a channel that is
+// closed when there are more. If some events after the id have already been
+// discarded complete is false, and the caller has missed messages.
+func (l *eventLog) Since(id uint64) (events []event, added <-chan struct{}, complete bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	complete = true
+	if id > l.last {
+		// An id from before we restarted, or from another connection, so
+		// all we can do is start again from what we have
+		id = 0
+		complete = false
+	} else if len(l.events) > 0 && l.events[0].id > id+1 {
+		complete = false
+	}
+	for idx := range l.events {
+		if l.events[idx].id > id {
+			events = append(events, l.events[idx:]...)
+			break
+		}
+	}
+	return events, l.added, complete
+}
+
+// Last returns the id of the most recent event
+func (l *eventLog) Last() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.last
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jnwhiteh/wallops/ircx"
+)
+
+func TestEventLog(t *testing.T) {
+	events := newEventLog(2)
+	for _, text := range []string{"one", "two", "three", "four"} {
+		events.Add(ircx.ParseMessage(":bob!b@host PRIVMSG #chan :" + text))
+	}
+
+	// Only the last two are guaranteed to be kept
+	since, _, complete := events.Since(2)
+	if !complete || len(since) != 2 || since[0].id != 3 || since[1].payload.Params[1] != "four" {
+		t.Fatalf("Incorrect events since 2: %v %v", since, complete)
+	}
+	if since, _, complete := events.Since(4); !complete || len(since) != 0 {
+		t.Fatalf("Expected no events since the last, got %v %v", since, complete)
+	}
+
+	// An id we've never issued means the client has missed everything
+	if since, _, complete := events.Since(99); complete || len(since) != 2 {
+		t.Fatalf("Expected buffered events for an unknown id, got %v %v", since, complete)
+	}
+
+	events.Add(ircx.ParseMessage(":bob!b@host PRIVMSG #chan :five"))
+	if since, _, complete := events.Since(1); complete || since[0].id != 3 {
+		t.Fatalf("Expected a gap after trimming, got %v %v", since, complete)
+	}
+}
+
+// readEvent reads the fields of the next event from a stream, skipping
+// comments.
+func readEvent(t *testing.T, stream *bufio.Reader) map[string]string {
+	fields := make(map[string]string)
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && len(fields) > 0 {
+			return fields
+		}
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		fields[parts[0]] = parts[1]
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	proxy := &Proxy{events: newEventLog(10)}
+	proxy.events.Add(ircx.ParseMessage(":bob!b@host PRIVMSG #chan :before"))
+	api := ServerAPI{&NoopConnectionPooler{proxy: proxy}}
+	server := httptest.NewServer(http.HandlerFunc(api.HandleEvents))
+	defer server.Close()
+
+	// Resume after the first message, and see the second as it arrives
+	req, _ := http.NewRequest("GET", server.URL+"/events?token=token", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Incorrect content type: %s", resp.Header.Get("Content-Type"))
+	}
+
+	stream := bufio.NewReader(resp.Body)
+	event := readEvent(t, stream)
+	if event["id"] != "1" || event["event"] != "message" || !strings.Contains(event["data"], `"before"`) {
+		t.Fatalf("Incorrect resumed event: %v", event)
+	}
+
+	proxy.events.Add(ircx.ParseMessage(":bob!b@host PRIVMSG #chan :after"))
+	event = readEvent(t, stream)
+	if event["id"] != "2" || !strings.Contains(event["data"], `"after"`) || !strings.Contains(event["data"], `"Token":"token"`) {
+		t.Fatalf("Incorrect live event: %v", event)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jnwhiteh/wallops/history"
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/sorcix/irc"
+)
+
+// messageHistory keeps the text received by every connection, if enabled
+// with -history
+var messageHistory *history.Index
+
+// historyOwner returns the owner of the records archived by a connection.
+// It is derived from what identifies the connection, so that the tokens
+// sharing it (and a connection restored after a restart) see the same
+// records, and no other token does.
+func historyOwner(config ServerConfig) string {
+	key, err := json.Marshal(config.connectionKey())
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// archive adds text from users (including the server's echoes of our own)
+// to the history. It is called from the read loop, which is the only place
+// the nick and server features change, so they can be read without the lock.
+func (p *Proxy) archive(msg *ircx.Message) {
+	if messageHistory == nil || msg.Prefix == nil || !msg.Prefix.IsHostmask() || !isText(msg) {
+		return
+	}
+	when, ok := msg.Time()
+	if !ok {
+		when = time.Now()
+	}
+	p.addHistory(msg, msg.Prefix.Name, when, p.currentNick, p.isupport)
+}
+
+// archiveSent adds text we send to the history, unless the server will echo
+// it back to us for archive to add. It is called from whichever goroutine is
+// sending, so it takes the lock.
+func (p *Proxy) archiveSent(msg *ircx.Message) {
+	if messageHistory == nil || !isText(msg) {
+		return
+	}
+	p.RLock()
+	nick, caps, isupport := p.currentNick, p.caps, p.isupport
+	p.RUnlock()
+	if isupport == nil || (caps != nil && caps.Enabled("echo-message")) {
+		return
+	}
+	p.addHistory(msg, nick, time.Now(), nick, isupport)
+}
+
+// addHistory adds text sent by nick to the history. Private messages to us,
+// where the target is self, are filed under the sender.
+func (p *Proxy) addHistory(msg *ircx.Message, nick string, when time.Time, self string, isupport *ircx.ISupport) {
+	network := isupport.Network()
+	if network == "" {
+		network = p.config.Host
+	}
+	channel := msg.Params[0]
+	if isupport.Fold(channel) == isupport.Fold(self) {
+		channel = nick
+	}
+
+	_, err := messageHistory.Add(history.Record{
+		Time:    when,
+		Owner:   p.owner,
+		Network: network,
+		Channel: channel,
+		Nick:    nick,
+		Command: msg.Command,
+		Text:    msg.Trailing,
+	})
+	if err != nil {
+		log.Printf("Failed to add to the history: %s", err)
+	}
+}
+
+// HandleHistorySearch searches the history of the connection a token uses.
+// The q, network, channel, nick, since and until parameters select messages,
+// and limit and before page through them, newest first.
+func (a *ServerAPI) HandleHistorySearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if messageHistory == nil {
+		jsonError(w, r, http.StatusNotFound, "History is not enabled")
+		return
+	}
+
+	params := r.URL.Query()
+	payload := TokenRequest{Token: params.Get("token")}
+	if !payload.Valid() {
+		log.Printf("Invalid request payload: %v", payload)
+		jsonError(w, r, http.StatusBadRequest, "Bad request")
+		return
+	}
+	proxy, err := a.pool.Lookup(payload.Token)
+	if err != nil {
+		jsonError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+
+	query := history.Query{
+		Owner:   proxy.owner,
+		Network: params.Get("network"),
+		Channel: params.Get("channel"),
+		Nick:    params.Get("nick"),
+		Text:    params.Get("q"),
+	}
+	now := time.Now()
+	for name, into := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := params.Get(name); value != "" {
+			*into, err = history.ParseTime(value, now)
+			if err != nil {
+				log.Printf("Invalid history search: %s", err)
+				jsonError(w, r, http.StatusBadRequest, "Bad request")
+				return
+			}
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		query.Limit, err = strconv.Atoi(value)
+		if err != nil || query.Limit < 1 {
+			jsonError(w, r, http.StatusBadRequest, "Bad request")
+			return
+		}
+	}
+	if value := params.Get("before"); value != "" {
+		query.Before, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			jsonError(w, r, http.StatusBadRequest, "Bad request")
+			return
+		}
+	}
+
+	page, err := messageHistory.Search(query)
+	if err != nil {
+		log.Printf("Failed to search the history: %s", err)
+		jsonError(w, r, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	response := HistoryResponse{
+		Success: true,
+		Records: append([]history.Record{}, page.Records...),
+		Next:    page.Next,
+	}
+	JSON(w, r, 200, response)
+}
+
+// isText reports whether a message is a PRIVMSG or NOTICE to a single target
+func isText(msg *ircx.Message) bool {
+	return (msg.Command == irc.PRIVMSG || msg.Command == irc.NOTICE) &&
+		len(msg.Params) == 1
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/jnwhiteh/wallops/history"
+	"github.com/jnwhiteh/wallops/ircx"
+)
+
+func TestHistorySearch(t *testing.T) {
+	pool := &NoopConnectionPooler{}
+	api := ServerAPI{pool}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost/history/search?token=token&q=deploy", nil)
+	api.HandleHistorySearch(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected not found without a history, got %d", w.Code)
+	}
+
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	messageHistory, err = history.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		messageHistory.Close()
+		messageHistory = nil
+	}()
+
+	isupport := ircx.NewISupport()
+	isupport.Handle(ircx.ParseMessage(":server 005 bot NETWORK=Example :are supported"))
+	config := ServerConfig{Host: "irc.example.net"}
+	proxy := &Proxy{config: config, owner: historyOwner(config), currentNick: "bot", isupport: isupport}
+	pool.proxy = proxy
+	for _, line := range []string{
+		"@time=2020-01-01T12:00:00.000Z :alice!a@example.net PRIVMSG #wallops :the deploy is broken",
+		"@time=2020-01-02T12:00:00.000Z :Bob!b@example.net PRIVMSG bot :is the deploy fixed?",
+		"@time=2020-01-03T12:00:00.000Z :alice!a@example.net PRIVMSG #wallops :deploy fixed",
+		":irc.example.net NOTICE bot :deploy notice from the server",
+		":alice!a@example.net JOIN #wallops",
+	} {
+		proxy.archive(ircx.ParseMessage(line))
+	}
+	// Text we send is archived too, unless the server will echo it
+	proxy.archiveSent(ircx.ParseMessage("PRIVMSG #wallops :thanks alice"))
+	proxy.caps = ircx.NewCapabilities([]string{"echo-message"}, nil)
+	proxy.caps.Handle(ircx.ParseMessage("CAP * ACK :echo-message"), ircx.WriterFunc(func(*ircx.Message) error { return nil }))
+	proxy.archiveSent(ircx.ParseMessage("PRIVMSG #wallops :thanks again alice"))
+
+	// Another connection to the same network, which the token doesn't use
+	other := ServerConfig{Host: "irc.example.net", Nickname: "someone"}
+	stranger := &Proxy{config: other, owner: historyOwner(other), currentNick: "someone", isupport: isupport}
+	stranger.archive(ircx.ParseMessage(":carol!c@example.net PRIVMSG someone :the deploy password is hunter2"))
+
+	search := func(query string) HistoryResponse {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost/history/search?token=token&"+query, nil)
+		api.HandleHistorySearch(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got unexpected status code %d", query, w.Code)
+		}
+		var response HistoryResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode response: %s", err)
+		}
+		return response
+	}
+
+	response := search("q=deploy&network=example&limit=2")
+	if len(response.Records) != 2 || response.Records[0].Text != "deploy fixed" || response.Next != 2 {
+		t.Fatalf("Unexpected first page %+v", response)
+	}
+	if query := response.Records[1]; query.Channel != "Bob" || query.Nick != "Bob" {
+		t.Errorf("Private message was archived as %+v", query)
+	}
+	response = search("q=deploy&limit=2&before=2")
+	if len(response.Records) != 1 || response.Records[0].Text != "the deploy is broken" || response.Next != 0 {
+		t.Errorf("Unexpected second page %+v", response)
+	}
+	response = search("channel=%23wallops&nick=alice&since=2020-01-02T00:00:00Z")
+	if len(response.Records) != 1 || response.Records[0].Text != "deploy fixed" {
+		t.Errorf("Unexpected filtered results %+v", response)
+	}
+	response = search("q=thanks")
+	if len(response.Records) != 1 || response.Records[0].Nick != "bot" || response.Records[0].Channel != "#wallops" {
+		t.Errorf("Unexpected sent messages %+v", response)
+	}
+	if response = search("q=missing"); response.Records == nil || len(response.Records) != 0 {
+		t.Errorf("Expected an empty list, got %+v", response)
+	}
+	if response = search("q=hunter2"); len(response.Records) != 0 {
+		t.Errorf("Found another connection's messages %+v", response)
+	}
+
+	for query, code := range map[string]int{
+		"q=deploy":                    http.StatusBadRequest,
+		"token=unknown&q=deploy":      http.StatusNotFound,
+		"token=token&since=yesterday": http.StatusBadRequest,
+		"token=token&limit=0":         http.StatusBadRequest,
+		"token=token&before=-1":       http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost/history/search?"+query, nil)
+		api.HandleHistorySearch(w, r)
+		if w.Code != code {
+			t.Errorf("%s: expected %d, got %d", query, code, w.Code)
+		}
+	}
+}
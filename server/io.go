@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"log"
 
-	"github.com/sorcix/irc"
+	"github.com/jnwhiteh/wallops/ircx"
 )
 
 var (
@@ -14,14 +14,14 @@ var (
 // messageReader provides an interface that makes it easy to mock connections
 // for testing purposes
 type messageReader interface {
-	ReadMessage() (*irc.Message, error)
+	ReadMessage() (*ircx.Message, error)
 }
 
 type messageWriter interface {
-	WriteMessage(*irc.Message) error
+	WriteMessage(*ircx.Message) error
 }
 
-// safeReader fixes the semantics of the irc package to ensure we can properly
+// safeReader fixes the semantics of the ircx decoder to ensure we can properly
 // handle error and invalid messages.
 //
 // The decoder will ONLY return an error if the underlying bufio.Reader
@@ -29,11 +29,11 @@ type messageWriter interface {
 // message, which obviously cannot be used. These cases are converted into a
 // parseError return.
 type safeReader struct {
-	decoder   *irc.Decoder
+	decoder   *ircx.Decoder
 	formatter func(msg interface{}) string
 }
 
-func (r *safeReader) ReadMessage() (*irc.Message, error) {
+func (r *safeReader) ReadMessage() (*ircx.Message, error) {
 	msg, err := r.decoder.Decode()
 	if err != nil {
 		return nil, err
@@ -41,19 +41,19 @@ func (r *safeReader) ReadMessage() (*irc.Message, error) {
 	if msg == nil {
 		return nil, parseError
 	}
-	if r.formatter != nil {
+	if r.formatter != nil && live.Debug() {
 		log.Print(r.formatter(msg))
 	}
 	return msg, err
 }
 
 type writer struct {
-	encoder   *irc.Encoder
+	encoder   *ircx.Encoder
 	formatter func(msg interface{}) string
 }
 
-func (w *writer) WriteMessage(msg *irc.Message) error {
-	if w.formatter != nil {
+func (w *writer) WriteMessage(msg *ircx.Message) error {
+	if w.formatter != nil && live.Debug() {
 		log.Println(w.formatter(msg))
 	}
 	return w.encoder.Encode(msg)
@@ -2,10 +2,43 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/jnwhiteh/wallops/history"
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/sorcix/irc"
+)
+
+var (
+	configPath *string = flag.String("config", "", "A YAML configuration file; flags given on the command line override it")
+	listenAddr *string = flag.String("listen", DefaultFileConfig().Listen, "The address to serve the API on")
+	statePath  *string = flag.String("state", DefaultFileConfig().State, "File in which to save tokens and connections across restarts, or empty to not save them")
+	historyDir *string = flag.String("history", "", "A directory in which to keep a searchable history of the messages received, or empty to not keep one")
+
+	deadlineTimeout *time.Duration = flag.Duration("proxy-timeout", DefaultFileConfig().Timeouts.Proxy, "The read and write deadline for IRC connections")
+	pongWait        *time.Duration = flag.Duration("pong-timeout", DefaultFileConfig().Timeouts.Pong, "How long to wait for a server to answer a PING")
+	missedDeadlines *int           = flag.Int("missed-deadlines", DefaultFileConfig().Timeouts.MissedDeadlines, "Quiet read deadlines before a server is sent a PING")
+
+	logLevel *string = flag.String("log-level", "debug", "debug to log every message sent and received, or info")
+)
+
+var (
+	// saveInterval is how often the pool is saved, to keep channels current
+	saveInterval = 30 * time.Second
+
+	eventsHeartbeat    = 15 * time.Second // how often idle streams get a comment
+	eventsWriteTimeout = 10 * time.Second // how long a write to a stream may take
 )
 
 type ServerAPI struct {
@@ -18,7 +51,7 @@ type ServerAPI struct {
 func (a *ServerAPI) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	var payload RegisterRequest
 	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		jsonError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
@@ -27,81 +60,465 @@ func (a *ServerAPI) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	err := json.Unmarshal(body, &payload)
 	if err != nil {
 		log.Printf("Failed to decode request payload: %s", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		jsonError(w, r, http.StatusBadRequest, "Bad request")
 		return
 	}
 
 	// Make sure we don't allow the zero value through
 	if !payload.Valid() {
 		log.Printf("Invalid request payload: %v", payload)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		jsonError(w, r, http.StatusBadRequest, "Bad request")
 		return
 	}
 
-	token, err := a.pool.Connect(payload.Config)
+	token, secret, err := a.pool.Connect(payload.Config)
 	if err != nil {
 		log.Printf("Failed to connect: %s", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		jsonError(w, r, http.StatusInternalServerError, "Internal server error")
 		return
 	}
 
 	response := RegisterResponse{
 		Success: true,
 		Token:   token,
+		Secret:  secret,
 	}
 	JSON(w, r, 200, response)
 }
 
-// HandleShutdown is the HTTP handler to shut down an existing server
+// HandleUnregister is the HTTP handler to shut down an existing server
 // connection
 func (a *ServerAPI) HandleUnregister(w http.ResponseWriter, r *http.Request) {
 	var payload TokenRequest
+	if !decodeRequest(w, r, &payload) {
+		return
+	}
+	a.unregister(w, r, payload.Token)
+}
 
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// unregister removes a token, closing its connection if no other token is
+// using it.
+func (a *ServerAPI) unregister(w http.ResponseWriter, r *http.Request, token string) {
+	err := a.pool.Unregister(token)
+	if err == invalidTokenError {
+		jsonError(w, r, http.StatusNotFound, "Not found")
+		return
+	} else if err != nil {
+		log.Printf("Failed to unregister: %s", err)
+		jsonError(w, r, http.StatusInternalServerError, "Internal server error")
 		return
 	}
+	JSON(w, r, 200, ErrorResponse{Success: true})
+}
 
-	// Decode the payload
-	body, _ := ioutil.ReadAll(r.Body)
-	err := json.Unmarshal(body, &payload)
+// HandleToken handles /tokens/{token}. GET describes the token and its
+// connection, and DELETE unregisters it. Channels the connection is in are
+// described under /tokens/{token}/channels/{name}.
+func (a *ServerAPI) HandleToken(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/tokens/")
+	if i := strings.Index(path, "/channels/"); i >= 0 {
+		a.handleChannel(w, r, path[:i], path[i+len("/channels/"):])
+		return
+	}
+	payload := TokenRequest{Token: path}
+	if !payload.Valid() || strings.Contains(payload.Token, "/") {
+		jsonError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		proxy, err := a.pool.Lookup(payload.Token)
+		if err != nil {
+			jsonError(w, r, http.StatusNotFound, "Not found")
+			return
+		}
+		response := TokenResponse{
+			Success:          true,
+			Token:            payload.Token,
+			ConnectionStatus: proxy.Info(),
+		}
+		JSON(w, r, 200, response)
+	case "DELETE":
+		a.unregister(w, r, payload.Token)
+	default:
+		jsonError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleChannel handles /tokens/{token}/channels/{name}, which describes a
+// channel the token's connection is in. The # of the name must be escaped
+// as %23.
+func (a *ServerAPI) handleChannel(w http.ResponseWriter, r *http.Request, token, name string) {
+	if r.Method != "GET" {
+		jsonError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	payload := TokenRequest{Token: token}
+	if !payload.Valid() || strings.Contains(payload.Token, "/") || name == "" {
+		jsonError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+
+	proxy, err := a.pool.Lookup(payload.Token)
 	if err != nil {
-		log.Printf("Failed to decode request payload: %s", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		jsonError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	info, ok := proxy.Channel(name)
+	if !ok {
+		jsonError(w, r, http.StatusNotFound, "Not found")
 		return
 	}
+	JSON(w, r, 200, ChannelResponse{Success: true, ChannelInfo: info})
+}
 
-	// Make sure we don't allow the zero value through
+// HandleConnections lists every pooled connection, for administrators. It
+// doesn't reveal the tokens using each connection, only how many there are.
+func (a *ServerAPI) HandleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	response := ConnectionsResponse{
+		Success:     true,
+		Connections: []ConnectionStatus{},
+	}
+	for _, proxy := range a.pool.Connections() {
+		response.Connections = append(response.Connections, proxy.Info())
+	}
+	sort.Slice(response.Connections, func(i, j int) bool {
+		return response.Connections[i].Server < response.Connections[j].Server
+	})
+	JSON(w, r, 200, response)
+}
+
+// HandleISupport returns the features advertised by the server that the
+// given token is connected to.
+func (a *ServerAPI) HandleISupport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	payload := TokenRequest{Token: r.URL.Query().Get("token")}
 	if !payload.Valid() {
 		log.Printf("Invalid request payload: %v", payload)
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		jsonError(w, r, http.StatusBadRequest, "Bad request")
 		return
 	}
 
-	err = a.pool.Unregister(payload.Token)
-	success := err != nil
-	response := ErrorResponse{
-		Success: success,
-		Error:   err.Error(),
+	proxy, err := a.pool.Lookup(payload.Token)
+	if err != nil {
+		jsonError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+
+	if status, err := proxy.Status(); status == StatusDead {
+		log.Printf("Connection for token is dead: %s", err)
+		jsonError(w, r, http.StatusServiceUnavailable, "Connection is dead")
+		return
+	}
+
+	isupport := proxy.ISupport()
+	modes, symbols := isupport.Prefix()
+	response := ISupportResponse{
+		Success:       true,
+		Network:       isupport.Network(),
+		NickLen:       isupport.NickLen(),
+		ChanTypes:     isupport.ChanTypes(),
+		PrefixModes:   modes,
+		PrefixSymbols: symbols,
+		ChanModes:     isupport.ChanModes(),
+		CaseMapping:   isupport.CaseMapping(),
+		TargMax:       isupport.TargMax(),
+		Tokens:        isupport.Tokens(),
 	}
 	JSON(w, r, 200, response)
 }
 
+// HandleWebhook reports how delivery to the MessageUrl registered with the
+// given token is going, including the most recent delivery failures.
+func (a *ServerAPI) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	payload := TokenRequest{Token: r.URL.Query().Get("token")}
+	if !payload.Valid() {
+		log.Printf("Invalid request payload: %v", payload)
+		jsonError(w, r, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	proxy, err := a.pool.Lookup(payload.Token)
+	if err != nil {
+		jsonError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+
+	response, ok := proxy.Webhook(payload.Token)
+	if !ok {
+		jsonError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	JSON(w, r, 200, response)
+}
+
+// HandleSend sends a raw message to the server that the given token is
+// connected to.
+func (a *ServerAPI) HandleSend(w http.ResponseWriter, r *http.Request) {
+	var payload SendRequest
+	if !decodeRequest(w, r, &payload) {
+		return
+	}
+	a.send(w, r, payload.Token, func(proxy *Proxy) ([]*ircx.Message, error) {
+		return []*ircx.Message{payload.Message()}, nil
+	})
+}
+
+// HandlePrivmsg sends text to a channel or user, splitting it into as many
+// messages as needed to fit the server's line length.
+func (a *ServerAPI) HandlePrivmsg(w http.ResponseWriter, r *http.Request) {
+	var payload PrivmsgRequest
+	if !decodeRequest(w, r, &payload) {
+		return
+	}
+	command := irc.PRIVMSG
+	if payload.Notice {
+		command = irc.NOTICE
+	}
+	a.send(w, r, payload.Token, func(proxy *Proxy) ([]*ircx.Message, error) {
+		return proxy.TextMessages(command, payload.Target, payload.Text)
+	})
+}
+
+// send writes the messages built for a token's connection and reports
+// whether the server confirmed them.
+func (a *ServerAPI) send(w http.ResponseWriter, r *http.Request, token string, build func(*Proxy) ([]*ircx.Message, error)) {
+	proxy, err := a.pool.Lookup(token)
+	if err != nil {
+		jsonError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	if status, err := proxy.Status(); status == StatusDead {
+		log.Printf("Connection for token is dead: %s", err)
+		jsonError(w, r, http.StatusServiceUnavailable, "Connection is dead")
+		return
+	}
+
+	msgs, err := build(proxy)
+	if err != nil {
+		jsonError(w, r, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	status, msgids, err := proxy.SendAndWait(msgs)
+	if err == ircx.QueueFullError || err == ircx.QueueClosedError {
+		jsonError(w, r, http.StatusServiceUnavailable, "Too many messages waiting to be sent")
+		return
+	} else if err != nil {
+		log.Printf("Failed to send message: %s", err)
+		jsonError(w, r, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+
+	response := SendResponse{
+		Success: true,
+		Status:  status,
+		MsgIds:  msgids,
+	}
+	JSON(w, r, 200, response)
+}
+
+// HandleEvents streams the messages received by the connection that the
+// given token is connected to as Server-Sent Events. A client reconnecting
+// with Last-Event-ID resumes from the messages it missed, as long as they are
+// still buffered. If they aren't, a "reset" event is sent first.
+func (a *ServerAPI) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	payload := TokenRequest{Token: r.URL.Query().Get("token")}
+	if !payload.Valid() {
+		log.Printf("Invalid request payload: %v", payload)
+		jsonError(w, r, http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	proxy, err := a.pool.Lookup(payload.Token)
+	if err != nil {
+		jsonError(w, r, http.StatusNotFound, "Not found")
+		return
+	}
+	if status, err := proxy.Status(); status == StatusDead {
+		log.Printf("Connection for token is dead: %s", err)
+		jsonError(w, r, http.StatusServiceUnavailable, "Connection is dead")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jsonError(w, r, http.StatusInternalServerError, "Streaming not supported")
+		return
+	}
+
+	// Start from the most recent message unless we're resuming
+	last := proxy.events.Last()
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		last, err = strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			jsonError(w, r, http.StatusBadRequest, "Bad request")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// The server's WriteTimeout would end the stream, so each write gets its
+	// own deadline instead
+	controller := http.NewResponseController(w)
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		controller.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+		events, added, complete := proxy.events.Since(last)
+		if !complete {
+			// The client missed some messages, either while it was away
+			// or by falling too far behind, and needs to know
+			fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+			last = 0
+		}
+
+		for _, event := range events {
+			event.payload.Token = payload.Token
+			data, err := json.Marshal(event.payload)
+			if err != nil {
+				log.Printf("Failed to encode event: %s", err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", event.id, data)
+			if err != nil {
+				return
+			}
+			last = event.id
+		}
+		flusher.Flush()
+
+		select {
+		case <-added:
+		case <-heartbeat.C:
+			controller.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-proxy.Dead():
+			fmt.Fprint(w, "event: dead\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// decodeRequest decodes and validates the JSON body of a POST request,
+// responding with an error and returning false if it can't be used.
+func decodeRequest(w http.ResponseWriter, r *http.Request, payload interface {
+	Valid() bool
+}) bool {
+	if r.Method != "POST" {
+		jsonError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return false
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	err := json.Unmarshal(body, payload)
+	if err != nil {
+		log.Printf("Failed to decode request payload: %s", err)
+		jsonError(w, r, http.StatusBadRequest, "Bad request")
+		return false
+	}
+
+	// Make sure we don't allow the zero value through
+	if !payload.Valid() {
+		log.Printf("Invalid request payload: %v", payload)
+		jsonError(w, r, http.StatusBadRequest, "Bad request")
+		return false
+	}
+	return true
+}
+
 func main() {
+	flag.Parse()
+	fileConfig, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+	live.Update(fileConfig.Timeouts, fileConfig.Log.Level)
+	go reloadOnHangup(fileConfig)
+
 	muxer := http.NewServeMux()
 	server := &http.Server{
-		Addr:           "localhost:9667",
+		Addr:           fileConfig.Listen,
 		Handler:        muxer,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
+		ReadTimeout:    fileConfig.HTTP.ReadTimeout,
+		WriteTimeout:   fileConfig.HTTP.WriteTimeout,
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	pool := NewConnectionPool()
+	if fileConfig.State != "" {
+		pool, err = NewPersistentConnectionPool(NewStore(fileConfig.State), saveInterval)
+		if err != nil {
+			log.Fatalf("Failed to restore state from %s: %s", fileConfig.State, err)
+		}
+	}
+
+	// Save once more on the way out, so we have the latest channels
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		pool.Save()
+		os.Exit(0)
+	}()
+
+	if fileConfig.History != "" {
+		messageHistory, err = history.Open(fileConfig.History)
+		if err != nil {
+			log.Fatalf("Failed to open the history in %s: %s", fileConfig.History, err)
+		}
+	}
+
+	registerPoolMetrics(registry, pool)
+
 	api := &ServerAPI{
-		pool: NewConnectionPool(),
+		pool: pool,
 	}
 
-	muxer.HandleFunc("/register", api.HandleRegister)
+	muxer.HandleFunc("/register", instrument("/register", api.HandleRegister))
+	muxer.HandleFunc("/unregister", instrument("/unregister", api.HandleUnregister))
+	muxer.HandleFunc("/tokens/", instrument("/tokens/", api.HandleToken))
+	muxer.HandleFunc("/connections", instrument("/connections", api.HandleConnections))
+	muxer.HandleFunc("/isupport", instrument("/isupport", api.HandleISupport))
+	muxer.HandleFunc("/webhook", instrument("/webhook", api.HandleWebhook))
+	muxer.HandleFunc("/send", instrument("/send", api.HandleSend))
+	muxer.HandleFunc("/privmsg", instrument("/privmsg", api.HandlePrivmsg))
+	muxer.HandleFunc("/events", instrument("/events", api.HandleEvents))
+	muxer.HandleFunc("/ws", instrument("/ws", api.HandleWebSocket))
+	muxer.HandleFunc("/history/search", instrument("/history/search", api.HandleHistorySearch))
+	muxer.Handle("/metrics", registry)
 
 	log.Printf("Listening on http://%s/", server.Addr)
 	log.Fatalln(server.ListenAndServe())
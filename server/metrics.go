@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jnwhiteh/wallops/metrics"
+)
+
+// registry holds the metrics served at /metrics
+var registry = metrics.NewRegistry()
+
+var hijackError = fmt.Errorf("ResponseWriter does not support hijacking")
+
+var (
+	reconnectAttempts = registry.NewCounter("wallops_reconnect_attempts_total",
+		"Attempts to reconnect to an IRC server, by outcome (succeeded or failed)", "outcome")
+	reconnectsAbandoned = registry.NewCounter("wallops_reconnects_abandoned_total",
+		"Connections given up on, because the reconnect policy ran out or the server rejected us")
+
+	webhookLatency = registry.NewHistogram("wallops_webhook_request_duration_seconds",
+		"Time taken by each POST to a MessageUrl, by outcome (ok or error)", nil, "outcome")
+	webhookDeliveries = registry.NewCounter("wallops_webhook_deliveries_total",
+		"Messages handed to webhooks, by outcome (delivered, failed or dropped)", "outcome")
+
+	httpRequests = registry.NewCounter("wallops_http_requests_total",
+		"HTTP requests served, by handler and status code", "handler", "code")
+	httpLatency = registry.NewHistogram("wallops_http_request_duration_seconds",
+		"Time taken to serve HTTP requests, by handler. Event streams and WebSockets are timed until they close.", nil, "handler")
+)
+
+// registerPoolMetrics adds the metrics that describe each connection in the
+// pool. They are read from the connections whenever the metrics are served.
+func registerPoolMetrics(registry *metrics.Registry, pool connectionPooler) {
+	labels := []string{"server", "nick"}
+	each := func(f func(p *Proxy, info ConnectionStatus, labels ...string)) {
+		for _, proxy := range pool.Connections() {
+			info := proxy.Info()
+			f(proxy, info, info.Server, proxy.config.Nickname)
+		}
+	}
+
+	registry.NewCollector("wallops_connections", "Connections in the pool, by status",
+		metrics.GaugeKind, []string{"status"}, func(emit func(float64, ...string)) {
+			counts := map[string]int{StatusConnected: 0, StatusReconnecting: 0, StatusDead: 0}
+			for _, proxy := range pool.Connections() {
+				status, _ := proxy.Status()
+				counts[status]++
+			}
+			for status, count := range counts {
+				emit(float64(count), status)
+			}
+		})
+	registry.NewCollector("wallops_connection_tokens", "Tokens registered with each connection",
+		metrics.GaugeKind, labels, func(emit func(float64, ...string)) {
+			each(func(p *Proxy, info ConnectionStatus, labels ...string) {
+				emit(float64(info.Tokens), labels...)
+			})
+		})
+	registry.NewCollector("wallops_connection_messages_received_total", "Messages received from the server by each connection",
+		metrics.CounterKind, labels, func(emit func(float64, ...string)) {
+			each(func(p *Proxy, info ConnectionStatus, labels ...string) {
+				emit(float64(p.received.Load()), labels...)
+			})
+		})
+	registry.NewCollector("wallops_connection_messages_sent_total", "Messages sent to the server by each connection",
+		metrics.CounterKind, labels, func(emit func(float64, ...string)) {
+			each(func(p *Proxy, info ConnectionStatus, labels ...string) {
+				emit(float64(p.sent.Load()), labels...)
+			})
+		})
+	registry.NewCollector("wallops_connection_missed_deadlines_total", "Read deadlines each connection has missed while the server was quiet",
+		metrics.CounterKind, labels, func(emit func(float64, ...string)) {
+			each(func(p *Proxy, info ConnectionStatus, labels ...string) {
+				emit(float64(p.missedDeadlines.Load()), labels...)
+			})
+		})
+	registry.NewCollector("wallops_connection_lag_seconds", "The round trip time of each connection's last lag PING",
+		metrics.GaugeKind, labels, func(emit func(float64, ...string)) {
+			each(func(p *Proxy, info ConnectionStatus, labels ...string) {
+				emit(float64(info.LagMs)/1000, labels...)
+			})
+		})
+}
+
+// instrument counts and times the requests served by a handler
+func instrument(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		handler(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.Inc(name, strconv.Itoa(status))
+		httpLatency.Observe(time.Since(start).Seconds(), name)
+	}
+}
+
+// statusRecorder remembers the status code written by a handler. It passes
+// on flushing, for event streams, and hijacking, for WebSockets.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, hijackError
+	}
+	// The handler takes over the connection, so this is the last we'll
+	// know of its status
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jnwhiteh/wallops/metrics"
+)
+
+func TestPoolMetrics(t *testing.T) {
+	p := newTestPool(&countingDialer{})
+	for i := 0; i < 2; i++ {
+		if _, _, err := p.Connect(poolConfig); err != nil {
+			t.Fatalf("Connect failed: %s", err)
+		}
+	}
+	proxy := p.Connections()[0]
+	proxy.received.Add(3)
+	proxy.sent.Add(2)
+
+	registry := metrics.NewRegistry()
+	registerPoolMetrics(registry, p)
+	var buf bytes.Buffer
+	registry.WriteTo(&buf)
+
+	for _, expected := range []string{
+		`wallops_connections{status="connected"} 1`,
+		`wallops_connections{status="dead"} 0`,
+		`wallops_connection_tokens{server="localhost:6667",nick="bot"} 2`,
+		`wallops_connection_messages_received_total{server="localhost:6667",nick="bot"} 3`,
+		`wallops_connection_messages_sent_total{server="localhost:6667",nick="bot"} 2`,
+	} {
+		if !strings.Contains(buf.String(), expected+"\n") {
+			t.Errorf("Expected %s in:\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	handler := instrument("/test-instrument", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			jsonError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+
+	if count := httpRequests.Value("/test-instrument", "200"); count != 2 {
+		t.Errorf("Counted %v OK requests, expected 2", count)
+	}
+	if count := httpRequests.Value("/test-instrument", "405"); count != 1 {
+		t.Errorf("Counted %v rejected requests, expected 1", count)
+	}
+	if count := httpLatency.Count("/test-instrument"); count != 3 {
+		t.Errorf("Timed %d requests, expected 3", count)
+	}
+}
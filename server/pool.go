@@ -2,7 +2,12 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/jnwhiteh/wallops/ircx"
 )
 
 var (
@@ -11,63 +16,302 @@ var (
 )
 
 type connectionPooler interface {
-	Connect(config ServerConfig) (string, error)
+	Connect(config ServerConfig) (token, secret string, err error)
 	Unregister(token string) error
+	Lookup(token string) (*Proxy, error)
+	Connections() []*Proxy
+	Save() error
+}
+
+// poolEntry is a connection shared by every token registered with the same
+// server configuration.
+type poolEntry struct {
+	key    ServerConfig
+	proxy  *Proxy
+	tokens map[string]StoredToken
+
+	// Closed once the connection has been made (or has failed), so that
+	// registrations racing the first one wait for it rather than dialing
+	ready chan struct{}
+	err   error
 }
 
 type pool struct {
 	// A map from server configuration to connection
-	conns map[ServerConfig]*Proxy
+	conns map[ServerConfig]*poolEntry
 
 	// A map from token to connection
-	tokenMap map[string]*Proxy
+	tokenMap map[string]*poolEntry
+
+	// Make new connections, and restore saved ones, replaced in tests
+	dial    func(config ServerConfig) (*Proxy, error)
+	restore func(config ServerConfig, channels []ircx.Channel) *Proxy
+
+	// Where the pool is saved, if anywhere
+	store *Store
 
 	sync.RWMutex
 }
 
 func NewConnectionPool() connectionPooler {
+	return newPool()
+}
+
+func newPool() *pool {
 	return &pool{
-		conns:    make(map[ServerConfig]*Proxy),
-		tokenMap: make(map[string]*Proxy),
+		conns:    make(map[ServerConfig]*poolEntry),
+		tokenMap: make(map[string]*poolEntry),
+		dial:     dialProxy,
+		restore:  RestoreConnection,
+	}
+}
+
+// NewPersistentConnectionPool creates a pool that is saved to the store
+// whenever a token is registered or unregistered, and every interval so that
+// the channels each connection is in are kept up to date. Any connections
+// already in the store are restored.
+func NewPersistentConnectionPool(store *Store, interval time.Duration) (connectionPooler, error) {
+	p := newPool()
+	err := p.load(store)
+	if err != nil {
+		return nil, err
+	}
+	go p.saveEvery(interval)
+	return p, nil
+}
+
+// load restores the connections saved in the store, and then keeps it up to
+// date.
+func (p *pool) load(store *Store) error {
+	state, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, saved := range state.Connections {
+		log.Printf("Restoring connection to %s for %d tokens", saved.Config.Host, len(saved.Tokens))
+		entry := &poolEntry{
+			key:    saved.Config.connectionKey(),
+			proxy:  p.restore(saved.Config.connectionKey(), saved.Channels),
+			tokens: make(map[string]StoredToken),
+			ready:  make(chan struct{}),
+		}
+		close(entry.ready)
+		for _, token := range saved.Tokens {
+			entry.tokens[token.Token] = token
+			entry.proxy.AddWebhook(token.Token, token.MessageUrl, token.Secret)
+			p.tokenMap[token.Token] = entry
+		}
+		p.conns[entry.key] = entry
+		go p.forgetWhenDead(entry)
+	}
+
+	p.store = store
+	return p.Save()
+}
+
+// Snapshot returns the state of the pool, to be saved
+func (p *pool) Snapshot() *PoolState {
+	p.RLock()
+	defer p.RUnlock()
+
+	state := &PoolState{Version: storeVersion}
+	seen := make(map[*poolEntry]bool)
+	for _, entry := range p.tokenMap {
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+
+		saved := StoredConnection{
+			Config:   entry.key,
+			Channels: entry.proxy.channels.List(),
+		}
+		for _, token := range entry.tokens {
+			saved.Tokens = append(saved.Tokens, token)
+		}
+		sort.Slice(saved.Tokens, func(i, j int) bool {
+			return saved.Tokens[i].Token < saved.Tokens[j].Token
+		})
+		state.Connections = append(state.Connections, saved)
+	}
+
+	// Keep the file stable so that it diffs nicely
+	sort.Slice(state.Connections, func(i, j int) bool {
+		return state.Connections[i].Tokens[0].Token < state.Connections[j].Tokens[0].Token
+	})
+	return state
+}
+
+// Save writes the state of the pool to its store, if it has one
+func (p *pool) Save() error {
+	if p.store == nil {
+		return nil
+	}
+	err := p.store.Save(p.Snapshot())
+	if err != nil {
+		log.Printf("Failed to save pool: %s", err)
+	}
+	return err
+}
+
+func (p *pool) saveEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		p.Save()
 	}
 }
 
+// dialProxy connects to a server and starts processing its messages
+func dialProxy(config ServerConfig) (*Proxy, error) {
+	proxy, err := NewConnection(config)
+	if err != nil {
+		return nil, err
+	}
+	go proxy.Run()
+	return proxy, nil
+}
+
+// connectionKey returns the part of a configuration that identifies its
+// connection. Registrations that differ only in who they are and where
+// their messages go share a connection.
+func (c ServerConfig) connectionKey() ServerConfig {
+	c.AppName = ""
+	c.MessageUrl = ""
+	return c
+}
+
+// Unregister removes a token. When the last token for a connection goes
+// away the connection is closed.
 func (p *pool) Unregister(token string) error {
 	p.Lock()
+	entry, ok := p.tokenMap[token]
+	if !ok {
+		p.Unlock()
+		return invalidTokenError
+	}
 	delete(p.tokenMap, token)
+	delete(entry.tokens, token)
+	last := len(entry.tokens) == 0
+	if last && p.conns[entry.key] == entry {
+		delete(p.conns, entry.key)
+	}
 	p.Unlock()
 
+	entry.proxy.RemoveWebhook(token)
+	if last {
+		entry.proxy.Close(quitMessage)
+	}
+	p.Save()
 	return nil
 }
 
-// Connect will connect to a server based on configuration or re-use an
-// existing open connection. If successful, a token that can be used to
-// communicate with the connection is returned.
-func (p *pool) Connect(config ServerConfig) (string, error) {
-	p.Lock()
-	conn, ok := p.conns[config]
-	p.Unlock()
+// Lookup returns the connection for a token
+func (p *pool) Lookup(token string) (*Proxy, error) {
+	p.RLock()
+	entry, ok := p.tokenMap[token]
+	p.RUnlock()
 
-	if ok && conn != nil {
-		token, err := generateToken()
-		p.tokenMap[token] = conn
-		return token, err
+	if !ok {
+		return nil, invalidTokenError
 	}
+	return entry.proxy, nil
+}
 
-	// Create a new connection
-	conn, err := NewConnection(config)
-	if err != nil {
-		return "", err
+// Connections returns every connection in the pool
+func (p *pool) Connections() []*Proxy {
+	p.RLock()
+	defer p.RUnlock()
+
+	// Connections that have died are no longer in conns, but are still in
+	// use until their tokens are unregistered
+	seen := make(map[*poolEntry]bool)
+	var proxies []*Proxy
+	for _, entry := range p.tokenMap {
+		if !seen[entry] {
+			seen[entry] = true
+			proxies = append(proxies, entry.proxy)
+		}
 	}
+	return proxies
+}
 
-	token, err := generateToken()
+// Connect will connect to a server based on configuration or re-use an
+// existing open connection. If successful, a token that can be used to
+// communicate with the connection is returned, along with the secret used to
+// sign the messages delivered to the token's MessageUrl.
+func (p *pool) Connect(config ServerConfig) (string, string, error) {
+	token, secret, err := generateCredentials()
 	if err != nil {
-		return "", generateTokenError
+		return "", "", err
+	}
+
+	for {
+		entry, err := p.connection(config.connectionKey())
+		if err != nil {
+			return "", "", err
+		}
+
+		// The connection may have been closed, or died, while we waited
+		// for it, in which case we need another one
+		p.Lock()
+		if p.conns[entry.key] != entry {
+			p.Unlock()
+			continue
+		}
+		entry.tokens[token] = StoredToken{
+			Token:      token,
+			Secret:     secret,
+			AppName:    config.AppName,
+			MessageUrl: config.MessageUrl,
+		}
+		p.tokenMap[token] = entry
+		entry.proxy.AddWebhook(token, config.MessageUrl, secret)
+		p.Unlock()
+
+		p.Save()
+		return token, secret, nil
 	}
+}
 
+// connection returns the connection for a configuration, dialing it if
+// there isn't one already.
+func (p *pool) connection(key ServerConfig) (*poolEntry, error) {
 	p.Lock()
-	p.tokenMap[token] = conn
+	entry, ok := p.conns[key]
+	if ok {
+		p.Unlock()
+		<-entry.ready
+		return entry, entry.err
+	}
+
+	entry = &poolEntry{
+		key:    key,
+		tokens: make(map[string]StoredToken),
+		ready:  make(chan struct{}),
+	}
+	p.conns[key] = entry
 	p.Unlock()
 
-	return token, nil
+	entry.proxy, entry.err = p.dial(key)
+	if entry.err != nil {
+		p.Lock()
+		delete(p.conns, key)
+		p.Unlock()
+	} else {
+		go p.forgetWhenDead(entry)
+	}
+	close(entry.ready)
+	return entry, entry.err
+}
+
+// forgetWhenDead stops sharing a connection once it has given up
+// reconnecting, so that the next registration dials a fresh one. Tokens
+// already using it report that it is dead until they are unregistered.
+func (p *pool) forgetWhenDead(entry *poolEntry) {
+	<-entry.proxy.Dead()
+	p.Lock()
+	if p.conns[entry.key] == entry {
+		delete(p.conns, entry.key)
+	}
+	p.Unlock()
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jnwhiteh/wallops/ircx"
+)
+
+// countingDialer counts the connections made by a pool, handing out pipe
+// proxies.
+type countingDialer struct {
+	dials    int
+	fail     bool
+	servers  []*ircx.Decoder
+	restored [][]ircx.Channel // the channels of each restored connection
+	sync.Mutex
+}
+
+func (d *countingDialer) restore(config ServerConfig, channels []ircx.Channel) *Proxy {
+	d.Lock()
+	d.restored = append(d.restored, channels)
+	d.Unlock()
+
+	proxy, _, _ := newPipeProxy()
+	proxy.config = config
+	return proxy
+}
+
+func (d *countingDialer) dial(config ServerConfig) (*Proxy, error) {
+	// Give racing registrations a chance to pile up
+	time.Sleep(10 * time.Millisecond)
+
+	d.Lock()
+	defer d.Unlock()
+	d.dials++
+	if d.fail {
+		return nil, fmt.Errorf("Connection refused")
+	}
+	proxy, decoder, _ := newPipeProxy()
+	proxy.config = config
+	d.servers = append(d.servers, decoder)
+	return proxy, nil
+}
+
+func newTestPool(dialer *countingDialer) *pool {
+	p := newPool()
+	p.dial = dialer.dial
+	p.restore = dialer.restore
+	return p
+}
+
+var poolConfig = ServerConfig{
+	Host:       "localhost",
+	Port:       6667,
+	Nickname:   "bot",
+	Realname:   "IRC Bot",
+	AppName:    "application",
+	MessageUrl: "http://localhost:9999/",
+}
+
+func TestPoolSharesConnections(t *testing.T) {
+	dialer := &countingDialer{}
+	p := newTestPool(dialer)
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for idx := range tokens {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			config := poolConfig
+			config.MessageUrl = fmt.Sprintf("http://localhost:9999/%d", idx)
+			token, _, err := p.Connect(config)
+			if err != nil {
+				t.Errorf("Failed to connect: %s", err)
+			}
+			tokens[idx] = token
+		}(idx)
+	}
+	wg.Wait()
+
+	if dialer.dials != 1 {
+		t.Fatalf("Expected one dial for racing registrations, got %d", dialer.dials)
+	}
+	first, _ := p.Lookup(tokens[0])
+	for _, token := range tokens {
+		if proxy, err := p.Lookup(token); err != nil || proxy != first {
+			t.Fatalf("Token %s does not share the connection: %v", token, err)
+		}
+	}
+
+	other := poolConfig
+	other.Nickname = "otherbot"
+	if _, _, err := p.Connect(other); err != nil || dialer.dials != 2 {
+		t.Fatalf("Expected a different config to dial again, got %d dials (%v)", dialer.dials, err)
+	}
+}
+
+func TestPoolUnregister(t *testing.T) {
+	dialer := &countingDialer{}
+	p := newTestPool(dialer)
+
+	first, _, _ := p.Connect(poolConfig)
+	second, _, _ := p.Connect(poolConfig)
+	proxy, _ := p.Lookup(first)
+
+	quit := make(chan string, 1)
+	go func() {
+		msg, err := dialer.servers[0].Decode()
+		if err == nil {
+			quit <- msg.String()
+		}
+	}()
+
+	if err := p.Unregister(first); err != nil {
+		t.Fatalf("Failed to unregister: %s", err)
+	}
+	if _, err := p.Lookup(first); err != invalidTokenError {
+		t.Fatalf("Expected unregistered token to be invalid, got %v", err)
+	}
+	if proxy.isClosing() {
+		t.Fatalf("Connection was closed while a token still uses it")
+	}
+
+	p.Unregister(second)
+	if line := <-quit; line != "QUIT :"+quitMessage {
+		t.Fatalf("Expected QUIT, got %s", line)
+	}
+	if !proxy.isClosing() {
+		t.Fatalf("Connection was not closed with the last token")
+	}
+	if err := p.Unregister(second); err != invalidTokenError {
+		t.Fatalf("Expected unregistering twice to fail, got %v", err)
+	}
+
+	// The closed connection is no longer shared
+	p.Connect(poolConfig)
+	if dialer.dials != 2 {
+		t.Fatalf("Expected a new dial after closing, got %d", dialer.dials)
+	}
+}
+
+func TestPoolDialFailure(t *testing.T) {
+	dialer := &countingDialer{fail: true}
+	p := newTestPool(dialer)
+
+	if _, _, err := p.Connect(poolConfig); err == nil {
+		t.Fatalf("Expected the dial error to be returned")
+	}
+	dialer.fail = false
+	if _, _, err := p.Connect(poolConfig); err != nil || dialer.dials != 2 {
+		t.Fatalf("Expected a failed dial to be retried, got %d dials (%v)", dialer.dials, err)
+	}
+}
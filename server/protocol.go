@@ -1,5 +1,14 @@
 package main
 
+import (
+	"strings"
+	"time"
+
+	"github.com/jnwhiteh/wallops/history"
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/sorcix/irc"
+)
+
 type ServerConfig struct {
 	Host     string // the host to connect to
 	Port     int    // the port on which to connect
@@ -7,6 +16,21 @@ type ServerConfig struct {
 	Nickname string // the nickname to use (if possible)
 	Realname string // the name to be displayed in WHOIS queries
 
+	// How to secure the connection, if at all. Certificates and keys must be
+	// given inline as PEM, since callers can't be trusted with file paths.
+	TLS  ircx.TLSConfig
+	SASL ircx.SASLConfig // credentials for authenticating with services
+
+	// Space-separated IRCv3 capabilities to request, or empty to request
+	// ircx.DefaultCapabilities
+	Capabilities string
+
+	Flood ircx.FloodConfig // rate limits for outgoing messages
+
+	// Comma-separated channels to join once connected, each optionally
+	// followed by a space and its key, e.g. "#wallops,#secret hunter2"
+	Channels string
+
 	AppName    string // a human-readable application name of registrant
 	MessageUrl string // a URL to be called for incoming messages
 }
@@ -17,7 +41,9 @@ func (c ServerConfig) Valid() bool {
 		c.Nickname != "" &&
 		c.Realname != "" &&
 		c.AppName != "" &&
-		c.MessageUrl != "")
+		c.MessageUrl != "" &&
+		!c.TLS.HasFiles() &&
+		c.SASL.Valid())
 }
 
 type RegisterRequest struct {
@@ -31,6 +57,10 @@ func (r RegisterRequest) Valid() bool {
 type RegisterResponse struct {
 	Success bool   // whether or not the connection was registered
 	Token   string // the token that can be used to access this connection
+
+	// The key for the HMAC signature sent with each message delivered to the
+	// MessageUrl, see the signature package for how to verify it
+	Secret string
 }
 
 // TokenRequest is a generic payload for any request that requires a server
@@ -43,6 +73,234 @@ func (r TokenRequest) Valid() bool {
 	return r.Token != ""
 }
 
+// SendRequest asks for a raw message to be sent to the server a token is
+// connected to.
+type SendRequest struct {
+	Token   string
+	Tags    map[string]string // IRCv3 tags to attach to the message
+	Command string
+	Params  []string // only the last parameter may contain spaces
+}
+
+// Commands that would interfere with a connection shared by other tokens
+var forbiddenCommands = map[string]bool{
+	irc.PASS:          true,
+	irc.USER:          true,
+	irc.QUIT:          true,
+	ircx.CAP:          true,
+	ircx.AUTHENTICATE: true,
+}
+
+func (r SendRequest) Valid() bool {
+	if r.Token == "" || r.Command == "" || forbiddenCommands[strings.ToUpper(r.Command)] {
+		return false
+	}
+	for _, c := range r.Command {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	for idx, param := range r.Params {
+		if !validParam(param, idx == len(r.Params)-1) {
+			return false
+		}
+	}
+	for key, value := range r.Tags {
+		if !validTagKey(key) || strings.ContainsAny(value, "\r\n\x00") {
+			return false
+		}
+	}
+	return true
+}
+
+// Message builds the message to be sent
+func (r SendRequest) Message() *ircx.Message {
+	msg := &irc.Message{Command: strings.ToUpper(r.Command), Params: r.Params}
+	if n := len(r.Params); n > 0 {
+		last := r.Params[n-1]
+		if last == "" || last[0] == ':' || strings.Contains(last, " ") {
+			msg.Params = r.Params[:n-1]
+			msg.Trailing = last
+			msg.EmptyTrailing = last == ""
+		}
+	}
+	wrapped := ircx.Wrap(msg)
+	if len(r.Tags) > 0 {
+		wrapped.Tags = ircx.Tags(r.Tags)
+	}
+	return wrapped
+}
+
+// validParam reports whether a parameter can be sent without changing the
+// meaning of the message. Only the last parameter may be empty, contain
+// spaces or start with a colon.
+func validParam(param string, last bool) bool {
+	if strings.ContainsAny(param, "\r\n\x00") {
+		return false
+	}
+	if last {
+		return true
+	}
+	return param != "" && param[0] != ':' && !strings.Contains(param, " ")
+}
+
+func validTagKey(key string) bool {
+	if key == "" || key == "+" {
+		return false
+	}
+	for idx, c := range key {
+		if c == '+' && idx == 0 {
+			continue
+		}
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '-' || c == '/' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// PrivmsgRequest sends text to a channel or user, splitting it into as many
+// messages as are needed.
+type PrivmsgRequest struct {
+	Token  string
+	Target string // a channel or nickname
+	Text   string // may be longer than a line, or contain several lines
+	Notice bool   // send a NOTICE rather than a PRIVMSG
+}
+
+func (r PrivmsgRequest) Valid() bool {
+	return (r.Token != "" &&
+		validParam(r.Target, false) &&
+		len(r.Target) <= ircx.MaxTargetLength &&
+		strings.TrimSpace(r.Text) != "" &&
+		!strings.ContainsRune(r.Text, 0))
+}
+
+// SendResponse reports whether the server has confirmed a sent message
+type SendResponse struct {
+	Success bool
+	Status  string   // SendQueued or SendSent
+	MsgIds  []string // the msgid of each message the server echoed, if any
+}
+
+// SocketRequest is a frame sent by a WebSocket client. The first frame must
+// have the type "auth" and carry the token, after which "send" and "privmsg"
+// frames send messages as SendRequest and PrivmsgRequest do.
+type SocketRequest struct {
+	Type string // "auth", "send" or "privmsg"
+	Ref  string // returned with the reply, so requests and replies can be matched
+
+	Token  string // for "auth", the token to connect to
+	LastId uint64 // for "auth", resume after this message id (zero for new messages only)
+
+	Tags    map[string]string // for "send"
+	Command string            // for "send"
+	Params  []string          // for "send"
+
+	Target string // for "privmsg"
+	Text   string // for "privmsg"
+	Notice bool   // for "privmsg"
+}
+
+// SocketResponse is a frame sent to a WebSocket client
+type SocketResponse struct {
+	Type    string          // "message", "result", "error", "reset" or "dead"
+	Ref     string          // the Ref of the request being replied to
+	Id      uint64          // for "message", the id to resume after
+	Message *MessagePayload // for "message"
+	Status  string          // for "result", SendQueued or SendSent
+	MsgIds  []string        // for "result", as in SendResponse
+	Error   string          // for "error"
+}
+
+// ISupportResponse describes the features (RPL_ISUPPORT) advertised by the
+// server that a token is connected to.
+type ISupportResponse struct {
+	Success       bool
+	Network       string
+	NickLen       int
+	ChanTypes     string
+	PrefixModes   string    // channel membership modes, e.g. "ov"
+	PrefixSymbols string    // the matching nick prefixes, e.g. "@+"
+	ChanModes     [4]string // the four CHANMODES groups
+	CaseMapping   string
+	TargMax       map[string]int    // zero means the command has no limit
+	Tokens        map[string]string // every advertised token and its raw value
+}
+
+// MessagePayload is POSTed to a token's MessageUrl for every message
+// received from the server.
+type MessagePayload struct {
+	Token   string            // the token the message is being delivered for
+	Time    time.Time         // when the server sent (or we received) the message
+	Prefix  string            // the source of the message, if any
+	Command string            // the command or numeric
+	Params  []string          // all parameters, including the trailing one
+	Tags    map[string]string // IRCv3 message tags
+	Raw     string            // the message as it was received
+}
+
+// DeliveryFailure records a message that could not be delivered to a
+// MessageUrl.
+type DeliveryFailure struct {
+	Time     time.Time // when we gave up on the message
+	Command  string    // the command of the message that was dropped
+	Attempts int       // how many times delivery was attempted
+	Error    string    // the last error seen
+}
+
+// WebhookResponse describes how delivery to a token's MessageUrl is going
+type WebhookResponse struct {
+	Success   bool
+	Url       string
+	Pending   int               // messages waiting to be delivered
+	Delivered uint64            // messages delivered successfully
+	Failed    uint64            // messages dropped after failing or overflowing
+	Failures  []DeliveryFailure // the most recent failures, oldest first
+}
+
+// ConnectionStatus describes a pooled connection to a server
+type ConnectionStatus struct {
+	Server         string    // the host and port connected to
+	Status         string    // "connected", "reconnecting" or "dead"
+	Error          string    // why the connection was lost, if it was
+	Nickname       string    // our current nickname
+	ConnectedSince time.Time // when we last finished registering
+	Channels       []string  // the channels we are in
+	LagMs          int64     // the round trip time of our last PING, in milliseconds
+	Tokens         int       // how many tokens share the connection
+}
+
+// TokenResponse describes a token and the connection it uses
+type TokenResponse struct {
+	Success bool
+	Token   string
+	ConnectionStatus
+}
+
+// ChannelResponse describes a channel that a token's connection is in: its
+// topic, modes and members
+type ChannelResponse struct {
+	Success bool
+	ircx.ChannelInfo
+}
+
+// ConnectionsResponse lists every pooled connection
+type ConnectionsResponse struct {
+	Success     bool
+	Connections []ConnectionStatus
+}
+
+// HistoryResponse is a page of the messages matching a history search
+type HistoryResponse struct {
+	Success bool
+	Records []history.Record // newest first
+	Next    uint64           // pass as before to get the next page, or 0 if this is the last
+}
+
+// ErrorResponse is returned, with an appropriate status code, whenever a
+// request fails.
 type ErrorResponse struct {
 	Success bool
 	Error   string
@@ -9,3 +9,22 @@ curl -XPOST http://127.0.0.1:9667/register -d '    {
         }
     }
 '
+
+curl -XPOST http://127.0.0.1:9667/privmsg -d '    {
+        "token": "TOKEN",
+        "target": "#wallops",
+        "text": "Hello from wallops"
+    }
+'
+
+curl http://127.0.0.1:9667/tokens/TOKEN
+
+curl http://127.0.0.1:9667/tokens/TOKEN/channels/%23wallops
+
+curl -XDELETE http://127.0.0.1:9667/tokens/TOKEN
+
+curl http://127.0.0.1:9667/connections
+
+curl http://127.0.0.1:9667/metrics
+
+curl 'http://127.0.0.1:9667/history/search?token=TOKEN&q=deploy+broken&channel=%23wallops&since=7d&limit=20'
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jnwhiteh/wallops/ircx"
+)
+
+// storeVersion is the version of the state file written by this build. Bump
+// it when the format changes, and teach Load to migrate the old one.
+const storeVersion = 1
+
+var unknownVersionError = fmt.Errorf("State file is from a newer version of wallops")
+
+// PoolState is everything needed to restore the pool after a restart
+type PoolState struct {
+	Version     int
+	Connections []StoredConnection
+}
+
+// StoredConnection is a pooled connection and the tokens using it
+type StoredConnection struct {
+	Config   ServerConfig   // the configuration shared by its tokens
+	Channels []ircx.Channel // the channels it was in, to rejoin
+	Tokens   []StoredToken
+}
+
+// StoredToken is a registered token and where its messages go
+type StoredToken struct {
+	Token      string
+	Secret     string
+	AppName    string
+	MessageUrl string
+}
+
+// Store keeps the pool's state in a file on local disk. Since the file holds
+// tokens and signing secrets, it is only readable by its owner.
+type Store struct {
+	path string
+	sync.Mutex
+}
+
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// Load reads the saved state. If nothing has been saved yet the state is
+// empty.
+func (s *Store) Load() (*PoolState, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return &PoolState{Version: storeVersion}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state PoolState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Version > storeVersion {
+		return nil, unknownVersionError
+	}
+	// Migrations from older versions go here, oldest first
+	state.Version = storeVersion
+	return &state, nil
+}
+
+// Save replaces the saved state. The state is written to a temporary file
+// which is then renamed over the old one, so a crash part way through never
+// leaves a truncated file behind.
+func (s *Store) Save(state *PoolState) error {
+	s.Lock()
+	defer s.Unlock()
+
+	state.Version = storeVersion
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
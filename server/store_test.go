@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jnwhiteh/wallops/ircx"
+)
+
+func tempStore(t *testing.T) *Store {
+	dir, err := ioutil.TempDir("", "wallops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return NewStore(filepath.Join(dir, "state.json"))
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	store := tempStore(t)
+	state, err := store.Load()
+	if err != nil || len(state.Connections) != 0 {
+		t.Fatalf("Expected an empty state before saving, got %+v %v", state, err)
+	}
+
+	saved := &PoolState{Connections: []StoredConnection{{
+		Config:   poolConfig.connectionKey(),
+		Channels: []ircx.Channel{{Name: "#wallops"}, {Name: "#secret", Key: "hunter2"}},
+		Tokens:   []StoredToken{{Token: "token", Secret: "secret", AppName: "application"}},
+	}}}
+	if err := store.Save(saved); err != nil {
+		t.Fatalf("Failed to save: %s", err)
+	}
+	info, _ := os.Stat(store.path)
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("State file should only be readable by its owner, got %v", info.Mode())
+	}
+
+	state, err = store.Load()
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	if state.Version != storeVersion || len(state.Connections) != 1 {
+		t.Fatalf("Incorrect state: %+v", state)
+	}
+	conn := state.Connections[0]
+	if conn.Config != poolConfig.connectionKey() || conn.Channels[1].Key != "hunter2" || conn.Tokens[0].Secret != "secret" {
+		t.Fatalf("Connection did not round trip: %+v", conn)
+	}
+
+	ioutil.WriteFile(store.path, []byte(`{"Version": 99}`), 0600)
+	if _, err := store.Load(); err != unknownVersionError {
+		t.Fatalf("Expected a newer version to be rejected, got %v", err)
+	}
+}
+
+func TestPoolRestore(t *testing.T) {
+	store := tempStore(t)
+	dialer := &countingDialer{}
+	p := newTestPool(dialer)
+	if err := p.load(store); err != nil {
+		t.Fatalf("Failed to load an empty store: %s", err)
+	}
+
+	token, secret, _ := p.Connect(poolConfig)
+	proxy, _ := p.Lookup(token)
+	proxy.channels.Handle(ircx.ParseMessage(":bot!b@host JOIN #wallops"), "bot", proxy.isupport)
+	p.Save()
+
+	// A new pool picks up where the old one left off
+	restored := newTestPool(dialer)
+	if err := restored.load(store); err != nil {
+		t.Fatalf("Failed to restore: %s", err)
+	}
+	if len(dialer.restored) != 1 || len(dialer.restored[0]) != 1 || dialer.restored[0][0].Name != "#wallops" {
+		t.Fatalf("Channels were not restored: %v", dialer.restored)
+	}
+	proxy, err := restored.Lookup(token)
+	if err != nil {
+		t.Fatalf("Token was not restored: %s", err)
+	}
+	if hook, ok := proxy.hooks[token]; !ok || hook.secret != secret || hook.url != poolConfig.MessageUrl {
+		t.Fatalf("Webhook was not restored: %+v", hook)
+	}
+
+	// and shares the restored connection with new registrations
+	restored.Connect(poolConfig)
+	if dialer.dials != 1 {
+		t.Fatalf("Expected the restored connection to be shared, got %d dials", dialer.dials)
+	}
+}
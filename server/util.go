@@ -22,6 +22,12 @@ func JSON(w http.ResponseWriter, r *http.Request, status int, value interface{})
 	w.Write(result)
 }
 
+// jsonError responds with an ErrorResponse, so that every endpoint reports
+// errors the same way
+func jsonError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	JSON(w, r, status, ErrorResponse{Success: false, Error: message})
+}
+
 // generateToken create a new 16-byte UUID token
 func generateToken() (string, error) {
 	b := make([]byte, 16)
@@ -32,13 +38,40 @@ func generateToken() (string, error) {
 	return fmt.Sprintf("%x", b), nil
 }
 
-var maxNickLength = 9
+// generateSecret creates a new 32-byte secret for signing webhooks
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := crand.Read(b)
+	if err != nil {
+		return "", generateTokenError
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+// generateCredentials creates a token and its webhook signing secret
+func generateCredentials() (token, secret string, err error) {
+	token, err = generateToken()
+	if err != nil {
+		return "", "", err
+	}
+	secret, err = generateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	return token, secret, nil
+}
 
 // randomNick will create a random nickname based on a desired name, with a
-// small random bit at the end.
-func randomNick(nickname string) string {
+// small random bit at the end, that fits within the server's maximum nickname
+// length. At least the first character of the name is kept, however short
+// the maximum is.
+func randomNick(nickname string, maxNickLength int) string {
 	randomBit := rand.Intn(99)
-	shortNick := truncate(nickname, maxNickLength-3)
+	keep := maxNickLength - 3
+	if keep < 1 {
+		keep = 1
+	}
+	shortNick := truncate(nickname, keep)
 	return fmt.Sprintf("%s_%0d", shortNick, randomBit)
 }
 
@@ -6,7 +6,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/jnwhiteh/wallops/ircx"
 )
 
 type StringReadCloser struct {
@@ -25,14 +29,36 @@ func NewStringReadCloser(s string) *StringReadCloser {
 
 type NoopConnectionPooler struct {
 	calls []ServerConfig
+	proxy *Proxy // returned by Lookup for "token"
 }
 
-func (p *NoopConnectionPooler) Connect(config ServerConfig) (string, error) {
+func (p *NoopConnectionPooler) Connect(config ServerConfig) (string, string, error) {
 	p.calls = append(p.calls, config)
-	return "token", nil
+	return "token", "secret", nil
 }
 
 func (p *NoopConnectionPooler) Unregister(token string) error {
+	if token != "token" {
+		return invalidTokenError
+	}
+	return nil
+}
+
+func (p *NoopConnectionPooler) Lookup(token string) (*Proxy, error) {
+	if token != "token" || p.proxy == nil {
+		return nil, invalidTokenError
+	}
+	return p.proxy, nil
+}
+
+func (p *NoopConnectionPooler) Connections() []*Proxy {
+	if p.proxy == nil {
+		return nil
+	}
+	return []*Proxy{p.proxy}
+}
+
+func (p *NoopConnectionPooler) Save() error {
 	return nil
 }
 
@@ -75,6 +101,16 @@ func TestRegisterValidatingConfig(t *testing.T) {
 		`{}`,
 		// empty config
 		`{"config": {}}`,
+		// SASL mechanism without credentials
+		`{"config": {"host": "localhost", "port": 6667, "nickname": "bot",
+			"realname": "IRC Bot", "appname": "application",
+			"messageurl": "http://localhost:9999/",
+			"sasl": {"mechanism": "PLAIN"}}}`,
+		// TLS files on the server's disk
+		`{"config": {"host": "localhost", "port": 6667, "nickname": "bot",
+			"realname": "IRC Bot", "appname": "application",
+			"messageurl": "http://localhost:9999/",
+			"tls": {"enabled": true, "keyfile": "/etc/wallops/client.key"}}}`,
 	}
 
 	for idx, payload := range tests {
@@ -130,9 +166,219 @@ func TestRegisterValidConfig(t *testing.T) {
 	expectedResponse := RegisterResponse{
 		Success: true,
 		Token:   "token",
+		Secret:  "secret",
 	}
 	jsonValue, _ := json.Marshal(expectedResponse)
 	if !bytes.Equal(body, jsonValue) {
 		t.Fatalf("Got incorrect response: %s != %s", body, jsonValue)
 	}
 }
+
+func TestISupport(t *testing.T) {
+	isupport := ircx.NewISupport()
+	isupport.Handle(ircx.ParseMessage(":server 005 bot NICKLEN=30 NETWORK=Example :are supported"))
+	api := ServerAPI{&NoopConnectionPooler{proxy: &Proxy{isupport: isupport}}}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost/isupport?token=invalid", nil)
+	api.HandleISupport(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected not found for an unknown token, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost/isupport?token=token", nil)
+	api.HandleISupport(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got unexpected non-200 status code %d", w.Code)
+	}
+
+	var response ISupportResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %s", err)
+	}
+	if response.NickLen != 30 || response.Network != "Example" || response.ChanTypes != "#&" {
+		t.Fatalf("Got incorrect response: %+v", response)
+	}
+	if response.Tokens["NICKLEN"] != "30" {
+		t.Fatalf("Raw tokens missing from response: %v", response.Tokens)
+	}
+
+	api.pool.(*NoopConnectionPooler).proxy.setStatus(StatusDead, ircx.GaveUpError)
+	w = httptest.NewRecorder()
+	api.HandleISupport(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected unavailable for a dead connection, got %d", w.Code)
+	}
+}
+
+func TestSendRequestValid(t *testing.T) {
+	valid := []SendRequest{
+		{Token: "token", Command: "PRIVMSG", Params: []string{"#chan", "hello there"}},
+		{Token: "token", Command: "join", Params: []string{"#chan"}},
+		{Token: "token", Command: "TAGMSG", Params: []string{"#chan"}, Tags: map[string]string{"+typing": "active"}},
+	}
+	for _, req := range valid {
+		if !req.Valid() {
+			t.Fatalf("Expected request to be valid: %+v", req)
+		}
+	}
+
+	invalid := []SendRequest{
+		{Command: "PRIVMSG", Params: []string{"#chan", "hi"}},
+		{Token: "token", Command: "QUIT", Params: []string{"bye"}},
+		{Token: "token", Command: "PRIV MSG"},
+		{Token: "token", Command: "PRIVMSG", Params: []string{"#a #b", "hi"}},
+		{Token: "token", Command: "PRIVMSG", Params: []string{"#chan", "hi\r\nQUIT"}},
+		{Token: "token", Command: "TAGMSG", Params: []string{"#chan"}, Tags: map[string]string{"a b": ""}},
+	}
+	for _, req := range invalid {
+		if req.Valid() {
+			t.Fatalf("Expected request to be invalid: %+v", req)
+		}
+	}
+
+	msg := SendRequest{Token: "token", Command: "privmsg", Params: []string{"#chan", "hello there"}}.Message()
+	if msg.String() != "PRIVMSG #chan :hello there" {
+		t.Fatalf("Incorrect message: %s", msg)
+	}
+}
+
+func TestPrivmsg(t *testing.T) {
+	proxy, decoder, server := newPipeProxy()
+	defer server.Close()
+	api := ServerAPI{&NoopConnectionPooler{proxy: proxy}}
+
+	w, r := SetupRequest(t, "POST", `{"Token": "token", "Target": "#chan"}`)
+	api.HandlePrivmsg(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request without text, got %d", w.Code)
+	}
+
+	w, r = SetupRequest(t, "POST", `{"Token": "invalid", "Target": "#chan", "Text": "hi"}`)
+	api.HandlePrivmsg(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected not found for an unknown token, got %d", w.Code)
+	}
+
+	long := strings.Repeat("a", 500)
+	w, r = SetupRequest(t, "POST", `{"Token": "token", "Target": "#`+long+`", "Text": "hi"}`)
+	api.HandlePrivmsg(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request for a long target, got %d", w.Code)
+	}
+
+	sent := make(chan string, 1)
+	go func() {
+		msg, _ := decoder.Decode()
+		sent <- msg.String()
+	}()
+	w, r = SetupRequest(t, "POST", `{"Token": "token", "Target": "#chan", "Text": "hi", "Notice": true}`)
+	api.HandlePrivmsg(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got unexpected non-200 status code %d", w.Code)
+	}
+	if line := <-sent; line != "NOTICE #chan :hi" {
+		t.Fatalf("Incorrect message sent: %s", line)
+	}
+
+	var response SendResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %s", err)
+	}
+	if !response.Success || response.Status != SendQueued {
+		t.Fatalf("Got incorrect response: %+v", response)
+	}
+}
+
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) ErrorResponse {
+	var response ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode error response %q: %s", w.Body.String(), err)
+	}
+	return response
+}
+
+func TestTokens(t *testing.T) {
+	isupport := ircx.NewISupport()
+	proxy := &Proxy{
+		config:      ServerConfig{Host: "irc.example.com", Port: 6697},
+		currentNick: "bot",
+		status:      StatusConnected,
+		state:       ircx.NewState("bot", isupport),
+	}
+	for _, line := range []string{
+		":bot!b@host JOIN #wallops",
+		":alice!a@host JOIN #wallops",
+		":server MODE #wallops +o alice",
+		":alice!a@host TOPIC #wallops :Welcome to wallops",
+	} {
+		proxy.state.Handle(ircx.ParseMessage(line))
+	}
+	api := ServerAPI{&NoopConnectionPooler{proxy: proxy}}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost/tokens/invalid", nil)
+	api.HandleToken(w, r)
+	if w.Code != http.StatusNotFound || decodeError(t, w).Error != "Not found" {
+		t.Fatalf("Expected a JSON not found error, got %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost/tokens/token", nil)
+	api.HandleToken(w, r)
+	var response TokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %s", err)
+	}
+	if response.Server != "irc.example.com:6697" || response.Nickname != "bot" || response.Status != StatusConnected {
+		t.Fatalf("Got incorrect response: %+v", response)
+	}
+	if len(response.Channels) != 1 || response.Channels[0] != "#wallops" {
+		t.Fatalf("Incorrect channels: %v", response.Channels)
+	}
+
+	for _, path := range []string{"/tokens/token/channels/%23elsewhere", "/tokens/invalid/channels/%23wallops", "/tokens/token/channels/"} {
+		w = httptest.NewRecorder()
+		r, _ = http.NewRequest("GET", "http://localhost"+path, nil)
+		api.HandleToken(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected not found, got %d %s", path, w.Code, w.Body)
+		}
+	}
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost/tokens/token/channels/%23WALLOPS", nil)
+	api.HandleToken(w, r)
+	var channel ChannelResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &channel); err != nil {
+		t.Fatalf("Failed to decode response: %s", err)
+	}
+	expected := []ircx.Member{{Nick: "alice", Prefixes: "@"}, {Nick: "bot"}}
+	if !channel.Success || channel.Name != "#wallops" || channel.Topic != "Welcome to wallops" || channel.TopicSetBy != "alice!a@host" || !reflect.DeepEqual(channel.Members, expected) {
+		t.Fatalf("Got incorrect channel: %+v", channel)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://localhost/connections", nil)
+	api.HandleConnections(w, r)
+	var connections ConnectionsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &connections); err != nil {
+		t.Fatalf("Failed to decode response: %s", err)
+	}
+	if len(connections.Connections) != 1 || connections.Connections[0].Nickname != "bot" {
+		t.Fatalf("Got incorrect connections: %+v", connections)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("DELETE", "http://localhost/tokens/token", nil)
+	api.HandleToken(w, r)
+	if w.Code != http.StatusOK || !decodeError(t, w).Success {
+		t.Fatalf("Failed to unregister: %d %s", w.Code, w.Body)
+	}
+
+	w, r = SetupRequest(t, "POST", `{"Token": "invalid"}`)
+	api.HandleUnregister(w, r)
+	if w.Code != http.StatusNotFound || decodeError(t, w).Success {
+		t.Fatalf("Expected a JSON not found error, got %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/jnwhiteh/wallops/signature"
+	"github.com/sorcix/irc"
+)
+
+var (
+	webhookTimeout      = time.Second * 10 // how long a single POST may take
+	webhookRetries      = 3                // retries after the first attempt
+	webhookRetryDelay   = time.Second      // doubled after each retry
+	webhookQueueSize    = 256              // messages waiting per token
+	webhookFailureLimit = 20               // failures remembered per token
+
+	webhookClosedError   = fmt.Errorf("Webhook has been closed")
+	webhookOverflowError = fmt.Errorf("Too many messages waiting for delivery")
+)
+
+// webhookStatusError is returned when a MessageUrl responds with a non-2xx
+// status code.
+type webhookStatusError struct {
+	Status int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("MessageUrl responded with %d %s", e.Status, http.StatusText(e.Status))
+}
+
+// retryable reports whether a failed delivery is worth trying again. Client
+// errors (other than rate limiting) won't be fixed by sending the same
+// payload again.
+func retryable(err error) bool {
+	if status, ok := err.(*webhookStatusError); ok {
+		return status.Status >= 500 || status.Status == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// NewMessagePayload converts a message into the form delivered to webhooks
+func NewMessagePayload(token string, msg *ircx.Message) MessagePayload {
+	payload := MessagePayload{
+		Token:   token,
+		Command: msg.Command,
+		Params:  msg.AllParams(),
+		Tags:    msg.Tags,
+		Raw:     msg.String(),
+	}
+	if msg.Prefix != nil {
+		payload.Prefix = msg.Prefix.String()
+	}
+	if when, ok := msg.Time(); ok {
+		payload.Time = when
+	} else {
+		payload.Time = time.Now().UTC()
+	}
+	return payload
+}
+
+// webhook delivers the messages for a single token to its MessageUrl, one
+// at a time and in the order they were received.
+type webhook struct {
+	token  string
+	url    string
+	secret string // the key used to sign each request
+	client *http.Client
+	queue  chan MessagePayload
+	done   chan struct{}
+
+	closed    bool
+	delivered uint64
+	failed    uint64
+	failures  []DeliveryFailure
+	sync.Mutex
+}
+
+func newWebhook(token, url, secret string) *webhook {
+	hook := &webhook{
+		token:  token,
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan MessagePayload, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go hook.run()
+	return hook
+}
+
+// Deliver queues a message for delivery without blocking. If the queue is
+// full the message is dropped and recorded as a failure, so that a slow
+// endpoint can't hold up the connection.
+func (h *webhook) Deliver(msg *ircx.Message) error {
+	payload := NewMessagePayload(h.token, msg)
+
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		return webhookClosedError
+	}
+	select {
+	case h.queue <- payload:
+		return nil
+	default:
+		webhookDeliveries.Inc("dropped")
+		h.recordFailure(payload, 0, webhookOverflowError)
+		return webhookOverflowError
+	}
+}
+
+// Close stops delivery once the messages already queued have been sent
+func (h *webhook) Close() {
+	h.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.queue)
+	}
+	h.Unlock()
+}
+
+// Wait blocks until the webhook has been closed and has drained its queue
+func (h *webhook) Wait() {
+	<-h.done
+}
+
+// Status returns a summary of how delivery is going
+func (h *webhook) Status() WebhookResponse {
+	h.Lock()
+	defer h.Unlock()
+	return WebhookResponse{
+		Success:   true,
+		Url:       h.url,
+		Pending:   len(h.queue),
+		Delivered: h.delivered,
+		Failed:    h.failed,
+		Failures:  append([]DeliveryFailure{}, h.failures...),
+	}
+}
+
+func (h *webhook) run() {
+	defer close(h.done)
+	for payload := range h.queue {
+		attempts, err := h.deliver(payload)
+
+		h.Lock()
+		if err != nil {
+			log.Printf("Failed to deliver %s to %s: %s", payload.Command, h.url, err)
+			webhookDeliveries.Inc("failed")
+			h.recordFailure(payload, attempts, err)
+		} else {
+			webhookDeliveries.Inc("delivered")
+			h.delivered++
+		}
+		h.Unlock()
+	}
+}
+
+// deliver POSTs a payload, retrying with backoff, and returns how many
+// attempts were made and the last error if they all failed. Every attempt
+// has the same delivery ID, so a receiver can spot retries, but is signed
+// with a new nonce, so that a receiver which verified an attempt and then
+// failed to handle it doesn't reject the retry as a replay.
+func (h *webhook) deliver(payload MessagePayload) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	delivery, err := generateToken()
+	if err != nil {
+		return 0, err
+	}
+
+	delay := webhookRetryDelay
+	attempt := 0
+	for {
+		attempt++
+		start := time.Now()
+		err = h.post(delivery, body)
+		if err == nil {
+			webhookLatency.Observe(time.Since(start).Seconds(), "ok")
+		} else {
+			webhookLatency.Observe(time.Since(start).Seconds(), "error")
+		}
+		if err == nil || attempt > webhookRetries || !retryable(err) {
+			return attempt, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (h *webhook) post(delivery string, body []byte) error {
+	req, err := http.NewRequest("POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	nonce, err := generateToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signature.SignRequest(req, h.secret, time.Now(), nonce, delivery, body)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &webhookStatusError{resp.StatusCode}
+	}
+	return nil
+}
+
+// recordFailure must be called with the lock held
+func (h *webhook) recordFailure(payload MessagePayload, attempts int, err error) {
+	h.failed++
+	h.failures = append(h.failures, DeliveryFailure{
+		Time:     time.Now().UTC(),
+		Command:  payload.Command,
+		Attempts: attempts,
+		Error:    err.Error(),
+	})
+	if len(h.failures) > webhookFailureLimit {
+		h.failures = h.failures[len(h.failures)-webhookFailureLimit:]
+	}
+}
+
+// shouldDeliver reports whether a message should be passed on to webhooks.
+// Keepalives are answered by the proxy and aren't interesting to anyone.
+func shouldDeliver(msg *ircx.Message) bool {
+	return msg.Command != irc.PING && msg.Command != irc.PONG
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/jnwhiteh/wallops/signature"
+)
+
+// webhookRecorder is a MessageUrl that records the payloads it receives,
+// responding with each status in turn (and 200 once they run out). If it has
+// a verifier, every request is verified first, and those with a bad signature
+// are rejected.
+type webhookRecorder struct {
+	statuses   []int
+	payloads   []MessagePayload
+	requests   int
+	deliveries []string
+	verifier   *signature.Verifier
+	rejected   []error
+	sync.Mutex
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.Lock()
+	defer rec.Unlock()
+
+	rec.requests++
+	rec.deliveries = append(rec.deliveries, r.Header.Get(signature.DeliveryHeader))
+	if rec.verifier != nil {
+		if _, err := rec.verifier.Verify(r); err != nil {
+			rec.rejected = append(rec.rejected, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	status := http.StatusOK
+	if len(rec.statuses) > 0 {
+		status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+	}
+	if status == http.StatusOK && rec.verifier == nil {
+		var payload MessagePayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		rec.payloads = append(rec.payloads, payload)
+	}
+	w.WriteHeader(status)
+}
+
+func fastRetries() func() {
+	delay := webhookRetryDelay
+	webhookRetryDelay = time.Millisecond
+	return func() { webhookRetryDelay = delay }
+}
+
+func TestWebhookDeliversInOrder(t *testing.T) {
+	rec := &webhookRecorder{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	hook := newWebhook("token", server.URL, "secret")
+	hook.Deliver(ircx.ParseMessage("@time=2011-10-19T16:40:51.620Z :bob!b@host PRIVMSG #chan :first"))
+	hook.Deliver(ircx.ParseMessage(":bob!b@host PRIVMSG #chan :second"))
+	hook.Deliver(ircx.ParseMessage(":bob!b@host JOIN #chan"))
+	hook.Close()
+	hook.Wait()
+
+	if len(rec.payloads) != 3 {
+		t.Fatalf("Expected 3 deliveries, got %d", len(rec.payloads))
+	}
+	first := rec.payloads[0]
+	if first.Token != "token" || first.Prefix != "bob!b@host" || first.Command != "PRIVMSG" {
+		t.Fatalf("Incorrect payload: %+v", first)
+	}
+	if len(first.Params) != 2 || first.Params[0] != "#chan" || first.Params[1] != "first" {
+		t.Fatalf("Incorrect params: %v", first.Params)
+	}
+	if !first.Time.Equal(time.Date(2011, 10, 19, 16, 40, 51, 620e6, time.UTC)) {
+		t.Fatalf("Server time was not used: %v", first.Time)
+	}
+	if rec.payloads[1].Params[1] != "second" || rec.payloads[2].Command != "JOIN" {
+		t.Fatalf("Messages were delivered out of order: %+v", rec.payloads)
+	}
+	if status := hook.Status(); status.Delivered != 3 || status.Failed != 0 {
+		t.Fatalf("Incorrect status: %+v", status)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	defer fastRetries()()
+	rec := &webhookRecorder{statuses: []int{503, 500}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	hook := newWebhook("token", server.URL, "secret")
+	hook.Deliver(ircx.ParseMessage(":bob!b@host PRIVMSG #chan :hello"))
+	hook.Close()
+	hook.Wait()
+
+	if rec.requests != 3 || len(rec.payloads) != 1 {
+		t.Fatalf("Expected delivery on the third attempt, got %d attempts", rec.requests)
+	}
+	if status := hook.Status(); status.Delivered != 1 || len(status.Failures) != 0 {
+		t.Fatalf("Incorrect status: %+v", status)
+	}
+}
+
+func TestWebhookRecordsFailures(t *testing.T) {
+	defer fastRetries()()
+	rec := &webhookRecorder{statuses: []int{500, 500, 500, 500, 400}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	hook := newWebhook("token", server.URL, "secret")
+	hook.Deliver(ircx.ParseMessage(":bob!b@host PRIVMSG #chan :retried"))
+	hook.Deliver(ircx.ParseMessage(":bob!b@host NOTICE #chan :rejected"))
+	hook.Close()
+	hook.Wait()
+
+	status := hook.Status()
+	if status.Failed != 2 || len(status.Failures) != 2 {
+		t.Fatalf("Expected two failures, got %+v", status)
+	}
+	if status.Failures[0].Command != "PRIVMSG" || status.Failures[0].Attempts != webhookRetries+1 {
+		t.Fatalf("Retried failure recorded incorrectly: %+v", status.Failures[0])
+	}
+	if status.Failures[1].Command != "NOTICE" || status.Failures[1].Attempts != 1 {
+		t.Fatalf("Client errors should not be retried: %+v", status.Failures[1])
+	}
+	if err := hook.Deliver(ircx.ParseMessage("PRIVMSG #chan :late")); err != webhookClosedError {
+		t.Fatalf("Expected delivery to a closed webhook to fail, got %v", err)
+	}
+}
+
+func TestWebhookSignsRequests(t *testing.T) {
+	defer fastRetries()()
+	rec := &webhookRecorder{
+		statuses: []int{500},
+		verifier: signature.NewVerifier("secret"),
+	}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	hook := newWebhook("token", server.URL, "secret")
+	hook.Deliver(ircx.ParseMessage(":bob!b@host PRIVMSG #chan :hello"))
+	hook.Close()
+	hook.Wait()
+	// The first attempt was verified but failed, and the retry must still
+	// be accepted
+	if len(rec.rejected) != 0 || hook.Status().Delivered != 1 {
+		t.Fatalf("Signed delivery was rejected: %v", rec.rejected)
+	}
+	if rec.requests != 2 || rec.deliveries[0] != rec.deliveries[1] {
+		t.Fatalf("Expected a retry with the same delivery ID, got %v", rec.deliveries)
+	}
+
+	forged := newWebhook("token", server.URL, "wrong")
+	forged.Deliver(ircx.ParseMessage(":bob!b@host PRIVMSG #chan :hello"))
+	forged.Close()
+	forged.Wait()
+	if len(rec.rejected) != 1 || rec.rejected[0] != signature.InvalidSignatureError {
+		t.Fatalf("Expected the forged delivery to be rejected: %v", rec.rejected)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jnwhiteh/wallops/ircx"
+	"github.com/sorcix/irc"
+)
+
+var (
+	wsAuthTimeout = 10 * time.Second // how long a client has to send its token
+	wsReadLimit   = int64(64 * 1024) // the largest frame a client may send
+	wsReplyBuffer = 16               // replies waiting to be written
+
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+
+		// Sockets are authenticated by the token in the first frame rather
+		// than by cookies, so there's nothing for another origin to abuse
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+)
+
+// HandleWebSocket upgrades the request to a WebSocket. Once the client has
+// sent an "auth" frame with its token, the messages received by the
+// connection are pushed to it as "message" frames, and it can send "send"
+// and "privmsg" frames to speak on IRC.
+func (a *ServerAPI) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded with an error
+		log.Printf("Failed to upgrade WebSocket: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	var auth SocketRequest
+	conn.SetReadLimit(wsReadLimit)
+	conn.SetReadDeadline(time.Now().Add(wsAuthTimeout))
+	if err := conn.ReadJSON(&auth); err != nil || auth.Type != "auth" || auth.Token == "" {
+		writeSocketError(conn, auth.Ref, "Bad request")
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	proxy, err := a.pool.Lookup(auth.Token)
+	if err != nil {
+		writeSocketError(conn, auth.Ref, "Not found")
+		return
+	}
+	if status, _ := proxy.Status(); status == StatusDead {
+		writeSocketError(conn, auth.Ref, "Connection is dead")
+		return
+	}
+
+	s := &socket{
+		conn:     conn,
+		proxy:    proxy,
+		token:    auth.Token,
+		replies:  make(chan SocketResponse, wsReplyBuffer),
+		activity: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	last := auth.LastId
+	if last == 0 {
+		last = proxy.events.Last()
+	}
+	go s.readRequests()
+	s.writeEvents(last)
+}
+
+func writeSocketError(conn *websocket.Conn, ref, message string) {
+	conn.SetWriteDeadline(time.Now().Add(live.Timeouts().Proxy))
+	conn.WriteJSON(SocketResponse{Type: "error", Ref: ref, Error: message})
+}
+
+// socket is an authenticated WebSocket client. Only writeEvents writes to
+// the connection, and only readRequests reads from it.
+type socket struct {
+	conn    *websocket.Conn
+	proxy   *Proxy
+	token   string
+	replies chan SocketResponse // replies to requests, waiting to be written
+
+	activity chan struct{} // signalled whenever the client sends us anything
+	done     chan struct{} // closed when the client stops reading
+	closed   chan struct{} // closed when we stop writing
+}
+
+// readRequests handles frames from the client until the connection fails
+func (s *socket) readRequests() {
+	defer close(s.done)
+	s.conn.SetPongHandler(func(string) error {
+		s.active()
+		return nil
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.active()
+
+		var req SocketRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			s.reply(SocketResponse{Type: "error", Error: "Bad request"})
+			continue
+		}
+		s.reply(s.handle(req))
+	}
+}
+
+func (s *socket) active() {
+	select {
+	case s.activity <- struct{}{}:
+	default:
+	}
+}
+
+func (s *socket) reply(resp SocketResponse) {
+	select {
+	case s.replies <- resp:
+	case <-s.closed:
+	}
+}
+
+// handle sends the message described by a request and returns the reply.
+// Requests are handled one at a time, so a client sending faster than the
+// server accepts messages is held back rather than queueing without limit.
+func (s *socket) handle(req SocketRequest) SocketResponse {
+	var msgs []*ircx.Message
+	switch req.Type {
+	case "send":
+		send := SendRequest{Token: s.token, Tags: req.Tags, Command: req.Command, Params: req.Params}
+		if !send.Valid() {
+			return SocketResponse{Type: "error", Ref: req.Ref, Error: "Bad request"}
+		}
+		msgs = []*ircx.Message{send.Message()}
+	case "privmsg":
+		privmsg := PrivmsgRequest{Token: s.token, Target: req.Target, Text: req.Text, Notice: req.Notice}
+		if !privmsg.Valid() {
+			return SocketResponse{Type: "error", Ref: req.Ref, Error: "Bad request"}
+		}
+		command := irc.PRIVMSG
+		if privmsg.Notice {
+			command = irc.NOTICE
+		}
+		var err error
+		msgs, err = s.proxy.TextMessages(command, privmsg.Target, privmsg.Text)
+		if err != nil {
+			return SocketResponse{Type: "error", Ref: req.Ref, Error: "Bad request"}
+		}
+	default:
+		return SocketResponse{Type: "error", Ref: req.Ref, Error: "Unknown request type"}
+	}
+
+	status, msgids, err := s.proxy.SendAndWait(msgs)
+	if err == ircx.QueueFullError || err == ircx.QueueClosedError {
+		return SocketResponse{Type: "error", Ref: req.Ref, Error: "Too many messages waiting to be sent"}
+	} else if err != nil {
+		log.Printf("Failed to send message: %s", err)
+		return SocketResponse{Type: "error", Ref: req.Ref, Error: "Internal server error"}
+	}
+	return SocketResponse{Type: "result", Ref: req.Ref, Status: status, MsgIds: msgids}
+}
+
+// writeEvents pushes messages after the given id, and replies to requests,
+// to the client until either end gives up.
+//
+// The keepalive follows the same rules as Proxy.ReadMessages: after
+// MissedDeadlines periods of the proxy timeout without hearing from the
+// client we ping it, and if it doesn't answer within the pong timeout the
+// socket is closed. A client that reads too slowly hits the write deadline
+// and is also closed, while one that falls further behind than the event
+// buffer is sent a "reset" frame, just as event streams are.
+func (s *socket) writeEvents(last uint64) {
+	defer close(s.closed)
+
+	ticker := time.NewTicker(live.Timeouts().Proxy)
+	defer ticker.Stop()
+	var waitingForPong <-chan time.Time
+	skippedDeadlines := 0
+
+	for {
+		events, added, complete := s.proxy.events.Since(last)
+		if !complete {
+			if s.write(SocketResponse{Type: "reset"}) != nil {
+				return
+			}
+			last = 0
+		}
+		for _, event := range events {
+			payload := event.payload
+			payload.Token = s.token
+			if s.write(SocketResponse{Type: "message", Id: event.id, Message: &payload}) != nil {
+				return
+			}
+			last = event.id
+		}
+
+		select {
+		case <-added:
+		case resp := <-s.replies:
+			if s.write(resp) != nil {
+				return
+			}
+		case <-s.activity:
+			skippedDeadlines = 0
+			waitingForPong = nil
+		case <-ticker.C:
+			skippedDeadlines++
+			timeouts := live.Timeouts()
+			if skippedDeadlines >= timeouts.MissedDeadlines && waitingForPong == nil {
+				deadline := time.Now().Add(timeouts.Proxy)
+				if s.conn.WriteControl(websocket.PingMessage, nil, deadline) != nil {
+					return
+				}
+				waitingForPong = time.After(timeouts.Pong)
+			}
+		case <-waitingForPong:
+			// We've timed out without a pong
+			return
+		case <-s.proxy.Dead():
+			s.write(SocketResponse{Type: "dead"})
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *socket) write(resp SocketResponse) error {
+	s.conn.SetWriteDeadline(time.Now().Add(live.Timeouts().Proxy))
+	return s.conn.WriteJSON(resp)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/jnwhiteh/wallops/ircx"
+)
+
+func dialSocket(t *testing.T, api *ServerAPI) *websocket.Conn {
+	server := httptest.NewServer(http.HandlerFunc(api.HandleWebSocket))
+	t.Cleanup(server.Close)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) SocketResponse {
+	var resp SocketResponse
+	if err := conn.ReadJSON(&resp); err != nil {
+		t.Fatalf("Failed to read frame: %s", err)
+	}
+	return resp
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	api := &ServerAPI{&NoopConnectionPooler{}}
+	conn := dialSocket(t, api)
+
+	conn.WriteJSON(SocketRequest{Type: "auth", Ref: "1", Token: "invalid"})
+	resp := readFrame(t, conn)
+	if resp.Type != "error" || resp.Ref != "1" || resp.Error != "Not found" {
+		t.Fatalf("Expected an error for an unknown token, got %+v", resp)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	proxy, decoder, server := newPipeProxy()
+	defer server.Close()
+	proxy.events.Add(ircx.ParseMessage(":bob!b@host PRIVMSG #chan :before"))
+	conn := dialSocket(t, &ServerAPI{&NoopConnectionPooler{proxy: proxy}})
+
+	// Resume after the first message, and see the second as it arrives
+	conn.WriteJSON(SocketRequest{Type: "auth", Token: "token", LastId: 1})
+	proxy.events.Add(ircx.ParseMessage(":bob!b@host PRIVMSG #chan :after"))
+	resp := readFrame(t, conn)
+	if resp.Type != "message" || resp.Id != 2 || resp.Message.Params[1] != "after" || resp.Message.Token != "token" {
+		t.Fatalf("Incorrect message frame: %+v", resp)
+	}
+
+	sent := make(chan string, 1)
+	go func() {
+		msg, _ := decoder.Decode()
+		sent <- msg.String()
+	}()
+	conn.WriteJSON(SocketRequest{Type: "privmsg", Ref: "2", Target: "#chan", Text: "hi"})
+	if line := <-sent; line != "PRIVMSG #chan :hi" {
+		t.Fatalf("Incorrect message sent: %s", line)
+	}
+	resp = readFrame(t, conn)
+	if resp.Type != "result" || resp.Ref != "2" || resp.Status != SendQueued {
+		t.Fatalf("Incorrect result frame: %+v", resp)
+	}
+
+	conn.WriteJSON(SocketRequest{Type: "send", Ref: "3", Command: "QUIT"})
+	resp = readFrame(t, conn)
+	if resp.Type != "error" || resp.Ref != "3" {
+		t.Fatalf("Expected an error for a forbidden command, got %+v", resp)
+	}
+}
@@ -0,0 +1,155 @@
+// Package signature signs and verifies the webhook requests that wallops
+// sends to a registered MessageUrl.
+//
+// Each request carries four headers: the time it was signed, a nonce that is
+// new for every attempt, a delivery ID that stays the same when a delivery is
+// retried, and an HMAC-SHA256 of all three along with the body, keyed with
+// the secret returned when the token was registered. Receivers should use a
+// Verifier, which also rejects requests that are too old or whose nonce it
+// has already seen. A retry has a new nonce, so it is accepted even if an
+// earlier attempt was verified but then failed; receivers that must not
+// handle a message twice can use the delivery ID to spot retries.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Wallops-Signature"
+	TimestampHeader = "X-Wallops-Timestamp"
+	DeliveryHeader  = "X-Wallops-Delivery"
+	NonceHeader     = "X-Wallops-Nonce"
+
+	// The prefix of the signature header's value, naming the algorithm
+	schemePrefix = "sha256="
+)
+
+// DefaultTolerance is how far a request's timestamp may be from our clock
+const DefaultTolerance = 5 * time.Minute
+
+var (
+	MissingHeaderError    = fmt.Errorf("Missing signature headers")
+	InvalidSignatureError = fmt.Errorf("Invalid signature")
+	ExpiredError          = fmt.Errorf("Timestamp outside of tolerance")
+	ReplayError           = fmt.Errorf("Request has already been seen")
+)
+
+// Sign returns the signature header value for a body sent at the given time
+// with the given nonce and delivery ID.
+func Sign(secret string, timestamp time.Time, nonce, delivery string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte{'.'})
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{'.'})
+	mac.Write([]byte(delivery))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return schemePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the signature headers on a request
+func SignRequest(r *http.Request, secret string, timestamp time.Time, nonce, delivery string, body []byte) {
+	r.Header.Set(TimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+	r.Header.Set(NonceHeader, nonce)
+	r.Header.Set(DeliveryHeader, delivery)
+	r.Header.Set(SignatureHeader, Sign(secret, timestamp, nonce, delivery, body))
+}
+
+// Check verifies a signature without any replay protection, returning the
+// time the body was signed.
+func Check(secret, signature, timestamp, nonce, delivery string, body []byte) (time.Time, error) {
+	if signature == "" || timestamp == "" || nonce == "" || delivery == "" {
+		return time.Time{}, MissingHeaderError
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, InvalidSignatureError
+	}
+	when := time.Unix(seconds, 0)
+
+	if !strings.HasPrefix(signature, schemePrefix) {
+		return time.Time{}, InvalidSignatureError
+	}
+	expected := Sign(secret, when, nonce, delivery, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return time.Time{}, InvalidSignatureError
+	}
+	return when, nil
+}
+
+// Verifier checks the signatures of requests for a single token, and
+// remembers the nonces it has accepted so that a captured request can't be
+// replayed.
+type Verifier struct {
+	secret    string
+	Tolerance time.Duration // how old (or far in the future) a request may be
+
+	seen map[string]time.Time // accepted nonces and their timestamps
+	sync.Mutex
+}
+
+func NewVerifier(secret string) *Verifier {
+	return &Verifier{
+		secret:    secret,
+		Tolerance: DefaultTolerance,
+		seen:      make(map[string]time.Time),
+	}
+}
+
+// Verify reads and returns the body of a request, returning an error if the
+// signature is missing or wrong, the request is too old, or its nonce has
+// already been accepted.
+func (v *Verifier) Verify(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = v.VerifyBody(r.Header, body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// VerifyBody checks a body that has already been read against the
+// signature headers.
+func (v *Verifier) VerifyBody(header http.Header, body []byte) error {
+	nonce := header.Get(NonceHeader)
+	when, err := Check(v.secret, header.Get(SignatureHeader),
+		header.Get(TimestampHeader), nonce, header.Get(DeliveryHeader), body)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if when.Before(now.Add(-v.Tolerance)) || when.After(now.Add(v.Tolerance)) {
+		return ExpiredError
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	// Anything older than the tolerance would be rejected anyway, so there's
+	// no need to remember it
+	for id, seen := range v.seen {
+		if seen.Before(now.Add(-v.Tolerance)) {
+			delete(v.seen, id)
+		}
+	}
+	if _, ok := v.seen[nonce]; ok {
+		return ReplayError
+	}
+	v.seen[nonce] = when
+	return nil
+}
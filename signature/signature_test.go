@@ -0,0 +1,80 @@
+package signature
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func signedRequest(t *testing.T, secret string, when time.Time, nonce, body string) *http.Request {
+	r, err := http.NewRequest("POST", "http://localhost/hook", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SignRequest(r, secret, when, nonce, "delivery", []byte(body))
+	return r
+}
+
+func TestVerify(t *testing.T) {
+	v := NewVerifier("secret")
+	r := signedRequest(t, "secret", time.Now(), "abc", `{"Command":"PRIVMSG"}`)
+
+	body, err := v.Verify(r)
+	if err != nil {
+		t.Fatalf("Failed to verify a valid request: %s", err)
+	}
+	if string(body) != `{"Command":"PRIVMSG"}` {
+		t.Fatalf("Body was not returned: %q", body)
+	}
+}
+
+func TestVerifyRejectsForgeries(t *testing.T) {
+	v := NewVerifier("secret")
+	now := time.Now()
+
+	r := signedRequest(t, "wrong", now, "abc", "{}")
+	if _, err := v.Verify(r); err != InvalidSignatureError {
+		t.Fatalf("Expected a bad secret to be rejected, got %v", err)
+	}
+
+	// A valid signature doesn't cover a different body
+	r = signedRequest(t, "secret", now, "abc", "{}")
+	r.Body = http.NoBody
+	if _, err := v.Verify(r); err != InvalidSignatureError {
+		t.Fatalf("Expected a modified body to be rejected, got %v", err)
+	}
+
+	// Nor a different delivery ID
+	r = signedRequest(t, "secret", now, "abc", "{}")
+	r.Header.Set(DeliveryHeader, "other")
+	if _, err := v.Verify(r); err != InvalidSignatureError {
+		t.Fatalf("Expected a modified delivery ID to be rejected, got %v", err)
+	}
+
+	r = signedRequest(t, "secret", now, "abc", "{}")
+	r.Header.Del(SignatureHeader)
+	if _, err := v.Verify(r); err != MissingHeaderError {
+		t.Fatalf("Expected a missing signature to be rejected, got %v", err)
+	}
+}
+
+func TestVerifyRejectsReplays(t *testing.T) {
+	v := NewVerifier("secret")
+	now := time.Now()
+
+	if _, err := v.Verify(signedRequest(t, "secret", now, "abc", "{}")); err != nil {
+		t.Fatalf("Failed to verify a valid request: %s", err)
+	}
+	if _, err := v.Verify(signedRequest(t, "secret", now, "abc", "{}")); err != ReplayError {
+		t.Fatalf("Expected a replayed request to be rejected, got %v", err)
+	}
+	if _, err := v.Verify(signedRequest(t, "secret", now, "retry", "{}")); err != nil {
+		t.Fatalf("Expected a retry of the delivery with a new nonce to be accepted, got %v", err)
+	}
+
+	old := now.Add(-2 * DefaultTolerance)
+	if _, err := v.Verify(signedRequest(t, "secret", old, "def", "{}")); err != ExpiredError {
+		t.Fatalf("Expected an old delivery to be rejected, got %v", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"testing"
 
+	"github.com/jnwhiteh/wallops/ircx"
 	"github.com/sorcix/irc"
 )
 
@@ -21,7 +22,7 @@ func NewDummyConn() *dummyConn {
 }
 
 type maybeMessage struct {
-	message *irc.Message
+	message *ircx.Message
 	err     error
 }
 
@@ -31,7 +32,7 @@ type timeoutReader struct {
 	queue []maybeMessage
 }
 
-func (r *timeoutReader) ReadMessage() (*irc.Message, error) {
+func (r *timeoutReader) ReadMessage() (*ircx.Message, error) {
 	item := r.queue[0]
 	r.queue = r.queue[1:]
 	return item.message, item.err
@@ -57,7 +58,7 @@ type captureWriter struct {
 	messages []maybeMessage
 }
 
-func (w *captureWriter) WriteMessage(msg *irc.Message) error {
+func (w *captureWriter) WriteMessage(msg *ircx.Message) error {
 	w.messages = append(w.messages, maybeMessage{message: msg})
 	return nil
 }
@@ -81,7 +82,7 @@ func TestReadTimeoutCausesPing(t *testing.T) {
 	writer := &captureWriter{}
 
 	// all reads will timeout
-	for i := 0; i < missedDeadlineLimit+1; i++ {
+	for i := 0; i < live.Timeouts().MissedDeadlines+1; i++ {
 		reader.queue = append(reader.queue, timeoutMsg)
 	}
 
@@ -108,7 +109,7 @@ func TestReadTimeoutCausesPing(t *testing.T) {
 func TestDeadlineExtended(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
 	timeoutMsg := maybeMessage{nil, timeoutError{}}
-	validMsg := maybeMessage{&irc.Message{}, nil}
+	validMsg := maybeMessage{ircx.Wrap(&irc.Message{}), nil}
 
 	reader := &timeoutReader{
 		queue: []maybeMessage{
@@ -117,7 +118,7 @@ func TestDeadlineExtended(t *testing.T) {
 		},
 	}
 
-	for i := 0; i < missedDeadlineLimit+1; i++ {
+	for i := 0; i < live.Timeouts().MissedDeadlines+1; i++ {
 		reader.queue = append(reader.queue, timeoutMsg)
 	}
 
@@ -128,7 +129,7 @@ func TestDeadlineExtended(t *testing.T) {
 		writer: writer,
 	}
 
-	incoming := make(chan *irc.Message, 1)
+	incoming := make(chan *ircx.Message, 1)
 	failure := make(chan error, 1)
 	proxy.ReadMessages(incoming, failure)
 
@@ -156,7 +157,7 @@ func TestUnexpectedError(t *testing.T) {
 		reader: reader,
 	}
 
-	incoming := make(chan *irc.Message, 1)
+	incoming := make(chan *ircx.Message, 1)
 	failure := make(chan error, 1)
 	proxy.ReadMessages(incoming, failure)
 
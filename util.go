@@ -6,12 +6,11 @@ import (
 	"math/rand"
 	"time"
 
+	"github.com/jnwhiteh/wallops/ircx"
 	"github.com/mgutz/ansi"
 	"github.com/sorcix/irc"
 )
 
-const maxNickLength = 9
-
 var colorIncoming = ansi.ColorCode("green:black")
 var colorOutgoing = ansi.ColorCode("green+bh:black")
 var colorWarning = ansi.ColorCode("yellow:black")
@@ -22,10 +21,16 @@ var colorConsole = ansi.ColorCode("blue+bh:black")
 var parseError = fmt.Errorf("Failed parsing IRC message")
 
 // randomNick will create a random nickname based on a desired name, with a
-// small random bit at the end.
-func randomNick(nickname string) string {
+// small random bit at the end, that fits within the server's maximum nickname
+// length. At least the first character of the name is kept, however short
+// the maximum is.
+func randomNick(nickname string, maxNickLength int) string {
 	randomBit := rand.Intn(99)
-	shortNick := truncate(nickname, maxNickLength-3)
+	keep := maxNickLength - 3
+	if keep < 1 {
+		keep = 1
+	}
+	shortNick := truncate(nickname, keep)
 	return fmt.Sprintf("%s_%0d", shortNick, randomBit)
 }
 
@@ -37,39 +42,57 @@ func truncate(s string, l int) string {
 	}
 }
 
-func logSend(msg *irc.Message) {
-	log.Printf("%s--> %s%s", colorOutgoing, msg, colorReset)
+// isText reports whether a message is a PRIVMSG or NOTICE to a single target
+func isText(msg *ircx.Message) bool {
+	return (msg.Command == irc.PRIVMSG || msg.Command == irc.NOTICE) &&
+		len(msg.Params) == 1
 }
 
-func logRecv(msg *irc.Message) {
-	log.Printf("%s<-- %s%s", colorIncoming, msg, colorReset)
+// conversation returns the channel or query that text belongs to: where it
+// was sent, or the sender if it was sent to us
+func (p *Proxy) conversation(msg *ircx.Message) string {
+	target := msg.Params[0]
+	if msg.Prefix != nil && p.isupport.Fold(target) == p.isupport.Fold(p.currentNick) {
+		return msg.Prefix.Name
+	}
+	return target
 }
 
-func send(encoder *irc.Encoder, msg *irc.Message) error {
-	logSend(msg)
-	return encoder.Encode(msg)
+// network returns the name of the network we are connected to, or the
+// server's host if it hasn't said
+func (p *Proxy) network() string {
+	if network := p.isupport.Network(); network != "" {
+		return network
+	}
+	return p.config.host
 }
 
-func getExponentialBackoffDelay(attempt uint) time.Duration {
-	randomBit := time.Millisecond * time.Duration(rand.Int63n(1001))
-	return (time.Second * (1 << (attempt + 1))) + randomBit
+// sentAt returns when a message was sent, according to its server-time tag,
+// or now if it doesn't have one
+func sentAt(msg *ircx.Message) time.Time {
+	if when, ok := msg.Time(); ok {
+		return when
+	}
+	return time.Now()
 }
 
-// safeDecode fixes the semantics of the irc package to ensure we can properly
-// handle error and invalid messages.
-//
-// The decoder will ONLY return an error if the underlying bufio.Reader
-// returns an error, normally io.EOF. However it may also return a nil
-// message, which obviously cannot be used. These cases are converted into a
-// parseError return.
-func safeDecode(decoder *irc.Decoder) (*irc.Message, error) {
-	msg, err := decoder.Decode()
-	if err != nil {
-		return nil, err
-	}
-	if msg == nil {
-		return nil, parseError
+func logSend(msg *ircx.Message) {
+	if !live.Debug() {
+		return
 	}
+	log.Printf("%s--> %s%s", colorOutgoing, msg, colorReset)
+}
+
+// received counts and logs a message read from the server while we register,
+// before the console is subscribed to them
+func received(msg *ircx.Message) {
+	messagesReceived.Inc()
 	logRecv(msg)
-	return msg, err
+}
+
+func logRecv(msg *ircx.Message) {
+	if !live.Debug() {
+		return
+	}
+	log.Printf("%s<-- %s%s", colorIncoming, msg, colorReset)
 }
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRandomNick(t *testing.T) {
+	for maxNickLength, prefix := range map[int]string{
+		30: "wallops_",
+		9:  "wallop_",
+		3:  "w_",
+		1:  "w_",
+		0:  "w_",
+	} {
+		if nick := randomNick("wallops", maxNickLength); !strings.HasPrefix(nick, prefix) {
+			t.Errorf("randomNick with NICKLEN=%d gave %q, expected it to start with %q", maxNickLength, nick, prefix)
+		}
+	}
+}